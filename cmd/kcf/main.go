@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"internal/kcf"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func die(err error) {
@@ -12,49 +21,154 @@ func die(err error) {
 	os.Exit(1)
 }
 
+// version is the version of the archiver, which is also stored in the
+// headers of archives it creates.
+const version = "v0.0.1"
+
 func banner() {
-	fmt.Println("KCF archiver v0.0.1 by Danila A. Kondratenko")
+	fmt.Println("KCF archiver " + version + " by Danila A. Kondratenko")
 	fmt.Println("(c) 2024")
 	fmt.Println()
 }
 
+func usage() {
+	fmt.Printf("Usage: %s [x|l|c|u|f] [options] archive "+
+		"[file1 ... fileN]\n", os.Args[0])
+	fmt.Println()
+	fmt.Println("  x  extract files from archive, only given ones if any")
+	fmt.Println("  l  list archive contents")
+	fmt.Println("  c  create archive")
+	fmt.Println("  u  add new files and replace changed ones")
+	fmt.Println("  f  replace changed files already in archive")
+	fmt.Println()
+	fmt.Printf("Run %s <command> -h to list options of the command.\n",
+		os.Args[0])
+	os.Exit(0)
+}
+
 func main() {
 	banner()
 
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s [x|c] archive [file1 ... fileN]\n",
-			os.Args[0])
-		os.Exit(0)
+	if len(os.Args) < 3 {
+		usage()
 	}
 
 	var retVal int
 
 	switch os.Args[1] {
 	case "x":
-		retVal = unpack(os.Args[2])
+		retVal = unpack(os.Args[2:])
+		break
+	case "l":
+		retVal = list(os.Args[2:])
 		break
 	case "c":
-		retVal = pack(os.Args[2], os.Args[3:])
+		retVal = create(os.Args[2:])
 		break
+	case "u":
+		retVal = update(os.Args[2:], false)
+		break
+	case "f":
+		retVal = update(os.Args[2:], true)
+		break
+	default:
+		usage()
 	}
 
 	os.Exit(retVal)
 }
 
-func unpack(archivePath string) int {
-	archive, err := kcf.OpenArchive(archivePath)
+// listFlag returns a flag function appending comma-separated values
+// to the list.
+func listFlag(list *[]string) func(string) error {
+	return func(value string) error {
+		*list = append(*list, strings.Split(value, ",")...)
+		return nil
+	}
+}
+
+func addXattrFlags(flags *flag.FlagSet, filter *kcf.XattrFilter) {
+	flags.Func("xattrs-include",
+		"comma-separated namespaces of extended attributes to keep",
+		listFlag(&filter.Include))
+	flags.Func("xattrs-exclude",
+		"comma-separated namespaces of extended attributes to drop",
+		listFlag(&filter.Exclude))
+}
+
+type unpackOptions struct {
+	sameOwner        bool
+	numericOwner     bool
+	samePermissions  bool
+	allowUnsafeLinks bool
+	umask            os.FileMode
+	xattrFilter      kcf.XattrFilter
+}
+
+func unpack(args []string) int {
+	var opts unpackOptions
+
+	isRoot := os.Geteuid() == 0
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	sameOwner := flags.Bool("same-owner", isRoot,
+		"restore owners of files")
+	noSameOwner := flags.Bool("no-same-owner", false,
+		"extract files as yourself")
+	flags.BoolVar(&opts.numericOwner, "numeric-owner", false,
+		"use numeric user and group ids instead of names")
+	samePermissions := flags.Bool("same-permissions", isRoot,
+		"restore permissions of files as they are")
+	noSamePermissions := flags.Bool("no-same-permissions", false,
+		"apply umask to permissions and drop setuid, setgid and "+
+			"sticky bits")
+	flags.BoolVar(&opts.allowUnsafeLinks, "allow-unsafe-links", false,
+		"create symbolic links pointing outside of the current "+
+			"directory")
+	addXattrFlags(flags, &opts.xattrFilter)
+	memoryLimit := flags.Uint64("memory-limit", 0,
+		"do not unpack files needing more than `MiB` of memory to "+
+			"decompress (default no limit)")
+	jobs := flags.Int("j", 1, "decompress up to `N` blocks of files "+
+		"packed in independent blocks at once")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	members := flags.Args()[1:]
+	for _, member := range members {
+		if _, err := path.Match(member, ""); err != nil {
+			die(err)
+		}
+	}
+
+	opts.sameOwner = *sameOwner && !*noSameOwner
+	opts.samePermissions = *samePermissions && !*noSamePermissions
+	if !opts.samePermissions {
+		opts.umask = umask()
+	}
+
+	archive, err := kcf.OpenArchive(flags.Arg(0))
 	if err != nil {
 		die(err)
 	}
+	defer archive.Close()
 
 	err = archive.InitArchive()
 	if err != nil {
 		die(err)
 	}
+	archive.SetReaderOptions(kcf.ReaderOptions{
+		MemoryLimit: *memoryLimit << 20,
+		Workers:     *jobs,
+	})
 
 	var fileInfo kcf.FileHeader
-	var output *os.File
-	for err == nil {
+	var dirs []kcf.FileHeader
+	var retVal int
+	for {
 		fileInfo, err = archive.GetCurrentFile()
 		if err != nil && err != io.EOF {
 			die(err)
@@ -63,52 +177,941 @@ func unpack(archivePath string) int {
 			break
 		}
 
+		// Data of other files are skipped without decompressing them,
+		// so solid blocks holding none of the members are not decoded.
+		if !isSelected(fileInfo.FileName, members) {
+			_, err = archive.UnpackFile(io.Discard)
+			if err != nil && err != io.EOF {
+				die(err)
+			}
+			continue
+		}
+
 		fmt.Println("Unpacking", fileInfo.FileName)
 
-		output, err = os.Create(fileInfo.FileName)
-		if err != nil {
-			die(err)
+		switch fileInfo.FileType {
+		case kcf.DIRECTORY:
+			err = os.MkdirAll(fileInfo.FileName, 0755)
+			if err != nil {
+				die(err)
+			}
+
+			_, err = archive.UnpackFile(io.Discard)
+			if err != nil && err != io.EOF {
+				die(err)
+			}
+
+			dirs = append(dirs, fileInfo)
+			continue
+		case kcf.SYMLINK:
+			err = unpackSymlink(archive, fileInfo, opts)
+		case kcf.HARDLINK:
+			err = unpackHardLink(archive, fileInfo, opts)
+		case kcf.FIFO, kcf.SOCKET, kcf.CHAR_DEVICE, kcf.BLOCK_DEVICE:
+			err = unpackSpecial(archive, fileInfo)
+		default:
+			err = unpackRegular(archive, fileInfo)
 		}
-		defer output.Close()
 
-		_, err = archive.UnpackFile(output)
+		if err == errSkipped {
+			retVal = 2
+			continue
+		}
 		if err != nil && err != io.EOF {
 			die(err)
 		}
+
+		if err = restoreMetadata(fileInfo, opts); err != nil {
+			die(err)
+		}
 	}
 
+	// Creating files changes modification time of their directories
+	// and may be forbidden by their permissions, so the metadata of
+	// directories is restored after everything has been unpacked.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = restoreMetadata(dirs[i], opts); err != nil {
+			die(err)
+		}
+	}
+
+	return retVal
+}
+
+var errSkipped = errors.New("file has been skipped")
+
+// isSelected reports whether the archived file is to be unpacked when
+// members are given. A member selects files whose names or names of
+// their parent directories match it as a pattern. No members select
+// every file.
+func isSelected(name string, members []string) bool {
+	if len(members) == 0 {
+		return true
+	}
+
+	name = filepath.Clean(name)
+	for _, member := range members {
+		member = filepath.Clean(member)
+		for dir := name; ; {
+			if matched, _ := path.Match(member, dir); matched {
+				return true
+			}
+
+			parent := filepath.Dir(dir)
+			if parent == dir || parent == "." {
+				break
+			}
+			dir = parent
+		}
+	}
+
+	return false
+}
+
+func unpackRegular(archive *kcf.Kcf, fileInfo kcf.FileHeader) (err error) {
+	err = os.MkdirAll(filepath.Dir(fileInfo.FileName), 0755)
+	if err != nil {
+		return
+	}
+
+	var output *os.File
+	output, err = os.Create(fileInfo.FileName)
+	if err != nil {
+		return
+	}
+	defer output.Close()
+
+	_, err = archive.UnpackFile(output)
+	return
+}
+
+func unpackSymlink(archive *kcf.Kcf, fileInfo kcf.FileHeader,
+	opts unpackOptions) (err error) {
+	var target strings.Builder
+
+	_, err = archive.UnpackFile(&target)
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(fileInfo.FileName), 0755)
+	if err != nil {
+		return
+	}
+
+	if !opts.allowUnsafeLinks &&
+		!isInsideRoot(fileInfo.FileName, target.String()) {
+		fmt.Printf("Skipping %s: link target %s is outside "+
+			"of the extraction directory\n",
+			fileInfo.FileName, target.String())
+		return errSkipped
+	}
+
+	err = os.Remove(fileInfo.FileName)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return os.Symlink(target.String(), fileInfo.FileName)
+}
+
+func unpackHardLink(archive *kcf.Kcf, fileInfo kcf.FileHeader,
+	opts unpackOptions) (err error) {
+	var target strings.Builder
+
+	_, err = archive.UnpackFile(&target)
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	if !opts.allowUnsafeLinks && !isLinkableTarget(target.String()) {
+		fmt.Printf("Skipping %s: link target %s is outside "+
+			"of the extraction directory\n",
+			fileInfo.FileName, target.String())
+		return errSkipped
+	}
+
+	err = os.MkdirAll(filepath.Dir(fileInfo.FileName), 0755)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(fileInfo.FileName)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return os.Link(target.String(), fileInfo.FileName)
+}
+
+// unpackSpecial creates FIFOs, sockets and device files. If they cannot
+// be created because of missing privileges, they are skipped.
+func unpackSpecial(archive *kcf.Kcf, fileInfo kcf.FileHeader) (err error) {
+	_, err = archive.UnpackFile(io.Discard)
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(fileInfo.FileName), 0755)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(fileInfo.FileName)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	err = kcf.CreateSpecialFile(fileInfo.FileName, fileInfo)
+	if errors.Is(err, os.ErrPermission) ||
+		errors.Is(err, errors.ErrUnsupported) {
+		fmt.Printf("Skipping %s: %v\n", fileInfo.FileName, err)
+		return errSkipped
+	}
+
+	return
+}
+
+// isInsideRoot reports whether the target of the symbolic link name
+// resolves to a path inside the current directory.
+func isInsideRoot(name string, target string) bool {
+	return resolvesInsideRoot(filepath.Dir(name), target)
+}
+
+// isLinkableTarget reports whether the target of a hard link resolves
+// to a path inside the current directory which is not a symbolic link.
+// Otherwise the link could make a later entry overwrite a file outside
+// of it.
+func isLinkableTarget(target string) bool {
+	if !resolvesInsideRoot(".", target) {
+		return false
+	}
+
+	info, err := os.Lstat(target)
+	return err != nil || info.Mode()&os.ModeSymlink == 0
+}
+
+// resolvesInsideRoot reports whether target relative to dir resolves
+// to a path inside the current directory. Links met on the way are
+// followed, so chains of links cannot lead outside either.
+func resolvesInsideRoot(dir string, target string) bool {
+	const maxLinks = 255
+
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+
+	// The target is not cleaned, so that every ".." in it applies to
+	// the directory resolved on disk so far and not to a link name.
+	var resolved []string
+	var links int
+
+	pending := append(splitPath(dir), splitPath(target)...)
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return false
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		path := filepath.Join(append(resolved, part)...)
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return false
+		}
+
+		link, err := os.Readlink(path)
+		if err != nil || filepath.IsAbs(link) {
+			return false
+		}
+
+		pending = append(splitPath(link), pending...)
+	}
+
+	return true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.ToSlash(path), "/")
+}
+
+// restoreMetadata sets owner, permissions and times of the unpacked
+// file.
+func restoreMetadata(fileInfo kcf.FileHeader, opts unpackOptions) (
+	err error,
+) {
+	meta := fileInfo.Metadata
+	isLink := fileInfo.FileType == kcf.SYMLINK
+
+	if opts.sameOwner {
+		if uid, gid, ok := meta.Owner(opts.numericOwner); ok {
+			err = os.Lchown(fileInfo.FileName, uid, gid)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// Permissions and times of symbolic links cannot be changed
+	// without following them.
+	if isLink {
+		return
+	}
+
+	if (meta.MetaFlags & kcf.HAS_MODE) != 0 {
+		mode := meta.FileMode()
+		if !opts.samePermissions {
+			mode &= os.ModePerm &^ opts.umask
+		}
+
+		err = os.Chmod(fileInfo.FileName, mode)
+		if err != nil {
+			return
+		}
+	}
+
+	// Extended attributes are set after the owner, since changing the
+	// owner drops file capabilities. Attributes which cannot be set,
+	// for example because of missing privileges, are reported only.
+	xattrs := fileInfo.Xattrs.Filter(opts.xattrFilter)
+	if err = kcf.RestoreXattrs(fileInfo.FileName, xattrs); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+
+	return restoreTimes(fileInfo)
+}
+
+// restoreTimes sets access and modification times of the unpacked
+// file. Change and birth times cannot be set by user programs, so
+// they are left as is.
+func restoreTimes(fileInfo kcf.FileHeader) error {
+	modTime := fileInfo.ModTime()
+	accessTime := fileInfo.Metadata.AccessTime
+	if modTime.IsZero() && accessTime.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(fileInfo.FileName, accessTime, modTime)
+}
+
+// collectFiles returns the given paths followed by contents of
+// directories among them, walked recursively in lexical order.
+func collectFiles(paths []string) (files []string, err error) {
+	for _, root := range paths {
+		err = filepath.WalkDir(filepath.Clean(root),
+			func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+
+				files = append(files, path)
+				return nil
+			})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// packFile queues the file to be packed with the compression method of
+// the first rule matching its name, or the default one.
+func packFile(pipeline *kcf.Pipeline, filePath string, opts *packOptions) (
+	err error,
+) {
+	writer := opts.writer
+	name := filepath.Base(filePath)
+	for _, rule := range opts.rules {
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			writer.Filters = rule.filters
+			writer.Compression = rule.compression
+			writer.AutoCompression = false
+			break
+		}
+	}
+
+	return pipeline.PackPath(filePath, writer)
+}
+
+// checkFilters rejects filters given by -m or -method-for if
+// -format-version selects a version without coder chains. Filters of
+// method rules for -m auto are left out in such versions instead.
+func checkFilters(opts *packOptions) error {
+	if opts.writer.Version == 0 || opts.writer.Version >= 2 {
+		return nil
+	}
+
+	hasFilters := len(opts.writer.Filters) > 0
+	for _, rule := range opts.rules {
+		hasFilters = hasFilters || len(rule.filters) > 0
+	}
+	if hasFilters {
+		return errors.New("filters need format version 2 or later")
+	}
+
+	return nil
+}
+
+// compressionRule selects filters and the compression method of files
+// whose base names match pattern.
+type compressionRule struct {
+	pattern     string
+	filters     []uint32
+	compression uint32
+}
+
+type packOptions struct {
+	writer    kcf.WriterOptions
+	rules     []compressionRule
+	rulesPath string
+	comment   *string
+	jobs      int
+}
+
+func addPackFlags(flags *flag.FlagSet, opts *packOptions) {
+	addXattrFlags(flags, &opts.writer.XattrFilter)
+	flags.Func("m", "compression `method` of files: store, "+
+		"lz4[:block=SIZE], lzma[:dict=SIZE,lc=N,lp=N,pb=N] or "+
+		"ppmd[:order=N,mem=SIZE], which may be preceded by up to two "+
+		"filters joined by '+' in format version 2: x86, arm64, riscv or "+
+		"delta[:dist=N]; auto stores compressed files and selects "+
+		"methods of others by -method-rules, lzma by default",
+		func(spec string) (err error) {
+			opts.writer.AutoCompression = spec == "auto"
+			if opts.writer.AutoCompression {
+				spec = "lzma"
+			}
+
+			opts.writer.Filters, opts.writer.Compression, err =
+				kcf.ParseCoderChain(spec)
+			return
+		})
+	flags.StringVar(&opts.rulesPath, "method-rules", "", "read rules "+
+		"selecting methods of files for -m auto from `file` instead of "+
+		"$XDG_CONFIG_HOME/"+defaultMethodRules)
+	flags.BoolVar(&opts.writer.AutoBCJ, "auto-bcj", false,
+		"filter x86, ARM64 and RISC-V ELF executables by BCJ filters")
+	flags.BoolVar(&opts.writer.AutoDelta, "auto-delta", false,
+		"filter PCM audio, raw images and other fixed-size records by delta")
+	flags.Func("method-for", "compress files whose names match a "+
+		"pattern by another method, given as `PATTERN=METHOD`; may be "+
+		"repeated, the first match wins", func(s string) (err error) {
+		pattern, spec, ok := strings.Cut(s, "=")
+		if !ok {
+			return errors.New("expected PATTERN=METHOD")
+		}
+		if _, err = path.Match(pattern, ""); err != nil {
+			return
+		}
+
+		rule := compressionRule{pattern: pattern}
+		rule.filters, rule.compression, err = kcf.ParseCoderChain(spec)
+		opts.rules = append(opts.rules, rule)
+		return
+	})
+	flags.IntVar(&opts.jobs, "j", 1, "compress up to `N` files or "+
+		"blocks of files at once")
+	flags.Func("solid", "compress regular files together in solid "+
+		"blocks of up to `MiB` in format version 2 (default not solid)",
+		func(s string) error {
+			size, err := strconv.ParseUint(s, 10, 64)
+			opts.writer.Solid.BlockSize = size << 20
+			return err
+		})
+	flags.IntVar(&opts.writer.Solid.Files, "solid-files", 0,
+		"put at most `N` files into a solid block (default no limit)")
+	flags.BoolVar(&opts.writer.Solid.ByExtension, "solid-by-ext", false,
+		"put files with different extensions into different solid blocks")
+	flags.Func("z", "read archive comment from `file`",
+		func(path string) error {
+			comment, err := os.ReadFile(path)
+			opts.comment = new(string)
+			*opts.comment = string(comment)
+			return err
+		})
+	flags.Func("format-version",
+		fmt.Sprintf("archive format version to write, %d to %d "+
+			"(default the lowest one covering the features used)",
+			kcf.MinVersion, kcf.MaxVersion),
+		func(s string) error {
+			version, err := strconv.ParseUint(s, 10, 16)
+			opts.writer.Version = uint16(version)
+			return err
+		})
+}
+
+// archiveFlagNames names archive flags in the order they are listed.
+var archiveFlagNames = []struct {
+	flag kcf.ArchiveFlags
+	name string
+}{
+	{kcf.IS_SOLID, "solid"},
+	{kcf.IS_ENCRYPTED, "encrypted"},
+	{kcf.IS_MULTI_VOLUME, "multi-volume"},
+	{kcf.HAS_INDEX, "has index"},
+}
+
+func printArchiveHeader(ahdr kcf.ArchiveHeader) {
+	fmt.Println("Format version:", ahdr.Version)
+
+	if ahdr.CreationTime.IsZero() {
+		return
+	}
+
+	creator := ahdr.Creator
+	if creator == "" {
+		creator = "unknown program"
+	}
+	fmt.Printf("Created: %s by %s on %s\n",
+		ahdr.CreationTime.Format("2006-01-02 15:04:05 -0700"),
+		creator, ahdr.HostOS)
+
+	var flagNames []string
+	for _, f := range archiveFlagNames {
+		if ahdr.ArchiveFlags&f.flag != 0 {
+			flagNames = append(flagNames, f.name)
+		}
+	}
+	if len(flagNames) > 0 {
+		fmt.Println("Flags:", strings.Join(flagNames, ", "))
+	}
+}
+
+// listMode returns the mode of the archived file including its type.
+func listMode(fileInfo kcf.FileHeader) os.FileMode {
+	mode := fileInfo.Metadata.FileMode()
+
+	switch fileInfo.FileType {
+	case kcf.DIRECTORY:
+		mode |= os.ModeDir
+	case kcf.SYMLINK:
+		mode |= os.ModeSymlink
+	case kcf.FIFO:
+		mode |= os.ModeNamedPipe
+	case kcf.SOCKET:
+		mode |= os.ModeSocket
+	case kcf.CHAR_DEVICE:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case kcf.BLOCK_DEVICE:
+		mode |= os.ModeDevice
+	}
+
+	return mode
+}
+
+// printComment prints the comment indented.
+func printComment(comment string) {
+	for _, line := range strings.Split(strings.TrimRight(comment, "\n"), "\n") {
+		fmt.Println("    " + line)
+	}
+}
+
+func list(args []string) int {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	archive, err := kcf.OpenArchive(flags.Arg(0))
+	if err != nil {
+		die(err)
+	}
+	defer archive.Close()
+
+	if err = archive.InitArchive(); err != nil {
+		die(err)
+	}
+
+	fileInfo, err := archive.GetCurrentFile()
 	if err != nil && err != io.EOF {
 		die(err)
 	}
 
+	// The archive comment precedes the first file, so it is known now.
+	printArchiveHeader(archive.ArchiveHeader())
+	if comment := archive.Comment(); comment != "" {
+		fmt.Println("Comment:")
+		printComment(comment)
+	}
+	fmt.Println()
+	fmt.Printf("%-11s %12s  %-19s  %-14s %s\n",
+		"Mode", "Size", "Modified", "Method", "Name")
+
+	for ; err != io.EOF; fileInfo, err = archive.GetCurrentFile() {
+		if err != nil {
+			die(err)
+		}
+
+		name := fileInfo.FileName
+		if fileInfo.FileType == kcf.SYMLINK ||
+			fileInfo.FileType == kcf.HARDLINK {
+			var target strings.Builder
+
+			_, err = archive.UnpackFile(&target)
+			if err != nil && err != io.EOF {
+				die(err)
+			}
+
+			arrow := " -> "
+			if fileInfo.FileType == kcf.HARDLINK {
+				arrow = " link to "
+			}
+			name += arrow + target.String()
+		} else {
+			_, err = archive.UnpackFile(io.Discard)
+			if err != nil && err != io.EOF {
+				die(err)
+			}
+		}
+
+		var modified string
+		if modTime := fileInfo.ModTime(); !modTime.IsZero() {
+			modified = modTime.Format("2006-01-02 15:04:05")
+		}
+
+		fmt.Printf("%-11s %12d  %-19s  %-14s %s\n", listMode(fileInfo),
+			fileInfo.UnpackedSize, modified,
+			kcf.CoderChainName(fileInfo.Filters, fileInfo.CompressionInfo),
+			name)
+		if fileInfo.Comment != "" {
+			printComment(fileInfo.Comment)
+		}
+	}
+
 	return 0
 }
 
-func pack(archiveName string, filePaths []string) int {
+func create(args []string) int {
+	var opts packOptions
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	addPackFlags(flags, &opts)
+	flags.Parse(args)
+
+	if err := loadMethodRules(&opts); err != nil {
+		die(err)
+	}
+	if err := checkFilters(&opts); err != nil {
+		die(err)
+	}
+
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	return pack(flags.Arg(0), flags.Args()[1:], &opts)
+}
+
+func pack(archiveName string, filePaths []string, opts *packOptions) int {
 	var archive *kcf.Kcf
 	var err error
 
+	filePaths, err = collectFiles(filePaths)
+	if err != nil {
+		die(err)
+	}
+
 	archive, err = kcf.CreateNewArchive(archiveName)
 	if err != nil {
 		panic(err)
 	}
+	defer archive.Close()
 
+	opts.writer.Creator = "kcf " + version
+	archive.SetWriterOptions(opts.writer)
 	if err = archive.InitArchive(); err != nil {
-		panic(err)
+		die(err)
+	}
+
+	if opts.comment != nil {
+		if err = archive.SetComment(*opts.comment); err != nil {
+			die(err)
+		}
 	}
 
-	var file *os.File
+	pipeline := archive.NewPipeline(opts.jobs)
 	for _, filePath := range filePaths {
 		fmt.Printf("Packing %s...\n", filePath)
-		if file, err = os.Open(filePath); err != nil {
+		if err = packFile(pipeline, filePath, opts); err != nil {
 			panic(err)
 		}
+	}
 
-		err = archive.PackFileRaw(file)
+	if err = pipeline.Close(); err != nil {
+		panic(err)
+	}
+
+	return 0
+}
+
+// isChanged reports whether the file on disk differs from its archived
+// version.
+func isChanged(fileInfo kcf.FileHeader, checkCRC bool) (bool, error) {
+	info, err := os.Lstat(fileInfo.FileName)
+	if err != nil {
+		return false, err
+	}
+
+	if !fileInfo.IsUpToDate(info) {
+		return true, nil
+	}
+
+	if !checkCRC || info.IsDir() || fileInfo.FileType == kcf.HARDLINK {
+		return false, nil
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fileInfo.FileName)
 		if err != nil {
-			panic(err)
+			return false, err
+		}
+
+		same, err := fileInfo.HasSameCRC32(strings.NewReader(target))
+		return !same, err
+	}
+
+	file, err := os.Open(fileInfo.FileName)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	same, err := fileInfo.HasSameCRC32(file)
+	return !same, err
+}
+
+// copyFile copies the current file of src into dst once files queued
+// to the pipeline are written. In solid archives, files no larger than
+// solid blocks are unpacked and queued to the pipeline instead, so that
+// they go to solid blocks together with other files.
+func copyFile(src *kcf.Kcf, dst *kcf.Kcf, pipeline *kcf.Pipeline,
+	fileInfo kcf.FileHeader, opts *packOptions) error {
+	isSolid := dst.ArchiveHeader().ArchiveFlags&kcf.IS_SOLID != 0
+	if !isSolid || fileInfo.FileFlags&kcf.IS_SPARSE != 0 ||
+		fileInfo.UnpackedSize > opts.writer.Solid.BlockSize {
+		if err := pipeline.Flush(); err != nil {
+			return err
 		}
+
+		return dst.CopyFileRaw(src)
+	}
+
+	var data bytes.Buffer
+	_, err := src.UnpackFile(&data)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return pipeline.PackFile(fileInfo, data.Bytes())
+}
+
+// update rewrites the archive replacing changed files with their
+// current versions from disk. Unless freshen is set, files which are
+// not in the archive yet are appended to it. If no files are given,
+// every file of the archive is checked.
+func update(args []string, freshen bool) int {
+	var opts packOptions
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	checkCRC := flags.Bool("crc", false,
+		"compare CRC32 of files besides size and time")
+	addPackFlags(flags, &opts)
+	flags.Parse(args)
+
+	if err := loadMethodRules(&opts); err != nil {
+		die(err)
+	}
+	if err := checkFilters(&opts); err != nil {
+		die(err)
+	}
+
+	if flags.NArg() < 1 {
+		usage()
+	}
+
+	archivePath := flags.Arg(0)
+	filePaths, err := collectFiles(flags.Args()[1:])
+	if err != nil {
+		die(err)
+	}
+
+	if _, err = os.Stat(archivePath); os.IsNotExist(err) && !freshen {
+		return pack(archivePath, flags.Args()[1:], &opts)
+	}
+
+	err = updateArchive(archivePath, filePaths, freshen, *checkCRC, &opts)
+	if err != nil {
+		die(err)
 	}
 
 	return 0
 }
+
+// updateArchive writes the updated archive at archivePath into a
+// temporary file, which replaces the archive only if nothing fails and
+// is removed otherwise.
+func updateArchive(archivePath string, filePaths []string, freshen bool,
+	checkCRC bool, opts *packOptions) (err error) {
+	src, err := kcf.OpenArchive(archivePath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	if err = src.InitArchive(); err != nil {
+		return
+	}
+
+	tmpPath := archivePath + ".tmp"
+	dst, err := kcf.CreateNewArchive(tmpPath)
+	if err != nil {
+		return
+	}
+
+	err = updateFiles(src, dst, filePaths, freshen, checkCRC, opts)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	return os.Rename(tmpPath, archivePath)
+}
+
+// updateFiles copies files of src into dst, packing changed and new
+// ones from disk instead.
+func updateFiles(src *kcf.Kcf, dst *kcf.Kcf, filePaths []string,
+	freshen bool, checkCRC bool, opts *packOptions) (err error) {
+	pending := make(map[string]bool)
+	for _, filePath := range filePaths {
+		pending[filePath] = true
+	}
+
+	opts.writer.Creator = "kcf " + version
+	dst.SetWriterOptions(opts.writer)
+	if err = dst.InitArchive(); err != nil {
+		return
+	}
+
+	// Changed files are packed in parallel, anything else is written
+	// to the archive only after them, unless copyFile queues it too.
+	// Files still queued after an error are released before dst is
+	// closed.
+	pipeline := dst.NewPipeline(opts.jobs)
+	defer func() {
+		if closeErr := pipeline.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var fileInfo kcf.FileHeader
+	var changed bool
+	var globalExtra kcf.Extra
+	for {
+		fileInfo, err = src.GetCurrentFile()
+		if err != nil && err != io.EOF {
+			return
+		}
+		atEnd := err == io.EOF
+
+		// Global headers and the archive comment are not copied with
+		// files, so they are carried over whenever reading the next
+		// file brings new ones. The comment is replaced if given.
+		if extra := src.GlobalExtra(); !maps.Equal(extra, globalExtra) {
+			if err = pipeline.Flush(); err != nil {
+				return
+			}
+			if err = dst.SetGlobalExtra(extra); err != nil {
+				return
+			}
+			globalExtra = extra
+		}
+
+		comment := src.Comment()
+		if opts.comment != nil {
+			comment = *opts.comment
+		}
+		if comment != dst.Comment() {
+			if err = pipeline.Flush(); err != nil {
+				return
+			}
+			if err = dst.SetComment(comment); err != nil {
+				return
+			}
+		}
+
+		if atEnd {
+			break
+		}
+
+		name := filepath.Clean(fileInfo.FileName)
+		if len(filePaths) > 0 && !pending[name] {
+			err = copyFile(src, dst, pipeline, fileInfo, opts)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		delete(pending, name)
+
+		changed, err = isChanged(fileInfo, checkCRC)
+		if os.IsNotExist(err) {
+			changed, err = false, nil
+		}
+		if err != nil {
+			return
+		}
+
+		if !changed {
+			err = copyFile(src, dst, pipeline, fileInfo, opts)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		fmt.Printf("Updating %s...\n", fileInfo.FileName)
+		_, err = src.UnpackFile(io.Discard)
+		if err != nil && err != io.EOF {
+			return
+		}
+
+		if err = packFile(pipeline, fileInfo.FileName, opts); err != nil {
+			return
+		}
+	}
+
+	if !freshen {
+		for _, filePath := range filePaths {
+			if !pending[filePath] {
+				continue
+			}
+
+			fmt.Printf("Adding %s...\n", filePath)
+			if err = packFile(pipeline, filePath, opts); err != nil {
+				return
+			}
+		}
+	}
+
+	return nil
+}
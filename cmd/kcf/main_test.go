@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"internal/kcf"
+)
+
+type testEntry struct {
+	name     string
+	fileType kcf.FileType
+	data     string
+}
+
+// writeTestArchive packs entries into a new archive at path.
+func writeTestArchive(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+
+	archive, err := kcf.CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err = archive.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		var hdr kcf.FileHeader
+		hdr.FileName = e.name
+		hdr.FileType = e.fileType
+		hdr.SetUnpackedSize(uint64(len(e.data)))
+
+		err = archive.PackFile(hdr, strings.NewReader(e.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// unpackTestArchive unpacks entries in a new directory root inside a
+// temporary directory and returns the exit code of unpack and root.
+func unpackTestArchive(t *testing.T, entries []testEntry) (int, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.kcf")
+	writeTestArchive(t, path, entries)
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	chdir(t, root)
+	return unpack([]string{"-no-same-owner", path}), root
+}
+
+// chdir changes the current directory to dir until the test ends.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestUnpackSymlinkEscape(t *testing.T) {
+	retVal, root := unpackTestArchive(t, []testEntry{
+		{"lnk", kcf.SYMLINK, "."},
+		{"esc", kcf.SYMLINK, "lnk/../outside_target"},
+	})
+
+	if retVal != 2 {
+		t.Errorf("unpack returned %d, want 2", retVal)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "lnk")); err != nil {
+		t.Errorf("link inside the root was not created: %v", err)
+	}
+	_, err := os.Lstat(filepath.Join(root, "esc"))
+	if !os.IsNotExist(err) {
+		t.Errorf("link leading outside of the root was created")
+	}
+}
+
+func TestUnpackHardLinkEscape(t *testing.T) {
+	// The archive itself lies next to the root directory.
+	retVal, root := unpackTestArchive(t, []testEntry{
+		{"lnk", kcf.SYMLINK, "."},
+		{"file", kcf.REGULAR_FILE, "data"},
+		{"sym", kcf.SYMLINK, "file"},
+		{"esc", kcf.HARDLINK, "lnk/../test.kcf"},
+		{"viasym", kcf.HARDLINK, "sym"},
+		{"good", kcf.HARDLINK, "lnk/file"},
+	})
+
+	if retVal != 2 {
+		t.Errorf("unpack returned %d, want 2", retVal)
+	}
+	for _, name := range []string{"esc", "viasym"} {
+		_, err := os.Lstat(filepath.Join(root, name))
+		if !os.IsNotExist(err) {
+			t.Errorf("unsafe hard link %s was created", name)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(root, "good"))
+	if err != nil || string(data) != "data" {
+		t.Errorf("hard link inside the root was not created: %v", err)
+	}
+}
+
+// readTestArchive returns the flags of the archive at path and data of
+// its files by their names.
+func readTestArchive(t *testing.T, path string) (kcf.ArchiveFlags,
+	map[string]string) {
+	t.Helper()
+
+	archive, err := kcf.OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err = archive.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for {
+		fileInfo, err := archive.GetCurrentFile()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var data bytes.Buffer
+		_, err = archive.UnpackFile(&data)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		files[fileInfo.FileName] = data.String()
+	}
+
+	return archive.ArchiveHeader().ArchiveFlags, files
+}
+
+func TestUpdateSolid(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	files := map[string]string{
+		"a.txt": strings.Repeat("first file\n", 100),
+		"b.txt": strings.Repeat("second file\n", 200),
+		"c.txt": strings.Repeat("third file\n", 300),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create([]string{"-solid", "1", "-m", "lz4", "solid.kcf", "a.txt",
+		"b.txt", "c.txt"})
+	flags, _ := readTestArchive(t, "solid.kcf")
+	if flags&kcf.IS_SOLID == 0 {
+		t.Fatal("archive is not solid")
+	}
+
+	src, err := os.ReadFile("solid.kcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files["b.txt"] = "changed\n"
+	err = os.WriteFile("b.txt", []byte(files["b.txt"]), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files a.txt and c.txt are copied from the solid block, into
+	// another one or on their own.
+	tests := []struct {
+		name  string
+		args  []string
+		solid bool
+	}{
+		{"solid", []string{"-solid", "1"}, true},
+		{"not solid", nil, false},
+	}
+
+	for _, tt := range tests {
+		path := strings.ReplaceAll(tt.name, " ", "-") + ".kcf"
+		if err = os.WriteFile(path, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		update(append(tt.args, path, "b.txt"), false)
+
+		flags, got := readTestArchive(t, path)
+		if isSolid := flags&kcf.IS_SOLID != 0; isSolid != tt.solid {
+			t.Errorf("%s: archive is solid: %v", tt.name, isSolid)
+		}
+		if len(got) != len(files) {
+			t.Errorf("%s: got %d files, want %d", tt.name, len(got),
+				len(files))
+		}
+		for name, data := range files {
+			if got[name] != data {
+				t.Errorf("%s: data of %s differ", tt.name, name)
+			}
+		}
+	}
+}
+
+// readTestHeaders returns headers of files of the archive at path by
+// their names.
+func readTestHeaders(t *testing.T, path string) map[string]kcf.FileHeader {
+	t.Helper()
+
+	archive, err := kcf.OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err = archive.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(map[string]kcf.FileHeader)
+	for {
+		fileInfo, err := archive.GetCurrentFile()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[fileInfo.FileName] = fileInfo
+
+		_, err = archive.UnpackFile(io.Discard)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	return headers
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	old := map[string]string{
+		"mtime.txt": strings.Repeat("modified\n", 100),
+		"size.txt":  strings.Repeat("grown\n", 100),
+		"crc.txt":   strings.Repeat("rewritten\n", 100),
+		"same.txt":  strings.Repeat("unchanged\n", 100),
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, data := range old {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create([]string{"-m", "lz4", "old.kcf", "mtime.txt", "size.txt",
+		"crc.txt", "same.txt"})
+	src, err := os.ReadFile("old.kcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the CRC32 of crc.txt tells that it has changed.
+	current := maps.Clone(old)
+	current["size.txt"] += "grown\n"
+	current["crc.txt"] = strings.Repeat("REWRITTEN\n", 100)
+	current["new.txt"] = "added\n"
+	for _, name := range []string{"size.txt", "crc.txt", "new.txt"} {
+		err = os.WriteFile(name, []byte(current[name]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	later := mtime.Add(time.Second)
+	if err = os.Chtimes("mtime.txt", later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updated files are packed stored, copied ones keep LZ4.
+	tests := []struct {
+		name    string
+		args    []string
+		freshen bool
+		updated []string
+	}{
+		{"u", nil, false, []string{"mtime.txt", "size.txt", "new.txt"}},
+		{"u -crc", []string{"-crc"}, false,
+			[]string{"mtime.txt", "size.txt", "crc.txt", "new.txt"}},
+		{"f", nil, true, []string{"mtime.txt", "size.txt"}},
+		{"f -crc", []string{"-crc"}, true,
+			[]string{"mtime.txt", "size.txt", "crc.txt"}},
+	}
+
+	for _, tt := range tests {
+		path := strings.ReplaceAll(tt.name, " ", "") + ".kcf"
+		if err = os.WriteFile(path, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		args := append(tt.args, "-m", "store", path, "mtime.txt",
+			"size.txt", "crc.txt", "same.txt", "new.txt")
+		update(args, tt.freshen)
+
+		_, files := readTestArchive(t, path)
+		headers := readTestHeaders(t, path)
+		if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary archive is left", tt.name)
+		}
+
+		want := len(old)
+		if !tt.freshen {
+			want++
+		}
+		if len(files) != want {
+			t.Errorf("%s: got %d files, want %d", tt.name, len(files),
+				want)
+		}
+
+		for name, data := range files {
+			isUpdated := slices.Contains(tt.updated, name)
+			wantData := old[name]
+			wantMethod := kcf.METHOD_LZ4
+			if isUpdated {
+				wantData = current[name]
+				wantMethod = kcf.METHOD_STORED
+			}
+
+			if data != wantData {
+				t.Errorf("%s: data of %s differ", tt.name, name)
+			}
+			info := headers[name].CompressionInfo
+			if kcf.MethodOf(info) != wantMethod {
+				t.Errorf("%s: %s is packed by %s", tt.name, name,
+					kcf.CompressionName(info))
+			}
+		}
+	}
+}
+
+func TestUpdateFailure(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		data := []byte(strings.Repeat(name+"\n", 100))
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create([]string{"test.kcf", "a.txt", "b.txt"})
+
+	// The record of the last file is cut short.
+	archive, err := os.ReadFile("test.kcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive = archive[:len(archive)-10]
+	if err = os.WriteFile("test.kcf", archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var opts packOptions
+	err = updateArchive("test.kcf", nil, false, false, &opts)
+	if err == nil {
+		t.Fatal("truncated archive has been updated")
+	}
+
+	if _, err = os.Stat("test.kcf.tmp"); !os.IsNotExist(err) {
+		t.Error("temporary archive is left")
+	}
+	got, err := os.ReadFile("test.kcf")
+	if err != nil || !bytes.Equal(got, archive) {
+		t.Errorf("archive has been replaced: %v", err)
+	}
+}
+
+func TestUnpackMembers(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	// Random data are stored in LZ4 blocks as they are, so they can be
+	// found in the archive.
+	random := make([]byte, 4000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	files := map[string]string{
+		"a.txt":     strings.Repeat("first file\n", 100),
+		"b.txt":     strings.Repeat("second file\n", 100),
+		"dir/c.bin": string(random[:2000]),
+		"dir/d.bin": string(random[2000:]),
+	}
+	if err := os.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files go to two solid blocks, a.txt and b.txt to the first one.
+	create([]string{"-solid", "1", "-solid-files", "2", "-m", "lz4",
+		"test.kcf", "a.txt", "b.txt", "dir/c.bin", "dir/d.bin"})
+	archive, err := os.ReadFile("test.kcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		members []string
+		want    []string
+	}{
+		{"name", []string{"b.txt"}, []string{"b.txt"}},
+		{"pattern", []string{"*.txt"}, []string{"a.txt", "b.txt"}},
+		{"directory", []string{"./dir/"}, []string{"dir", "dir/c.bin",
+			"dir/d.bin"}},
+		{"nested pattern", []string{"dir/c*"}, []string{"dir",
+			"dir/c.bin"}},
+		{"several", []string{"a.txt", "dir/d.bin"},
+			[]string{"a.txt", "dir", "dir/d.bin"}},
+		{"none", []string{"e.txt"}, nil},
+	}
+
+	for _, tt := range tests {
+		root := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+		if err = os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		chdir(t, root)
+
+		args := append([]string{"-no-same-owner", "../test.kcf"},
+			tt.members...)
+		if retVal := unpack(args); retVal != 0 {
+			t.Errorf("%s: unpack returned %d", tt.name, retVal)
+		}
+
+		var got []string
+		filepath.WalkDir(".", func(path string, d fs.DirEntry,
+			err error) error {
+			if path != "." {
+				got = append(got, path)
+			}
+			return err
+		})
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for _, name := range got {
+			data, err := os.ReadFile(name)
+			if err == nil && string(data) != files[name] {
+				t.Errorf("%s: data of %s differ", tt.name, name)
+			}
+		}
+	}
+
+	// A corrupt byte in the second block fails unpacking if the block
+	// is decoded.
+	i := bytes.Index(archive, random[1000:1100])
+	if i < 0 {
+		t.Fatal("data of dir/c.bin not found")
+	}
+	archive[i] ^= 0x55
+	if err = os.WriteFile(filepath.Join(dir, "test.kcf"), archive,
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "corrupt")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, root)
+
+	retVal := unpack([]string{"-no-same-owner", "../test.kcf", "a.txt"})
+	if retVal != 0 {
+		t.Errorf("unpack returned %d", retVal)
+	}
+	data, err := os.ReadFile("a.txt")
+	if err != nil || string(data) != files["a.txt"] {
+		t.Errorf("a.txt was not unpacked: %v", err)
+	}
+}
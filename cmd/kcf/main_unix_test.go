@@ -0,0 +1,86 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"internal/kcf"
+)
+
+func TestUnpackOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs privileges of the superuser")
+	}
+
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	// The names are known on the system, the ids need not be.
+	var meta kcf.FileMetadata
+	meta.MetaFlags = kcf.HAS_OWNER | kcf.HAS_NAMES | kcf.HAS_MODE
+	meta.Uid, meta.Gid = 1234, 5678
+	meta.UserName, meta.GroupName = "root", "root"
+	meta.Mode = 0o4750
+
+	archive, err := kcf.CreateNewArchive("test.kcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = archive.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	var hdr kcf.FileHeader
+	hdr.FileName = "file"
+	hdr.FileType = kcf.REGULAR_FILE
+	hdr.Metadata = meta
+	hdr.SetUnpackedSize(4)
+	if err = archive.PackFile(hdr, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	tests := []struct {
+		name     string
+		args     []string
+		uid, gid uint32
+		mode     os.FileMode
+	}{
+		{"names", []string{"-same-owner"}, 0, 0, 0750 | os.ModeSetuid},
+		{"numeric", []string{"-same-owner", "-numeric-owner"}, 1234, 5678,
+			0750 | os.ModeSetuid},
+		{"no permissions", []string{"-same-owner", "-numeric-owner",
+			"-no-same-permissions"}, 1234, 5678, 0750 &^ umask()},
+	}
+
+	for _, tt := range tests {
+		root := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-"))
+		if err = os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		chdir(t, root)
+
+		args := append(tt.args, "../test.kcf")
+		if retVal := unpack(args); retVal != 0 {
+			t.Errorf("%s: unpack returned %d", tt.name, retVal)
+		}
+
+		info, err := os.Stat("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Uid != tt.uid || st.Gid != tt.gid {
+			t.Errorf("%s: got owner %d:%d, want %d:%d", tt.name, st.Uid,
+				st.Gid, tt.uid, tt.gid)
+		}
+		if info.Mode() != tt.mode {
+			t.Errorf("%s: got mode %v, want %v", tt.name, info.Mode(),
+				tt.mode)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"internal/kcf"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultMethodRules is the path of the method rules file used by
+// -m auto unless another one is given, relative to the user
+// configuration directory.
+const defaultMethodRules = "kcf/methods"
+
+// readMethodRules reads rules selecting compression methods of files
+// for -m auto. Each line of the file holds a match and a method, as in
+//
+//	# Comments start with '#'.
+//	*.txt               ppmd:order=8
+//	*.wav               delta:dist=4+lzma
+//	magic:7f454c46      x86+lzma
+//	magic:7573746172@257 lzma
+//
+// A match is either a pattern of base names of files or "magic:HEX"
+// with the bytes files start with, optionally followed by "@OFFSET" if
+// they are found further in the file. The first matching rule wins.
+func readMethodRules(rulesPath string) (rules []kcf.MethodRule, err error) {
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var rule kcf.MethodRule
+		if len(fields) == 2 {
+			rule, err = parseMethodRule(fields[0], fields[1])
+		} else {
+			err = errors.New("expected MATCH METHOD")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", rulesPath, line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseMethodRule(match string, spec string) (
+	rule kcf.MethodRule,
+	err error,
+) {
+	if magic, ok := strings.CutPrefix(match, "magic:"); ok {
+		magic, offset, hasOffset := strings.Cut(magic, "@")
+		if hasOffset {
+			rule.MagicOffset, err = strconv.Atoi(offset)
+			if err != nil || rule.MagicOffset < 0 {
+				return rule, errors.New("invalid magic offset")
+			}
+		}
+
+		rule.Magic, err = hex.DecodeString(magic)
+		if err != nil || len(rule.Magic) == 0 {
+			return rule, errors.New("invalid magic bytes")
+		}
+	} else {
+		if _, err = path.Match(match, ""); err != nil {
+			return
+		}
+		rule.Pattern = match
+	}
+
+	rule.Filters, rule.Compression, err = kcf.ParseCoderChain(spec)
+	return
+}
+
+// loadMethodRules reads method rules for -m auto from the file given by
+// -method-rules, or from the default file in the user configuration
+// directory if it exists.
+func loadMethodRules(opts *packOptions) (err error) {
+	if !opts.writer.AutoCompression {
+		return
+	}
+
+	rulesPath := opts.rulesPath
+	if rulesPath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil
+		}
+
+		rulesPath = filepath.Join(dir, defaultMethodRules)
+		if _, err = os.Stat(rulesPath); err != nil {
+			return nil
+		}
+	}
+
+	opts.writer.MethodRules, err = readMethodRules(rulesPath)
+	return
+}
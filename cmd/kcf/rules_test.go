@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"internal/kcf"
+)
+
+func TestReadMethodRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "methods")
+	rules := "# Comments start with '#'.\n" +
+		"\n" +
+		"*.txt               ppmd:order=8\n" +
+		"  *.wav\tdelta:dist=4+lzma  \n" +
+		"magic:7f454c46      x86+lzma\n" +
+		"magic:7573746172@257 lz4\n"
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readMethodRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		pattern string
+		magic   string
+		offset  int
+		spec    string
+	}{
+		{"*.txt", "", 0, "ppmd:order=8"},
+		{"*.wav", "", 0, "delta:dist=4+lzma"},
+		{"", "\x7FELF", 0, "x86+lzma"},
+		{"", "ustar", 257, "lz4"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		filters, info, err := kcf.ParseCoderChain(w.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rule := got[i]
+		if rule.Pattern != w.pattern || string(rule.Magic) != w.magic ||
+			rule.MagicOffset != w.offset ||
+			!slices.Equal(rule.Filters, filters) ||
+			rule.Compression != info {
+			t.Errorf("rule %d: got %+v, want %+v", i+1, rule, w)
+		}
+	}
+}
+
+func TestReadMethodRulesMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"no method", "*.txt"},
+		{"extra field", "*.txt lzma x"},
+		{"bad pattern", "[ lzma"},
+		{"unknown method", "*.txt zip"},
+		{"bad parameter", "*.txt lzma:dict=3"},
+		{"bad hex", "magic:7g lzma"},
+		{"odd hex", "magic:7f4 lzma"},
+		{"empty magic", "magic: lzma"},
+		{"empty magic with offset", "magic:@4 lzma"},
+		{"bad offset", "magic:7f@x lzma"},
+		{"negative offset", "magic:7f@-1 lzma"},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "methods")
+		rules := "# valid rule first\n*.c lzma\n" + tt.line + "\n"
+		if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readMethodRules(path)
+		if err == nil {
+			t.Errorf("%s: got %d rules", tt.name, len(got))
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+":3: ") {
+			t.Errorf("%s: error %q does not name the line", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func umask() os.FileMode {
+	return 0
+}
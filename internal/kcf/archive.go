@@ -2,8 +2,13 @@ package kcf
 
 import (
 	"hash"
+	"hash/crc32"
 	"io"
+	"maps"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 )
 
 // bit 0, 1 - parser mode
@@ -146,6 +151,9 @@ type Kcf struct {
 	written      uint64
 	recOffset    int64
 	recEndOffset int64
+	hdrOffset    int64
+	ahdrOffset   int64
+	packedSize   uint64
 	validCrc     uint32
 
 	isWritable bool
@@ -157,8 +165,214 @@ type Kcf struct {
 	addedWriter LimitedWriter
 
 	lastRecord  Record
+	hdrRecord   Record
+	auxRecords  []auxRecord
 	currentFile FileHeader
+	block       *solidReader
 	archiveHdr  ArchiveHeader
+	globalExtra Extra
+	comment     string
+
+	hardLinks     map[inodeID]string
+	options       WriterOptions
+	versionLimit  uint16
+	readerOptions ReaderOptions
+}
+
+// Range of archive format versions the package reads and writes.
+const (
+	MinVersion uint16 = 1
+	MaxVersion uint16 = 2
+)
+
+// WriterOptions controls how files are packed into the archive.
+type WriterOptions struct {
+	// Version selects the format version to write, so that older
+	// readers can unpack the archive. Sparse files are then packed
+	// with their holes and filters are not selected automatically,
+	// while packing files with long names or Filters and copying
+	// files which need a later version fail with UnsupportedFeature.
+	// Zero means the lowest version covering the features used,
+	// which is raised as files need it in seekable archives and is
+	// MaxVersion otherwise. It takes effect only if set before
+	// InitArchive.
+	Version uint16
+
+	// Creator and CreationTime are stored in the archive header.
+	// Zero CreationTime means the time of InitArchive.
+	Creator      string
+	CreationTime time.Time
+
+	// XattrFilter selects extended attributes to be stored.
+	XattrFilter XattrFilter
+
+	// Compression is CompressionInfo of packed regular files, which
+	// selects the compression method and its parameters.
+	Compression uint32
+
+	// Filters lists CompressionInfo of up to two coders applied to data
+	// of regular files before Compression, such as delta filters. They
+	// need format version 2, packing files with them fails with
+	// UnsupportedFeature in earlier versions.
+	Filters []uint32
+
+	// AutoBCJ selects the BCJ filter for ELF executables of x86, ARM64
+	// and RISC-V by their machine type, when Filters is empty and data
+	// is compressed.
+	AutoBCJ bool
+
+	// AutoDelta selects the delta filter for files which look like
+	// arrays of fixed-size records, such as PCM audio or raw images,
+	// when Filters is empty, no BCJ filter is selected and data is
+	// compressed.
+	AutoDelta bool
+
+	// AutoCompression selects the compression method of each regular
+	// file instead of Compression and Filters. Files of compressed
+	// formats and files whose first bytes look random are stored.
+	// Other files are compressed as set by the first of MethodRules
+	// matching them, or by Compression and Filters if none does. In
+	// seekable archives, files whose packed data turn out no smaller
+	// than the files themselves are packed again as stored.
+	AutoCompression bool
+	MethodRules     []MethodRule
+
+	// Solid makes a Pipeline pack regular files into solid blocks. It
+	// needs format version 2 and takes effect only if set before
+	// InitArchive, which then marks the archive as solid.
+	Solid SolidOptions
+}
+
+// SetWriterOptions sets options for files packed after the call.
+func (kcf *Kcf) SetWriterOptions(opts WriterOptions) {
+	kcf.options = opts
+}
+
+// ReaderOptions controls how files are unpacked from the archive.
+type ReaderOptions struct {
+	// MemoryLimit is the maximum amount of memory in bytes which the
+	// decompressor of a file may use. Files whose compression method
+	// needs more memory are not unpacked. Zero means no limit.
+	MemoryLimit uint64
+
+	// Workers is the number of fragments unpacked at once for files
+	// whose fragments are compressed independently, when the archive
+	// is seekable. Fewer workers are used if they would need more
+	// memory than MemoryLimit. Zero means one.
+	Workers int
+}
+
+// SetReaderOptions sets options for files unpacked after the call.
+func (kcf *Kcf) SetReaderOptions(opts ReaderOptions) {
+	kcf.readerOptions = opts
+}
+
+// GlobalExtra returns key/value metadata of global extended headers
+// read so far. When writing, it returns metadata set by SetGlobalExtra.
+func (kcf *Kcf) GlobalExtra() Extra {
+	return maps.Clone(kcf.globalExtra)
+}
+
+// SetGlobalExtra writes a global extended header with the given pairs.
+// It should be called right after InitArchive, since readers learn of
+// the pairs only when they reach the record.
+func (kcf *Kcf) SetGlobalExtra(extra Extra) (err error) {
+	if !kcf.state.IsWriting() ||
+		kcf.state.GetPackerPos() != pposFileHeader {
+		panic(InvalidState)
+	}
+
+	var rec Record
+	var data []byte
+
+	rec, data, err = extra.AsRecord(GLOBAL_HEADER)
+	if err != nil {
+		return
+	}
+
+	err = kcf.writeRecordData(rec, data)
+	if err != nil {
+		return
+	}
+
+	return kcf.mergeGlobalExtra(rec, data)
+}
+
+// Version returns the format version of the archive. It is known
+// after InitArchive, but may rise while files are packed if
+// WriterOptions.Version is zero.
+func (kcf *Kcf) Version() uint16 {
+	return kcf.archiveHdr.Version
+}
+
+// ArchiveHeader returns the header of the archive. It is known after
+// InitArchive.
+func (kcf *Kcf) ArchiveHeader() ArchiveHeader {
+	return kcf.archiveHdr
+}
+
+// checkVersion returns an error if the package does not support the
+// format version.
+func checkVersion(version uint16) error {
+	if version < MinVersion || version > MaxVersion {
+		return &ErrUnsupportedVersion{Found: version, Supported: MaxVersion}
+	}
+
+	return nil
+}
+
+// recordVersion returns the first format version with records of type t.
+func recordVersion(t RecordType) uint16 {
+	switch t {
+	case LONG_NAME, SPARSE_MAP:
+		return 2
+	case CODER_CHAIN:
+		return filtersVersion
+	case SOLID_BLOCK:
+		return solidVersion
+	}
+
+	return MinVersion
+}
+
+// lowestVersion returns the format version written by default. Later
+// versions are reached by useVersion, so it is the lowest one unless
+// the archive header cannot be rewritten or solid blocks are used.
+func (kcf *Kcf) lowestVersion() uint16 {
+	if !kcf.isSeekable {
+		return MaxVersion
+	}
+	if kcf.options.Solid.BlockSize > 0 {
+		return solidVersion
+	}
+
+	return MinVersion
+}
+
+// useVersion raises the format version of the archive to at least
+// version, rewriting the archive header. It returns UnsupportedFeature
+// if the archive is limited to an earlier version.
+func (kcf *Kcf) useVersion(version uint16) (err error) {
+	if version <= kcf.archiveHdr.Version {
+		return nil
+	}
+	if version > kcf.versionLimit {
+		return UnsupportedFeature
+	}
+
+	kcf.archiveHdr.Version = version
+	rec, err := kcf.archiveHdr.AsRecord()
+	if err != nil {
+		return
+	}
+
+	return kcf.rewriteRecord(kcf.ahdrOffset, rec)
+}
+
+// inodeID identifies a file on the system the archive is created on.
+type inodeID struct {
+	dev uint64
+	ino uint64
 }
 
 func (kcf Kcf) IsWritable() bool {
@@ -231,20 +445,61 @@ func (kcf *Kcf) GetCurrentFile() (info FileHeader, err error) {
 	case pposArchiveStart:
 		panic(InvalidState)
 	case pposFileHeader:
-		_, err = kcf.readRecord()
+		kcf.auxRecords = kcf.auxRecords[:0]
+		kcf.currentFile = FileHeader{}
+		fallthrough
+	case pposFileMetadata:
+		for {
+			_, err = kcf.readRecord()
+			if err == io.EOF && kcf.block != nil && kcf.block.left > 0 {
+				err = InvalidFormat
+			}
+			if err != nil {
+				return
+			}
+
+			if kcf.lastRecord.HeadType == FILE_HEADER {
+				break
+			}
+
+			// Solid blocks precede records of their first files.
+			if kcf.lastRecord.HeadType == SOLID_BLOCK &&
+				kcf.state.GetPackerPos() == pposFileHeader {
+				err = kcf.readSolidBlock()
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			kcf.state.SetPackerPos(pposFileMetadata)
+			err = kcf.readFileMetadata()
+			if err != nil {
+				return
+			}
+		}
+
+		err = kcf.currentFile.parseRecord(kcf.lastRecord)
 		if err != nil {
 			return
 		}
 
-		kcf.currentFile, err = RecordToFileHeader(kcf.lastRecord)
+		// Extents past the end of the file would be written there.
+		if (kcf.currentFile.FileFlags & IS_SPARSE) != 0 {
+			err = kcf.currentFile.SparseMap.check(
+				kcf.currentFile.UnpackedSize)
+			if err != nil {
+				return
+			}
+		}
+
+		err = kcf.readSolidFile()
 		if err != nil {
 			return
 		}
 
 		kcf.state.SetPackerPos(pposFileData)
 	case pposFileData:
-		fallthrough
-	case pposFileMetadata:
 		break
 	}
 
@@ -271,6 +526,48 @@ func (kcf *Kcf) UnpackFile(w io.Writer) (n int64, err error) {
 	var eof bool = false
 	buffer := make([]byte, 4096)
 
+	if (kcf.currentFile.FileFlags&IS_SPARSE) != 0 && w != io.Discard {
+		sw := &sparseWriter{
+			w:    w,
+			smap: kcf.currentFile.SparseMap,
+			size: kcf.currentFile.UnpackedSize,
+		}
+		w = sw
+
+		defer func() {
+			if err == nil || err == io.EOF {
+				err = sw.Close()
+			}
+		}()
+	}
+
+	if (kcf.currentFile.FileFlags & IN_SOLID_BLOCK) != 0 {
+		n, err = kcf.unpackSolidFile(w)
+		if err != nil {
+			return
+		}
+
+		kcf.state.SetPackerPos(pposFileHeader)
+		return
+	}
+
+	if kcf.state.GetStage() != stageRecordAddedData &&
+		kcf.lastRecord.HeadFlags&0x01 == 0 {
+		kcf.state.SetPackerPos(pposFileHeader)
+		return
+	}
+
+	if MethodOf(kcf.currentFile.CompressionInfo) != METHOD_STORED ||
+		len(kcf.currentFile.Filters) > 0 {
+		n, err = kcf.unpackData(w)
+		if err != nil {
+			return
+		}
+
+		kcf.state.SetPackerPos(pposFileHeader)
+		return
+	}
+
 	for {
 		var n_read, n_written int
 
@@ -316,53 +613,472 @@ func (kcf *Kcf) UnpackFile(w io.Writer) (n int64, err error) {
 	return
 }
 
+// unpackData decompresses data of the current file into w. Data are
+// not decompressed if w is io.Discard.
+func (kcf *Kcf) unpackData(w io.Writer) (n int64, err error) {
+	fr := &fragmentReader{kcf: kcf}
+
+	if w != io.Discard {
+		var cr io.Reader
+		var needed uint64
+
+		info := kcf.currentFile.CompressionInfo
+		filters := kcf.currentFile.Filters
+		needed, err = kcf.memoryNeeded(filters, info)
+		if err != nil {
+			return
+		}
+
+		size := kcf.currentFile.UnpackedSize
+		if (kcf.currentFile.FileFlags & IS_SPARSE) != 0 {
+			size = kcf.currentFile.SparseMap.DataSize()
+		}
+
+		workers := kcf.readerOptions.Workers
+		limit := kcf.readerOptions.MemoryLimit
+		if limit != 0 && needed > 0 {
+			workers = min(workers, int(min(limit/needed, 1<<16)))
+		}
+
+		if workers > 1 && kcf.isSeekable && len(filters) == 0 &&
+			kcf.currentFile.FileFlags&INDEPENDENT_FRAGMENTS != 0 {
+			var c codec
+
+			c, err = codecOf(info)
+			if err != nil {
+				return
+			}
+
+			// Fragments of other codecs are not bounded in size.
+			if _, ok := c.(blockCodec); ok {
+				return kcf.unpackFragments(w, c, info, size, workers)
+			}
+		}
+
+		cr, err = newChainReader(fr, filters, info)
+		if err != nil {
+			return
+		}
+
+		n, err = io.CopyBuffer(w, io.LimitReader(cr, int64(size)),
+			make([]byte, 64<<10))
+		if err != nil {
+			return
+		}
+		if uint64(n) != size {
+			err = InvalidAddedData
+			return
+		}
+	}
+
+	_, err = io.Copy(io.Discard, fr)
+	return
+}
+
+// memoryNeeded returns the amount of memory needed to decode data passed
+// through filters and the compression method of info. It fails with
+// MemoryLimitError if the decoders would need more than MemoryLimit.
+func (kcf *Kcf) memoryNeeded(filters []uint32, info uint32) (
+	needed uint64,
+	err error,
+) {
+	needed, err = chainMemoryUsage(filters, info)
+	if err != nil {
+		return
+	}
+
+	limit := kcf.readerOptions.MemoryLimit
+	if limit != 0 && needed > limit {
+		err = &MemoryLimitError{Needed: needed, Limit: limit}
+	}
+
+	return
+}
+
 func (kcf *Kcf) PackFileRaw(file *os.File) (err error) {
+	hdr, data, size, err := kcf.fileHeaderOf(file, kcf.options)
+	if err != nil {
+		return
+	}
+
+	if hdr.FileType != REGULAR_FILE {
+		return kcf.packData(hdr, data(), size)
+	}
+
+	return kcf.packFileData(hdr, data, size)
+}
+
+// fileHeaderOf returns the header of the file or directory packed with
+// opts, a function returning new readers of size bytes of its data to
+// be packed, which skip holes of sparse files.
+func (kcf *Kcf) fileHeaderOf(file *os.File, opts WriterOptions) (
+	hdr FileHeader,
+	data func() io.Reader,
+	size uint64,
+	err error,
+) {
 	var info os.FileInfo
 
 	info, err = file.Stat()
 	if err != nil {
-		return err
+		return
 	}
 
-	size := uint64(info.Size())
+	hdr.Metadata = readMetadata(file, info)
+	hdr.SetModTime(hdr.Metadata.ModTime)
+	hdr.FileName = file.Name()
 
-	var hdr FileHeader
-	hdr.FileFlags = HAS_TIMESTAMP
+	hdr.Xattrs, err = readXattrs(file.Name(), opts.XattrFilter)
+	if err != nil {
+		return
+	}
 
 	if info.IsDir() {
 		hdr.FileType = DIRECTORY
-	} else {
-		hdr.FileType = REGULAR_FILE
-		hdr.FileFlags |= HAS_UNPACKED_4
-		if info.Size() > 2147483647 {
-			hdr.FileFlags |= HAS_UNPACKED_8
+		data = func() io.Reader { return file }
+		return
+	}
+
+	size = uint64(info.Size())
+	hdr.FileType = REGULAR_FILE
+	hdr.SetUnpackedSize(size)
+	hdr.CompressionInfo = opts.Compression
+	hdr.Filters = opts.Filters
+
+	// Filters are selected automatically only if the archive can use
+	// them, while Filters set explicitly make prepareHeader fail.
+	autoFilters := kcf.versionLimit >= filtersVersion
+	if opts.AutoCompression {
+		hdr.Filters, hdr.CompressionInfo =
+			selectMethod(file, info.Size(), opts, autoFilters)
+	}
+
+	if len(hdr.Filters) == 0 && autoFilters &&
+		MethodOf(hdr.CompressionInfo) != METHOD_STORED {
+		if opts.AutoBCJ {
+			hdr.Filters = autoBCJ(file)
+		}
+		if opts.AutoDelta && len(hdr.Filters) == 0 {
+			hdr.Filters = autoDelta(file, info.Size())
+		}
+	}
+
+	// Holes are packed as data if the archive cannot use sparse maps.
+	var isSparse bool
+	if kcf.versionLimit >= recordVersion(SPARSE_MAP) {
+		hdr.SparseMap, isSparse, err = sparseExtents(file, info.Size())
+		if err != nil {
+			return
 		}
+	}
 
-		hdr.UnpackedSize = size
+	data = func() io.Reader {
+		return io.NewSectionReader(file, 0, info.Size())
 	}
 
-	hdr.FileName = file.Name()
+	if isSparse {
+		hdr.FileFlags |= IS_SPARSE
+		size = hdr.SparseMap.DataSize()
+		data = func() io.Reader {
+			readers := make([]io.Reader, len(hdr.SparseMap))
+			for i, ext := range hdr.SparseMap {
+				readers[i] = io.NewSectionReader(file,
+					int64(ext.Offset), int64(ext.Size))
+			}
+
+			return io.MultiReader(readers...)
+		}
+	}
+
+	return
+}
+
+// packFileData packs size bytes of data of a regular file read from
+// the reader returned by data. With AutoCompression, the file is packed
+// again as stored, reading its data anew, if its packed data are no
+// smaller than size.
+func (kcf *Kcf) packFileData(hdr FileHeader, data func() io.Reader,
+	size uint64) (err error) {
+	retry := kcf.options.AutoCompression && kcf.isSeekable &&
+		(MethodOf(hdr.CompressionInfo) != METHOD_STORED ||
+			len(hdr.Filters) > 0)
+
+	var start int64
+	if retry {
+		start, err = kcf.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return
+		}
+	}
+
+	err = kcf.packData(hdr, data(), size)
+	if err != nil || !retry || kcf.packedSize < size {
+		return
+	}
+
+	// Drop records of the file written so far.
+	err = kcf.file.Truncate(start)
+	if err != nil {
+		return
+	}
+	_, err = kcf.file.Seek(start, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	hdr.CompressionInfo = compressionInfo(METHOD_STORED, 0)
+	hdr.Filters = nil
+	return kcf.packData(hdr, data(), size)
+}
+
+// PackPath packs the file at path without following symbolic links.
+// Symbolic links are stored as links with their targets as data.
+// Files which have already been packed by PackPath under another name
+// are stored as hard links to the first packed name.
+func (kcf *Kcf) PackPath(path string) (err error) {
+	var info os.FileInfo
+
+	info, err = os.Lstat(path)
+	if err != nil {
+		return
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return kcf.packSymlink(path, info)
+	}
+
+	special := os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+	if info.Mode()&special != 0 {
+		return kcf.packSpecial(path, info)
+	}
+
+	id, isLinked := inodeOf(info)
+	if isLinked && info.Mode().IsRegular() {
+		if target, ok := kcf.hardLinks[id]; ok {
+			return kcf.packHardLink(path, target)
+		}
+	}
+
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = kcf.PackFileRaw(file)
+	if err != nil {
+		return
+	}
+
+	if isLinked && info.Mode().IsRegular() {
+		if kcf.hardLinks == nil {
+			kcf.hardLinks = make(map[inodeID]string)
+		}
+		kcf.hardLinks[id] = path
+	}
+
+	return
+}
+
+// packSpecial packs FIFOs, sockets and device files. They have no data,
+// device numbers are stored in the metadata.
+func (kcf *Kcf) packSpecial(path string, info os.FileInfo) (err error) {
+	var hdr FileHeader
+	hdr.Metadata = readLinkMetadata(path, info)
+	hdr.SetModTime(hdr.Metadata.ModTime)
+	hdr.FileType = fileTypeOf(info.Mode())
+	hdr.FileName = path
+
+	hdr.Xattrs, err = readXattrs(path, kcf.options.XattrFilter)
+	if err != nil {
+		return
+	}
+
+	return kcf.packData(hdr, nil, 0)
+}
+
+func (kcf *Kcf) packHardLink(path string, target string) (err error) {
+	var hdr FileHeader
+	hdr.FileType = HARDLINK
+	hdr.SetUnpackedSize(uint64(len(target)))
+	hdr.FileName = path
+
+	return kcf.packData(hdr, strings.NewReader(target), hdr.UnpackedSize)
+}
+
+func (kcf *Kcf) packSymlink(path string, info os.FileInfo) (err error) {
+	var target string
+
+	target, err = os.Readlink(path)
+	if err != nil {
+		return
+	}
+
+	var hdr FileHeader
+	hdr.Metadata = readLinkMetadata(path, info)
+	hdr.SetModTime(hdr.Metadata.ModTime)
+	hdr.FileType = SYMLINK
+	hdr.SetUnpackedSize(uint64(len(target)))
+	hdr.FileName = path
+
+	return kcf.packData(hdr, strings.NewReader(target), hdr.UnpackedSize)
+}
+
+// PackFile packs a file described by hdr with data read from r. It
+// lets callers set fields PackPath does not fill, such as Extra. The
+// size of the file must be set by SetUnpackedSize. For sparse files r
+// yields data of the extents of hdr.SparseMap only, which must be in
+// ascending order within the file, or InvalidFormat is returned.
+func (kcf *Kcf) PackFile(hdr FileHeader, r io.Reader) (err error) {
+	if !kcf.state.IsWriting() {
+		panic(InvalidState)
+	}
+
+	size := hdr.UnpackedSize
+	if (hdr.FileFlags & IS_SPARSE) != 0 {
+		err = hdr.SparseMap.check(hdr.UnpackedSize)
+		if err != nil {
+			return
+		}
+		size = hdr.SparseMap.DataSize()
+	}
+
+	return kcf.packData(hdr, r, size)
+}
+
+// fileHash computes CRC32 of file data.
+type fileHash interface {
+	io.Writer
+	Sum32() uint32
+}
+
+// newFileHash returns the hash of data of the file described by hdr.
+// Holes of sparse files are hashed as zeros.
+func newFileHash(hdr FileHeader) fileHash {
+	if (hdr.FileFlags & IS_SPARSE) != 0 {
+		return &sparseCRC{smap: hdr.SparseMap, size: hdr.UnpackedSize}
+	}
+
+	crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+	return crc32.New(crc32c_table)
+}
+
+// prepareHeader adjusts flags, filters and the compression method of
+// hdr to the archive and size bytes of file data. It returns the codec
+// of the compression method, which is nil for stored data.
+func (kcf *Kcf) prepareHeader(hdr *FileHeader, size uint64) (
+	c codec,
+	err error,
+) {
+	if size == 0 {
+		hdr.CompressionInfo = 0
+		hdr.Filters = nil
+	}
+
+	if len(hdr.Filters) > 0 && kcf.versionLimit < filtersVersion {
+		return nil, UnsupportedFeature
+	}
+	if len(hdr.Filters) > maxFilters {
+		return nil, InvalidCompressionParams
+	}
+
+	hdr.FileFlags &^= INDEPENDENT_FRAGMENTS
+	if MethodOf(hdr.CompressionInfo) != METHOD_STORED {
+		c, err = codecOf(hdr.CompressionInfo)
+		if err != nil {
+			return
+		}
+
+		// Filters carry their state over block boundaries.
+		if _, ok := c.(blockCodec); ok && len(hdr.Filters) == 0 {
+			hdr.FileFlags |= INDEPENDENT_FRAGMENTS
+		}
+	}
+
+	if kcf.isSeekable && size > 0 {
+		hdr.FileFlags |= HAS_FILE_CRC32
+	}
+
+	return
+}
+
+// packData writes the file header together with records preceding it
+// and size bytes of file data read from r, compressed by the method
+// of hdr.CompressionInfo.
+func (kcf *Kcf) packData(hdr FileHeader, r io.Reader, size uint64) (
+	err error,
+) {
+	var c codec
+
+	c, err = kcf.prepareHeader(&hdr, size)
+	if err != nil {
+		return
+	}
 
 	kcf.currentFile = hdr
-	kcf.lastRecord, err = kcf.currentFile.AsRecord()
+	err = kcf.writeFileMetadata()
 	if err != nil {
 		return err
 	}
 
-	kcf.lastRecord.HeadFlags |= HAS_ADDED_4
-	if size > 2147483647 {
-		kcf.lastRecord.HeadFlags |= HAS_ADDED_8
+	fileCrc := newFileHash(hdr)
+	if c == nil && len(hdr.Filters) == 0 {
+		kcf.packedSize = size
+		err = kcf.writeStoredData(io.TeeReader(r, fileCrc), size)
+	} else {
+		err = kcf.writePackedData(c, io.TeeReader(r, fileCrc), size)
+	}
+	if err != nil {
+		return
 	}
-	kcf.lastRecord.AddedDataSize = size
 
-	if !kcf.isSeekable {
-		kcf.lastRecord.HeadFlags |= 0x01
-		kcf.lastRecord.AddedDataSize = 0
-		kcf.lastRecord.HeadFlags &^= HAS_ADDED_8
+	if kcf.currentFile.FileFlags&HAS_FILE_CRC32 != 0 {
+		kcf.currentFile.FileCRC32 = fileCrc.Sum32()
+		err = kcf.rewriteFileHeader()
+		if err != nil {
+			return
+		}
+	}
+
+	kcf.state.SetPackerPos(pposFileHeader)
+
+	return
+}
+
+// writeStoredData writes the file header record of kcf.currentFile
+// with size bytes read from r as its added data.
+func (kcf *Kcf) writeStoredData(r io.Reader, size uint64) (err error) {
+	kcf.lastRecord, err = kcf.currentFile.AsRecord()
+	if err != nil {
+		return err
+	}
+
+	if size > 0 {
+		kcf.lastRecord.HeadFlags |= HAS_ADDED_4
+		if size > 2147483647 {
+			kcf.lastRecord.HeadFlags |= HAS_ADDED_8
+		}
+		kcf.lastRecord.AddedDataSize = size
+
+		if !kcf.isSeekable {
+			kcf.lastRecord.HeadFlags |= 0x01
+			kcf.lastRecord.AddedDataSize = 0
+			kcf.lastRecord.HeadFlags &^= HAS_ADDED_8
+		}
 	}
 
 	kcf.lastRecord.Fix()
-	kcf.writeRecord(kcf.lastRecord)
+	_, err = kcf.writeRecord(kcf.lastRecord)
+	if err != nil {
+		return
+	}
+	kcf.hdrOffset = kcf.recOffset
+
+	if size == 0 {
+		kcf.hdrRecord = kcf.lastRecord
+		return
+	}
 
 	var buffer []byte
 	var n int
@@ -370,7 +1086,7 @@ func (kcf *Kcf) PackFileRaw(file *os.File) (err error) {
 	buffer = make([]byte, 4096)
 
 	for {
-		n, err = file.Read(buffer)
+		n, err = r.Read(buffer)
 		if err != nil && err != io.EOF {
 			return
 		}
@@ -385,11 +1101,165 @@ func (kcf *Kcf) PackFileRaw(file *os.File) (err error) {
 		}
 	}
 
-	if err == io.EOF {
-		err = nil
+	err = kcf.finishAddedData()
+	if err != nil {
+		return
+	}
+
+	kcf.hdrRecord = kcf.lastRecord
+	return
+}
+
+// writePackedData encodes size bytes read from r with filters of the
+// file and the codec of its compression method, which is nil for stored
+// data, and writes them split into fragments.
+func (kcf *Kcf) writePackedData(c codec, r io.Reader, size uint64) (
+	err error,
+) {
+	info := kcf.currentFile.CompressionInfo
+	fw := newFragmentWriter(&recordSink{kcf: kcf}, c, info)
+
+	err = encodeData(fw, r, size, kcf.currentFile.Filters, info)
+	kcf.packedSize = fw.packed
+	return
+}
+
+// encodeData encodes size bytes read from r by filters and then by the
+// compression method of info into fw and closes it.
+func encodeData(fw *fragmentWriter, r io.Reader, size uint64,
+	filters []uint32, info uint32) (err error) {
+	var cw io.WriteCloser
+	cw, err = newChainWriter(fw, filters, info)
+	if err != nil {
+		return
+	}
+
+	var n int64
+	n, err = io.CopyBuffer(cw, io.LimitReader(r, int64(size)),
+		make([]byte, 64<<10))
+	if err != nil {
+		return
+	}
+	if uint64(n) != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	err = cw.Close()
+	if err != nil {
+		return
+	}
+
+	return fw.Close()
+}
+
+// rewriteFileHeader updates the file header record of the file being
+// packed with the contents of kcf.currentFile.
+func (kcf *Kcf) rewriteFileHeader() (err error) {
+	var rec Record
+
+	rec, err = kcf.currentFile.AsRecord()
+	if err != nil {
+		return
+	}
+
+	hdrRecord := kcf.hdrRecord
+	hdrRecord.Data = rec.Data
+	err = hdrRecord.Fix()
+	if err != nil {
+		return
+	}
+
+	return kcf.rewriteRecord(kcf.hdrOffset, hdrRecord)
+}
+
+// CopyFileRaw copies the current file of the src archive into the
+// archive without unpacking it. Records are written as they are,
+// so the copied file keeps its compression and checksums. Files of
+// solid blocks are unpacked and packed on their own by the compression
+// method of their blocks instead.
+func (kcf *Kcf) CopyFileRaw(src *Kcf) (err error) {
+	if !kcf.state.IsWriting() || !src.state.IsReading() {
+		panic(InvalidState)
+	}
+
+	if src.state.GetPackerPos() == pposFileHeader {
+		_, err = src.GetCurrentFile()
+		if err != nil {
+			return
+		}
+	}
+
+	if src.state.GetPackerPos() != pposFileData {
+		panic(InvalidState)
+	}
+
+	if (src.currentFile.FileFlags & IN_SOLID_BLOCK) != 0 {
+		return kcf.copySolidFile(src)
+	}
+
+	for _, aux := range src.auxRecords {
+		if recordVersion(aux.rec.HeadType) > kcf.versionLimit {
+			return UnsupportedFeature
+		}
+	}
+
+	var n int
+	buffer := make([]byte, 4096)
+
+	kcf.state.SetPackerPos(pposFileMetadata)
+	for _, aux := range src.auxRecords {
+		err = kcf.writeRecordData(aux.rec, aux.data)
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		rec := src.lastRecord
+
+		_, err = kcf.writeRecord(rec)
+		if err != nil {
+			return
+		}
+
+		if kcf.state.GetStage() == stageRecordAddedData {
+			kcf.state.SetAddedCRCKnown(true)
+
+			for src.state.GetStage() == stageRecordAddedData {
+				n, err = src.readAddedData(buffer)
+				if err != nil && err != io.EOF {
+					return
+				}
+
+				_, err = kcf.writeAddedData(buffer[:n])
+				if err != nil {
+					return
+				}
+			}
+
+			err = kcf.finishAddedData()
+			if err != nil {
+				return
+			}
+		}
+
+		if rec.HeadFlags&0x01 == 0 {
+			break
+		}
+
+		_, err = src.readRecord()
+		if err != nil {
+			return
+		}
+
+		if src.lastRecord.HeadType != DATA_FRAGMENT {
+			err = InvalidFormat
+			return
+		}
 	}
 
-	kcf.finishAddedData()
+	kcf.currentFile = src.currentFile
+	src.state.SetPackerPos(pposFileHeader)
 	kcf.state.SetPackerPos(pposFileHeader)
 
 	return
@@ -401,12 +1271,37 @@ func (kcf *Kcf) InitArchive() (err error) {
 	}
 
 	if kcf.state.IsWriting() {
+		kcf.archiveHdr.Version = kcf.options.Version
+		kcf.versionLimit = kcf.options.Version
+		if kcf.archiveHdr.Version == 0 {
+			kcf.archiveHdr.Version = kcf.lowestVersion()
+			kcf.versionLimit = MaxVersion
+		}
+
+		err = checkVersion(kcf.archiveHdr.Version)
+		if err != nil {
+			return
+		}
+
+		if kcf.options.Solid.BlockSize > 0 &&
+			kcf.archiveHdr.Version >= solidVersion {
+			kcf.archiveHdr.ArchiveFlags |= IS_SOLID
+		}
+
+		kcf.archiveHdr.Checksum = CHECKSUM_CRC32C
+		kcf.archiveHdr.HostOS = hostOSOf(runtime.GOOS)
+		kcf.archiveHdr.Creator = kcf.options.Creator
+		kcf.archiveHdr.CreationTime = kcf.options.CreationTime
+		if kcf.archiveHdr.CreationTime.IsZero() {
+			kcf.archiveHdr.CreationTime = time.Now()
+		}
+
 		err = kcf.writeMarker()
 		if err != nil {
 			return
 		}
 
-		kcf.lastRecord, err = ArchiveHeader{Version: 1}.AsRecord()
+		kcf.lastRecord, err = kcf.archiveHdr.AsRecord()
 		if err != nil {
 			return
 		}
@@ -415,6 +1310,7 @@ func (kcf *Kcf) InitArchive() (err error) {
 		if err != nil {
 			return
 		}
+		kcf.ahdrOffset = kcf.recOffset
 	} else if kcf.state.IsReading() {
 		err = kcf.scanForMarker()
 		if err != nil {
@@ -430,6 +1326,16 @@ func (kcf *Kcf) InitArchive() (err error) {
 		if err != nil {
 			return
 		}
+
+		err = checkVersion(kcf.archiveHdr.Version)
+		if err != nil {
+			return
+		}
+
+		if kcf.archiveHdr.Checksum != CHECKSUM_CRC32C {
+			err = UnsupportedChecksum
+			return
+		}
 	}
 
 	kcf.state.SetPackerPos(pposFileHeader)
@@ -0,0 +1,138 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestFiltersVersion(t *testing.T) {
+	data := textData(10000, 1)
+	filters := []uint32{compressionInfo(METHOD_DELTA, 0)}
+
+	tests := []struct {
+		version uint16
+		want    uint16
+		err     error
+	}{
+		{0, filtersVersion, nil},
+		{1, 1, UnsupportedFeature},
+		{2, 2, nil},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "test.kcf")
+		kcf, err := CreateNewArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kcf.SetWriterOptions(WriterOptions{Version: tt.version})
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		var hdr FileHeader
+		hdr.FileName = "file"
+		hdr.FileType = REGULAR_FILE
+		hdr.CompressionInfo = compressionInfo(METHOD_LZMA, 0)
+		hdr.Filters = filters
+		hdr.SetUnpackedSize(uint64(len(data)))
+
+		err = kcf.PackFile(hdr, bytes.NewReader(data))
+		kcf.Close()
+		if err != tt.err {
+			t.Errorf("version %d: got %v, want %v", tt.version, err,
+				tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		kcf, err = OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		if kcf.Version() != tt.want {
+			t.Errorf("version %d: archive has version %d, want %d",
+				tt.version, kcf.Version(), tt.want)
+		}
+		kcf.Close()
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	tests := []struct {
+		version uint16
+		ok      bool
+	}{
+		{0, false},
+		{MinVersion, true},
+		{MaxVersion, true},
+		{MaxVersion + 1, false},
+		{0xFFFF, false},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "test.kcf")
+		kcf, err := CreateNewArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Writers refuse unknown versions, zero selects the default.
+		kcf.SetWriterOptions(WriterOptions{Version: tt.version})
+		err = kcf.InitArchive()
+		refused := !tt.ok && tt.version != 0
+		if refused && !isUnsupportedVersion(err, tt.version) ||
+			!refused && err != nil {
+			t.Errorf("version %d: writer returned %v", tt.version, err)
+		}
+		kcf.Close()
+
+		// The archive header is rewritten with the version for readers.
+		kcf, err = CreateNewArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		kcf.archiveHdr.Version = tt.version
+		rec, err := kcf.archiveHdr.AsRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.rewriteRecord(kcf.ahdrOffset, rec); err != nil {
+			t.Fatal(err)
+		}
+		kcf.Close()
+
+		kcf, err = OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = kcf.InitArchive()
+		kcf.Close()
+
+		if tt.ok && err != nil ||
+			!tt.ok && !isUnsupportedVersion(err, tt.version) {
+			t.Errorf("version %d: reader returned %v", tt.version, err)
+		}
+	}
+}
+
+// isUnsupportedVersion reports whether err is ErrUnsupportedVersion for
+// the version.
+func isUnsupportedVersion(err error, version uint16) bool {
+	var e *ErrUnsupportedVersion
+
+	return errors.As(err, &e) && e.Found == version &&
+		e.Supported == MaxVersion
+}
@@ -0,0 +1,121 @@
+package kcf
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// MethodRule selects filters and the compression method of files by
+// their names and first bytes when WriterOptions.AutoCompression is
+// set.
+type MethodRule struct {
+	// Pattern is matched against the base name of the file by
+	// path.Match. Empty Pattern matches any name.
+	Pattern string
+
+	// Magic is matched against file data at MagicOffset. Empty Magic
+	// matches any data.
+	Magic       []byte
+	MagicOffset int
+
+	Filters     []uint32
+	Compression uint32
+}
+
+func (rule MethodRule) matches(name string, sample []byte) bool {
+	if rule.Pattern != "" {
+		if matched, _ := path.Match(rule.Pattern, name); !matched {
+			return false
+		}
+	}
+
+	if len(rule.Magic) > 0 {
+		if rule.MagicOffset < 0 ||
+			rule.MagicOffset+len(rule.Magic) > len(sample) {
+			return false
+		}
+
+		start := sample[rule.MagicOffset:]
+		return bytes.HasPrefix(start, rule.Magic)
+	}
+
+	return true
+}
+
+// autoSampleSize is the amount of data at the start of a file examined
+// to select its compression method.
+const autoSampleSize = 64 << 10
+
+// compressedMagic lists signatures of formats whose data are already
+// compressed.
+var compressedMagic = []struct {
+	offset int
+	magic  string
+}{
+	{0, "\xFF\xD8\xFF"},       // JPEG
+	{0, "\x89PNG\r\n\x1A\n"},  // PNG
+	{0, "GIF8"},               // GIF
+	{0, "PK\x03\x04"},         // zip and its derivatives
+	{0, "\x1F\x8B"},           // gzip
+	{0, "BZh"},                // bzip2
+	{0, "\xFD7zXZ\x00"},       // xz
+	{0, "\x28\xB5\x2F\xFD"},   // zstd
+	{0, "\x04\x22\x4D\x18"},   // LZ4 frame
+	{0, "7z\xBC\xAF\x27\x1C"}, // 7z
+	{0, "Rar!\x1A\x07"},       // RAR
+	{0, "OggS"},               // Ogg
+	{0, "fLaC"},               // FLAC
+	{4, "ftyp"},               // MP4 and QuickTime
+	{0, "\x1A\x45\xDF\xA3"},   // Matroska and WebM
+	{0, "KC!\x1A\x06\x00"},    // KCF archive
+}
+
+// isIncompressible reports whether sample from the start of a file is
+// of a compressed format or its bytes are spread so evenly that
+// compression would not pay off.
+func isIncompressible(sample []byte) bool {
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(sample[min(m.offset, len(sample)):],
+			[]byte(m.magic)) {
+			return true
+		}
+	}
+
+	// Entropy of a small sample is underestimated.
+	if len(sample) < 4096 {
+		return false
+	}
+
+	return entropyBits(sample, 0) > 7.9*float64(len(sample))
+}
+
+// selectMethod returns filters and CompressionInfo of the file for
+// opts.AutoCompression. Incompressible files are stored, others are
+// compressed by the first matching rule, or by Filters and Compression
+// of opts. Filters of rules are left out unless ruleFilters is set.
+func selectMethod(file *os.File, size int64, opts WriterOptions,
+	ruleFilters bool) (
+	filters []uint32,
+	info uint32,
+) {
+	sample := make([]byte, min(size, autoSampleSize))
+	if _, err := file.ReadAt(sample, 0); err == nil &&
+		isIncompressible(sample) {
+		return nil, compressionInfo(METHOD_STORED, 0)
+	}
+
+	name := filepath.Base(file.Name())
+	for _, rule := range opts.MethodRules {
+		if rule.matches(name, sample) {
+			if !ruleFilters {
+				return nil, rule.Compression
+			}
+
+			return rule.Filters, rule.Compression
+		}
+	}
+
+	return opts.Filters, opts.Compression
+}
@@ -0,0 +1,217 @@
+package kcf
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// spreadData returns n random bytes out of the first symbols values,
+// which look compressible by their entropy, but LZ4 cannot shrink.
+func spreadData(n int, symbols int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rnd.Intn(symbols))
+	}
+
+	return data
+}
+
+func TestIsIncompressible(t *testing.T) {
+	text := textData(autoSampleSize, 1)
+
+	tests := []struct {
+		name   string
+		sample []byte
+		want   bool
+	}{
+		{"text", text, false},
+		{"JPEG", append([]byte("\xFF\xD8\xFF\xE0"), text...), true},
+		{"zip", append([]byte("PK\x03\x04"), text...), true},
+		{"zstd", append([]byte("\x28\xB5\x2F\xFD"), text...), true},
+		{"MP4", append([]byte("\x00\x00\x00\x20ftypisom"), text...), true},
+		{"short magic", []byte("\xFF\xD8"), false},
+		{"magic later", append([]byte("x"), "PK\x03\x04"...), false},
+		{"empty", nil, false},
+		{"random", randomData(autoSampleSize, 1), true},
+		{"small random", randomData(4095, 1), false},
+		{"spread", spreadData(autoSampleSize, 200, 1), false},
+	}
+
+	for _, tt := range tests {
+		if got := isIncompressible(tt.sample); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectMethod(t *testing.T) {
+	lz4 := compressionInfo(METHOD_LZ4, 0)
+	lzma := compressionInfo(METHOD_LZMA, 0)
+	ppmd := compressionInfo(METHOD_PPMD, 0)
+	stored := compressionInfo(METHOD_STORED, 0)
+	delta := []uint32{compressionInfo(METHOD_DELTA, 0)}
+	x86 := []uint32{compressionInfo(METHOD_BCJ_X86, 0)}
+
+	opts := WriterOptions{
+		AutoCompression: true,
+		Compression:     lzma,
+		Filters:         delta,
+		MethodRules: []MethodRule{
+			{Pattern: "*.txt", Compression: ppmd},
+			{Magic: []byte("\x7FELF"), Filters: x86, Compression: lzma},
+			{Magic: []byte("ustar"), MagicOffset: 257, Compression: lz4},
+			{Pattern: "*.wav", Filters: delta, Compression: lz4},
+		},
+	}
+
+	text := textData(10000, 1)
+	tar := bytes.Clone(text)
+	copy(tar[257:], "ustar")
+
+	tests := []struct {
+		name        string
+		data        []byte
+		ruleFilters bool
+		filters     []uint32
+		info        uint32
+	}{
+		{"a.txt", text, true, nil, ppmd},
+		{"a.jpg", append([]byte("\xFF\xD8\xFF\xE0"), text...), true, nil,
+			stored},
+		{"a.txt.gz", append([]byte("\x1F\x8B"), text...), true, nil,
+			stored},
+		{"random.txt", randomData(10000, 1), true, nil, stored},
+		{"prog", append([]byte("\x7FELF"), text...), true, x86, lzma},
+		{"prog.txt", append([]byte("\x7FELF"), text...), true, nil, ppmd},
+		{"archive.tar", tar, true, nil, lz4},
+		{"short.tar", tar[:260], true, opts.Filters, lzma},
+		{"sound.wav", text, true, delta, lz4},
+		{"sound.wav", text, false, nil, lz4},
+		{"other", text, true, opts.Filters, lzma},
+		{"empty", nil, true, opts.Filters, lzma},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filters, info := selectMethod(file, int64(len(tt.data)), opts,
+			tt.ruleFilters)
+		file.Close()
+
+		if !slices.Equal(filters, tt.filters) || info != tt.info {
+			t.Errorf("%s: got %s with %d filters, want %s with %d",
+				tt.name, CompressionName(info), len(filters),
+				CompressionName(tt.info), len(tt.filters))
+		}
+	}
+}
+
+func TestAutoCompressionFallback(t *testing.T) {
+	dir := t.TempDir()
+	paths, contents := writeFiles(t, dir, []string{"spread", "text"},
+		[]int{0, 100000})
+
+	// The data of spread are packed as LZ4 first, which does not pay
+	// off.
+	spread := spreadData(100000, 200, 1)
+	if err := os.WriteFile(paths[0], spread, 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents[paths[0]] = string(spread)
+
+	opts := WriterOptions{
+		AutoCompression: true,
+		Compression:     compressionInfo(METHOD_LZ4, 0),
+	}
+
+	for _, workers := range []int{0, 1, 4} {
+		path := filepath.Join(dir, "test.kcf")
+		kcf, err := CreateNewArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kcf.SetWriterOptions(opts)
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Zero workers packs files by the archive itself.
+		if workers == 0 {
+			for _, path := range paths {
+				if err = kcf.PackPath(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else {
+			p := kcf.NewPipeline(workers)
+			for _, path := range paths {
+				if err = p.PackPath(path, opts); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = p.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		kcf.Close()
+
+		kcf, err = OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []Method{METHOD_STORED, METHOD_LZ4}
+		for i := 0; ; i++ {
+			hdr, err := kcf.GetCurrentFile()
+			if err == io.EOF {
+				if i != len(paths) {
+					t.Errorf("%d workers: got %d files, want %d",
+						workers, i, len(paths))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%d workers: %v", workers, err)
+			}
+			if i >= len(paths) {
+				t.Fatalf("%d workers: more files than packed", workers)
+			}
+
+			if MethodOf(hdr.CompressionInfo) != want[i] {
+				t.Errorf("%d workers: %s is packed by %s", workers,
+					hdr.FileName, CompressionName(hdr.CompressionInfo))
+			}
+
+			var data bytes.Buffer
+			_, err = kcf.UnpackFile(&data)
+			if err != nil && err != io.EOF {
+				t.Fatalf("%d workers: %v", workers, err)
+			}
+			if data.String() != contents[hdr.FileName] {
+				t.Errorf("%d workers: data of %s differ", workers,
+					hdr.FileName)
+			}
+		}
+		kcf.Close()
+	}
+}
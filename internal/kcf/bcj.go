@@ -0,0 +1,397 @@
+package kcf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// BCJ filters convert relative targets of branch instructions in machine
+// code into absolute addresses, so that calls of the same function look
+// the same and compress better. Positions are counted from the start of
+// the filtered data. The filters convert data the same way as filters of
+// XZ Utils with zero start offset. They have no parameters.
+type bcjCodec struct {
+	arch string
+
+	newConverter func(encode bool) converter
+}
+
+func (c bcjCodec) name() string {
+	return c.arch
+}
+
+func (bcjCodec) parseParams(args []string) (params uint32, err error) {
+	if len(args) > 0 {
+		err = InvalidCompressionParams
+	}
+
+	return
+}
+
+func (bcjCodec) formatParams(params uint32) string {
+	return ""
+}
+
+func (bcjCodec) memoryUsage(params uint32) uint64 {
+	return filterChunkSize
+}
+
+func (c bcjCodec) newWriter(w io.Writer, params uint32) (
+	io.WriteCloser,
+	error,
+) {
+	if params != 0 {
+		return nil, InvalidCompressionParams
+	}
+
+	return &filterWriter{w: w, conv: c.newConverter(true)}, nil
+}
+
+func (c bcjCodec) newReader(r io.Reader, params uint32) (io.Reader, error) {
+	if params != 0 {
+		return nil, InvalidCompressionParams
+	}
+
+	return &filterReader{r: r, conv: c.newConverter(false)}, nil
+}
+
+// elfFilter returns CompressionInfo of the BCJ filter for machine code
+// of the ELF file whose header is given.
+func elfFilter(header []byte) (info uint32, ok bool) {
+	if len(header) < 20 || string(header[:4]) != elf.ELFMAG {
+		return
+	}
+
+	var machine elf.Machine
+	switch elf.Data(header[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		machine = elf.Machine(le.Uint16(header[18:]))
+	case elf.ELFDATA2MSB:
+		machine = elf.Machine(binary.BigEndian.Uint16(header[18:]))
+	default:
+		return
+	}
+
+	switch machine {
+	case elf.EM_386, elf.EM_X86_64:
+		return compressionInfo(METHOD_BCJ_X86, 0), true
+	case elf.EM_AARCH64:
+		return compressionInfo(METHOD_BCJ_ARM64, 0), true
+	case elf.EM_RISCV:
+		return compressionInfo(METHOD_BCJ_RISCV, 0), true
+	}
+
+	return
+}
+
+// autoBCJ returns the BCJ filter for the file if it is an ELF file of a
+// known machine.
+func autoBCJ(file *os.File) (filters []uint32) {
+	var header [20]byte
+
+	if _, err := file.ReadAt(header[:], 0); err != nil {
+		return
+	}
+
+	if info, ok := elfFilter(header[:]); ok {
+		filters = []uint32{info}
+	}
+
+	return
+}
+
+// bcjX86 converts targets of CALL (E8) and JMP (E9) instructions with
+// 32-bit displacements. prevMask remembers which of the preceding bytes
+// were E8 or E9 not taken as opcodes, so that bytes of other
+// instructions are less likely to be converted.
+type bcjX86 struct {
+	encode   bool
+	prevMask uint32
+	prevPos  uint32
+}
+
+var bcjX86AllowedStatus = [8]bool{
+	true, true, true, false, true, false, false, false,
+}
+
+var bcjX86MaskToBitNumber = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+
+func newBCJX86(encode bool) converter {
+	x := &bcjX86{encode: encode}
+	x.prevPos -= 5
+	return x
+}
+
+// bcjX86TestMSByte reports whether b may be the most significant byte
+// of a displacement, which is near zero for calls within a file.
+func bcjX86TestMSByte(b byte) bool {
+	return b == 0x00 || b == 0xFF
+}
+
+func (x *bcjX86) convert(buf []byte, pos uint32) int {
+	if len(buf) < 5 {
+		return 0
+	}
+
+	if pos-x.prevPos > 5 {
+		x.prevPos = pos - 5
+	}
+
+	limit := len(buf) - 5
+	i := 0
+	for i <= limit {
+		b := buf[i]
+		if b != 0xE8 && b != 0xE9 {
+			i++
+			continue
+		}
+
+		offset := pos + uint32(i) - x.prevPos
+		x.prevPos = pos + uint32(i)
+
+		if offset > 5 {
+			x.prevMask = 0
+		} else {
+			for k := uint32(0); k < offset; k++ {
+				x.prevMask &= 0x77
+				x.prevMask <<= 1
+			}
+		}
+
+		b = buf[i+4]
+		if !bcjX86TestMSByte(b) ||
+			!bcjX86AllowedStatus[(x.prevMask>>1)&7] ||
+			x.prevMask>>1 >= 0x10 {
+			i++
+			x.prevMask |= 1
+			if bcjX86TestMSByte(b) {
+				x.prevMask |= 0x10
+			}
+			continue
+		}
+
+		src := le.Uint32(buf[i+1:])
+		next := pos + uint32(i) + 5
+
+		var dest uint32
+		for {
+			if x.encode {
+				dest = src + next
+			} else {
+				dest = src - next
+			}
+
+			if x.prevMask == 0 {
+				break
+			}
+
+			k := bcjX86MaskToBitNumber[x.prevMask>>1]
+			if !bcjX86TestMSByte(byte(dest >> (24 - k*8))) {
+				break
+			}
+
+			src = dest ^ (1<<(32-k*8) - 1)
+		}
+
+		// Keep the most significant byte 00 or FF depending on bit 24.
+		dest = dest&0x00FFFFFF | ^((dest>>24)&1-1)<<24
+		le.PutUint32(buf[i+1:], dest)
+		i += 5
+		x.prevMask = 0
+	}
+
+	return i
+}
+
+// bcjARM64 converts targets of BL instructions and ADRP instructions
+// whose targets are within 512 MiB.
+type bcjARM64 struct {
+	encode bool
+}
+
+func newBCJARM64(encode bool) converter {
+	return bcjARM64{encode: encode}
+}
+
+func (a bcjARM64) convert(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		pc := pos + uint32(i)
+		instr := le.Uint32(buf[i:])
+
+		if instr>>26 == 0x25 {
+			// BL
+			pc >>= 2
+			if !a.encode {
+				pc = -pc
+			}
+
+			instr = 0x94000000 | (instr+pc)&0x03FFFFFF
+			le.PutUint32(buf[i:], instr)
+		} else if instr&0x9F000000 == 0x90000000 {
+			// ADRP
+			src := (instr>>29)&3 | (instr>>3)&0x001FFFFC
+			if (src+0x00020000)&0x001C0000 != 0 {
+				continue
+			}
+
+			pc >>= 12
+			if !a.encode {
+				pc = -pc
+			}
+
+			dest := src + pc
+			instr &= 0x9000001F
+			instr |= (dest & 3) << 29
+			instr |= (dest & 0x0003FFFC) << 3
+			instr |= -(dest & 0x00020000) & 0x00E00000
+			le.PutUint32(buf[i:], instr)
+		}
+	}
+
+	return i
+}
+
+// bcjRISCV converts targets of JAL instructions linking to ra or t0 and
+// of AUIPC instructions paired with the following instruction using
+// their result. Converted pairs are stored as an AUIPC with rd = x2
+// holding the fields of the second instruction, followed by the big
+// endian absolute address. AUIPC instructions with rd = x2 which look
+// like converted pairs are converted the other way, so that the decoder
+// restores them.
+type bcjRISCV struct {
+	encode bool
+}
+
+func newBCJRISCV(encode bool) converter {
+	return bcjRISCV{encode: encode}
+}
+
+// bcjRISCVNotPair reports whether the instruction following AUIPC does
+// not take rd of AUIPC as rs1 or is a compressed instruction.
+func bcjRISCVNotPair(auipc, inst2 uint32) bool {
+	return ((auipc<<8)^(inst2-3))&0xF8003 != 0
+}
+
+// bcjRISCVNotSpecial reports whether AUIPC with rd = x2 cannot be taken
+// for a converted pair: it does not hold the lowest opcode bits of the
+// second instruction in bits 12 and 13, or its would-be rs1 is x0 or x2.
+func bcjRISCVNotSpecial(auipc, rs1 uint32) bool {
+	return (auipc-0x3117)<<18 >= rs1&0x1D
+}
+
+func (r bcjRISCV) convert(buf []byte, pos uint32) int {
+	if len(buf) < 8 {
+		return 0
+	}
+
+	limit := len(buf) - 8
+	i := 0
+	for ; i <= limit; i += 2 {
+		inst := uint32(buf[i])
+
+		if inst == 0xEF {
+			// JAL
+			b1 := uint32(buf[i+1])
+			if b1&0x0D != 0 {
+				continue
+			}
+
+			b2 := uint32(buf[i+2])
+			b3 := uint32(buf[i+3])
+			pc := pos + uint32(i)
+
+			if r.encode {
+				addr := (b1&0xF0)<<8 | (b2&0x0F)<<16 | (b2&0x10)<<7 |
+					(b2&0xE0)>>4 | (b3&0x7F)<<4 | (b3&0x80)<<13
+				addr += pc
+
+				buf[i+1] = byte(b1&0x0F | (addr>>13)&0xF0)
+				buf[i+2] = byte(addr >> 9)
+				buf[i+3] = byte(addr >> 1)
+			} else {
+				addr := (b1&0xF0)<<13 | b2<<9 | b3<<1
+				addr -= pc
+
+				buf[i+1] = byte(b1&0x0F | (addr>>8)&0xF0)
+				buf[i+2] = byte((addr>>16)&0x0F | (addr>>7)&0x10 |
+					(addr<<4)&0xE0)
+				buf[i+3] = byte((addr>>4)&0x7F | (addr>>13)&0x80)
+			}
+
+			i += 4 - 2
+			continue
+		}
+
+		if inst&0x7F != 0x17 {
+			continue
+		}
+
+		// AUIPC
+		inst = le.Uint32(buf[i:])
+		var inst2 uint32
+
+		if inst&0xE80 != 0 {
+			// rd is neither x0 nor x2.
+			inst2 = le.Uint32(buf[i+4:])
+			if bcjRISCVNotPair(inst, inst2) {
+				// Bits checked in the second instruction lie
+				// in its first three bytes, which stay intact
+				// whatever starts at i+6.
+				i += 6 - 2
+				continue
+			}
+
+			if r.encode {
+				addr := inst & 0xFFFFF000
+				addr += inst2>>20 - (inst2>>19)&0x1000
+				addr += pos + uint32(i)
+
+				inst = 0x17 | 2<<7 | inst2<<12
+				le.PutUint32(buf[i:], inst)
+				binary.BigEndian.PutUint32(buf[i+4:], addr)
+			} else {
+				// Restore AUIPC with rd = x2 converted the
+				// other way by the encoder.
+				addr := inst&0xFFFFF000 | inst2>>20
+
+				inst = 0x17 | 2<<7 | inst2<<12
+				le.PutUint32(buf[i:], inst)
+				le.PutUint32(buf[i+4:], addr)
+			}
+		} else {
+			// rd is x0 or x2.
+			rs1 := inst >> 27
+			if bcjRISCVNotSpecial(inst, rs1) {
+				i += 4 - 2
+				continue
+			}
+
+			if r.encode {
+				// Convert AUIPC which looks like a converted
+				// pair so that the decoder takes it for an
+				// unconverted one.
+				addr := le.Uint32(buf[i+4:])
+
+				inst2 = inst>>12 | addr<<20
+				inst = 0x17 | rs1<<7 | addr&0xFFFFF000
+				le.PutUint32(buf[i:], inst)
+				le.PutUint32(buf[i+4:], inst2)
+			} else {
+				addr := binary.BigEndian.Uint32(buf[i+4:])
+				addr -= pos + uint32(i)
+
+				inst2 = inst>>12 | addr<<20
+				inst = 0x17 | rs1<<7 | (addr+0x800)&0xFFFFF000
+				le.PutUint32(buf[i:], inst)
+				le.PutUint32(buf[i+4:], inst2)
+			}
+		}
+
+		i += 8 - 2
+	}
+
+	return i
+}
@@ -0,0 +1,219 @@
+package kcf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// x86Code returns n bytes of random data with many CALL and JMP
+// instructions whose displacements are near zero.
+func x86Code(n int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	code := make([]byte, 0, n+5)
+	for len(code) < n {
+		if rnd.Intn(4) != 0 {
+			code = append(code, byte(rnd.Intn(256)))
+			continue
+		}
+
+		code = append(code, 0xE8+byte(rnd.Intn(2)))
+		code = le.AppendUint32(code, uint32(rnd.Intn(1<<25)-1<<24))
+	}
+
+	return code[:n]
+}
+
+// arm64Code returns n bytes of random instructions, many of them BL and
+// ADRP.
+func arm64Code(n int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	code := make([]byte, 0, n+4)
+	for len(code) < n {
+		instr := rnd.Uint32()
+		switch rnd.Intn(3) {
+		case 0:
+			instr = 0x94000000 | instr&0x03FFFFFF
+		case 1:
+			instr = 0x90000000 | instr&^0x9F000000
+		}
+
+		code = le.AppendUint32(code, instr)
+	}
+
+	return code[:n]
+}
+
+// riscvCode returns n bytes of random instructions, many of them JAL,
+// AUIPC paired with instructions using its result, and AUIPC with
+// rd = x2, which the filter treats specially.
+func riscvCode(n int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	code := make([]byte, 0, n+8)
+	for len(code) < n {
+		instr := rnd.Uint32()
+		rd := uint32(rnd.Intn(32))
+		switch rnd.Intn(5) {
+		case 0:
+			// JAL linking to ra or t0.
+			rd = []uint32{1, 5}[rnd.Intn(2)]
+			instr = instr&0xFFFFF000 | rd<<7 | 0x6F
+		case 1:
+			// AUIPC followed by ADDI or LW taking its result.
+			code = le.AppendUint32(code, instr&0xFFFFF000|rd<<7|0x17)
+			instr = instr&0xFFF0_7F80 | rd<<15 | 0x13
+			if rnd.Intn(2) == 0 {
+				instr = instr&0xFFF0_0F80 | rd<<15 | 2<<12 | 0x03
+			}
+		case 2:
+			// AUIPC with rd = x2.
+			instr = instr&0xFFFFF000 | 2<<7 | 0x17
+		case 3:
+			// A compressed instruction.
+			code = le.AppendUint16(code, uint16(instr))
+			continue
+		}
+
+		code = le.AppendUint32(code, instr)
+	}
+
+	return code[:n]
+}
+
+func TestBCJRoundTrip(t *testing.T) {
+	chunk := filterChunkSize
+
+	// Instructions at every offset around the end of the first chunk
+	// of filters.
+	straddle := func(op ...byte) []byte {
+		data := make([]byte, 2*chunk)
+		for i := chunk - 12; i < chunk+4; i += len(op) + 1 {
+			copy(data[i:], op)
+		}
+
+		return data
+	}
+
+	tests := []struct {
+		method Method
+		name   string
+		data   []byte
+	}{
+		{METHOD_BCJ_X86, "random", randomData(3*chunk+5, 1)},
+		{METHOD_BCJ_X86, "code", x86Code(3*chunk+5, 2)},
+		{METHOD_BCJ_X86, "calls",
+			bytes.Repeat([]byte{0xE8, 0, 0, 0, 0}, chunk/5+9)},
+		{METHOD_BCJ_X86, "straddle", straddle(0xE8, 1, 2, 3, 0)},
+		{METHOD_BCJ_ARM64, "random", randomData(3*chunk+5, 3)},
+		{METHOD_BCJ_ARM64, "code", arm64Code(3*chunk+2, 4)},
+		{METHOD_BCJ_ARM64, "straddle", straddle(1, 0, 0, 0x94)},
+		{METHOD_BCJ_RISCV, "random", randomData(3*chunk+5, 5)},
+		{METHOD_BCJ_RISCV, "code", riscvCode(3*chunk+3, 6)},
+		{METHOD_BCJ_RISCV, "straddle", straddle(0x97, 0x02, 0, 0,
+			0x13, 0x85, 0x02, 0)},
+	}
+
+	for _, tt := range tests {
+		info := compressionInfo(tt.method, 0)
+		t.Run(CompressionName(info)+"/"+tt.name, func(t *testing.T) {
+			filterRoundTrip(t, info, nil)
+			filterRoundTrip(t, info, tt.data[:3])
+			encoded := filterRoundTrip(t, info, tt.data)
+			if tt.name != "random" && bytes.Equal(encoded, tt.data) {
+				t.Error("nothing has been converted")
+			}
+		})
+	}
+}
+
+func TestBCJConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		conv    func(encode bool) converter
+		pos     uint32
+		in, out []byte
+	}{
+		// Displacements become targets relative to the start of data.
+		{"x86 call", newBCJX86, 0x1000,
+			[]byte{0xE8, 0x10, 0, 0, 0},
+			[]byte{0xE8, 0x15, 0x10, 0, 0}},
+		{"x86 backward jump", newBCJX86, 0x1000,
+			[]byte{0xE9, 0xF0, 0xFF, 0xFF, 0xFF},
+			[]byte{0xE9, 0xF5, 0x0F, 0, 0}},
+		{"x86 far call", newBCJX86, 0x1000,
+			[]byte{0xE8, 0, 0, 0, 0x12},
+			[]byte{0xE8, 0, 0, 0, 0x12}},
+		{"arm64 bl", newBCJARM64, 0x1000,
+			[]byte{0x01, 0, 0, 0x94},
+			[]byte{0x01, 0x04, 0, 0x94}},
+		{"arm64 other", newBCJARM64, 0x1000,
+			[]byte{0x1F, 0x20, 0x03, 0xD5},
+			[]byte{0x1F, 0x20, 0x03, 0xD5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Clone(tt.in)
+			tt.conv(true).convert(buf, tt.pos)
+			if !bytes.Equal(buf, tt.out) {
+				t.Fatalf("encoded % X, want % X", buf, tt.out)
+			}
+
+			tt.conv(false).convert(buf, tt.pos)
+			if !bytes.Equal(buf, tt.in) {
+				t.Fatalf("decoded % X, want % X", buf, tt.in)
+			}
+		})
+	}
+}
+
+func TestELFFilter(t *testing.T) {
+	header := func(data elf.Data, machine elf.Machine) []byte {
+		h := make([]byte, 20)
+		copy(h, elf.ELFMAG)
+		h[elf.EI_DATA] = byte(data)
+
+		order := binary.ByteOrder(binary.LittleEndian)
+		if data == elf.ELFDATA2MSB {
+			order = binary.BigEndian
+		}
+		order.PutUint16(h[18:], uint16(machine))
+
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+		method Method
+		ok     bool
+	}{
+		{"x86-64", header(elf.ELFDATA2LSB, elf.EM_X86_64),
+			METHOD_BCJ_X86, true},
+		{"i386", header(elf.ELFDATA2LSB, elf.EM_386),
+			METHOD_BCJ_X86, true},
+		{"arm64", header(elf.ELFDATA2LSB, elf.EM_AARCH64),
+			METHOD_BCJ_ARM64, true},
+		{"riscv", header(elf.ELFDATA2LSB, elf.EM_RISCV),
+			METHOD_BCJ_RISCV, true},
+		{"big endian", header(elf.ELFDATA2MSB, elf.EM_AARCH64),
+			METHOD_BCJ_ARM64, true},
+		{"other machine", header(elf.ELFDATA2LSB, elf.EM_PPC64),
+			0, false},
+		{"short", header(elf.ELFDATA2LSB, elf.EM_X86_64)[:19], 0, false},
+		{"not elf", textData(20, 1), 0, false},
+	}
+
+	for _, tt := range tests {
+		info, ok := elfFilter(tt.header)
+		if ok != tt.ok || ok && MethodOf(info) != tt.method {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name,
+				CompressionName(info), ok, tt.method, tt.ok)
+		}
+	}
+}
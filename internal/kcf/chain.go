@@ -0,0 +1,204 @@
+package kcf
+
+import (
+	"io"
+	"strings"
+)
+
+// maxFilters limits the number of filters of a file, so that a file has
+// at most three coders together with its compression method.
+const maxFilters = 2
+
+// filtersVersion is the first format version with coder chains.
+const filtersVersion uint16 = 2
+
+// filtersAsRecord returns the coder chain record listing CompressionInfo
+// of filters applied to file data before its compression method.
+func filtersAsRecord(filters []uint32) (rec Record, err error) {
+	rec.HeadType = CODER_CHAIN
+	rec.Data = make([]byte, 0, 4*len(filters))
+	for _, info := range filters {
+		rec.Data = le.AppendUint32(rec.Data, info)
+	}
+
+	err = rec.Fix()
+	return
+}
+
+func recordToFilters(rec Record) (filters []uint32, err error) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != CODER_CHAIN {
+		err = InvalidFormat
+		return
+	}
+
+	n := len(rec.Data) / 4
+	if len(rec.Data)%4 != 0 || n == 0 || n > maxFilters {
+		err = CorruptedRecordData
+		return
+	}
+
+	filters = make([]uint32, n)
+	for i := range filters {
+		filters[i] = le.Uint32(rec.Data[4*i:])
+	}
+
+	return
+}
+
+// ParseCoderChain parses the description of a chain of coders joined
+// by '+', such as "delta:dist=4+lzma". Each coder is described as in
+// ParseCompression. The last coder is the compression method, the
+// preceding ones are filters applied to data before it.
+func ParseCoderChain(spec string) (
+	filters []uint32,
+	info uint32,
+	err error,
+) {
+	specs := strings.Split(spec, "+")
+	if len(specs) > maxFilters+1 {
+		err = InvalidCompressionParams
+		return
+	}
+
+	for _, s := range specs[:len(specs)-1] {
+		var filter uint32
+
+		filter, err = ParseCompression(s)
+		if err != nil {
+			return
+		}
+		if MethodOf(filter) == METHOD_STORED {
+			err = InvalidCompressionParams
+			return
+		}
+
+		filters = append(filters, filter)
+	}
+
+	info, err = ParseCompression(specs[len(specs)-1])
+	return
+}
+
+// CoderChainName returns the description of the chain of filters and
+// the compression method in the form accepted by ParseCoderChain.
+func CoderChainName(filters []uint32, info uint32) string {
+	var names []string
+	for _, filter := range filters {
+		names = append(names, CompressionName(filter))
+	}
+
+	return strings.Join(append(names, CompressionName(info)), "+")
+}
+
+// chainMemoryUsage returns the amount of memory needed to decode data
+// passed through filters and the compression method of info.
+func chainMemoryUsage(filters []uint32, info uint32) (
+	needed uint64,
+	err error,
+) {
+	coders := append(filters[:len(filters):len(filters)], info)
+	for _, coder := range coders {
+		if MethodOf(coder) == METHOD_STORED {
+			continue
+		}
+
+		var c codec
+		c, err = codecOf(coder)
+		if err != nil {
+			return
+		}
+
+		needed += c.memoryUsage(paramsOf(coder))
+	}
+
+	return
+}
+
+// chainWriter passes data through filters and the compression method
+// of a file. Its coders are listed from the first one data is written
+// to.
+type chainWriter struct {
+	coders []io.WriteCloser
+}
+
+// newChainWriter returns a writer which encodes data by filters and
+// then by the compression method of info into w.
+func newChainWriter(w io.Writer, filters []uint32, info uint32) (
+	io.WriteCloser,
+	error,
+) {
+	cw := &chainWriter{}
+
+	for i := len(filters); i >= 0; i-- {
+		coder := info
+		if i < len(filters) {
+			coder = filters[i]
+		} else if MethodOf(info) == METHOD_STORED {
+			continue
+		}
+
+		c, err := codecOf(coder)
+		if err != nil {
+			return nil, err
+		}
+
+		wc, err := c.newWriter(w, paramsOf(coder))
+		if err != nil {
+			return nil, err
+		}
+
+		cw.coders = append([]io.WriteCloser{wc}, cw.coders...)
+		w = wc
+	}
+
+	return cw, nil
+}
+
+func (cw *chainWriter) Write(p []byte) (int, error) {
+	return cw.coders[0].Write(p)
+}
+
+// Close flushes coders in order, so that each of them writes its last
+// data into the following one before it is closed.
+func (cw *chainWriter) Close() error {
+	for _, wc := range cw.coders {
+		if err := wc.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newChainReader returns a reader which decodes data read from r by the
+// compression method of info and then by filters in reverse order.
+func newChainReader(r io.Reader, filters []uint32, info uint32) (
+	io.Reader,
+	error,
+) {
+	for i := len(filters); i >= 0; i-- {
+		coder := info
+		if i < len(filters) {
+			coder = filters[i]
+		} else if MethodOf(info) == METHOD_STORED {
+			continue
+		}
+
+		c, err := codecOf(coder)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err = c.newReader(r, paramsOf(coder))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,364 @@
+package kcf
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Method is a compression method. It is stored in bits 0 to 7 of
+// CompressionInfo, bits 8 to 30 hold parameters of the method.
+type Method uint8
+
+const (
+	METHOD_STORED Method = 0x00
+	METHOD_LZ4    Method = 0x01
+	METHOD_LZMA   Method = 0x02
+	METHOD_PPMD   Method = 0x03
+
+	// Filters, which are meant to precede compression methods in coder
+	// chains.
+	METHOD_BCJ_X86   Method = 0x10
+	METHOD_BCJ_ARM64 Method = 0x11
+	METHOD_BCJ_RISCV Method = 0x12
+	METHOD_DELTA     Method = 0x13
+)
+
+const (
+	methodMask  = 0xFF
+	paramsShift = 8
+	paramsMask  = 0x7FFFFF
+)
+
+// MethodOf returns the compression method of CompressionInfo.
+func MethodOf(info uint32) Method {
+	return Method(info & methodMask)
+}
+
+// paramsOf returns parameters of the method of CompressionInfo.
+func paramsOf(info uint32) uint32 {
+	return (info >> paramsShift) & paramsMask
+}
+
+func compressionInfo(method Method, params uint32) uint32 {
+	return uint32(method) | (params&paramsMask)<<paramsShift
+}
+
+// codec compresses and decompresses file data of one method.
+type codec interface {
+	name() string
+
+	// parseParams parses comma-separated key=value pairs given
+	// after the method name. Zero params select defaults.
+	parseParams(args []string) (params uint32, err error)
+	formatParams(params uint32) string
+
+	// memoryUsage returns the approximate amount of memory needed to
+	// decompress data.
+	memoryUsage(params uint32) uint64
+
+	newWriter(w io.Writer, params uint32) (io.WriteCloser, error)
+	newReader(r io.Reader, params uint32) (io.Reader, error)
+}
+
+// blockCodec is a codec which compresses data in independent blocks.
+// Its writer cuts the fragment of the archive after each block.
+type blockCodec interface {
+	codec
+	blockSize(params uint32) int
+}
+
+var codecs = map[Method]codec{
+	METHOD_LZ4:  lz4Codec{},
+	METHOD_LZMA: lzmaCodec{},
+	METHOD_PPMD: ppmdCodec{},
+
+	METHOD_BCJ_X86:   bcjCodec{"x86", newBCJX86},
+	METHOD_BCJ_ARM64: bcjCodec{"arm64", newBCJARM64},
+	METHOD_BCJ_RISCV: bcjCodec{"riscv", newBCJRISCV},
+	METHOD_DELTA:     deltaCodec{},
+}
+
+// ParseCompression returns CompressionInfo for the description of the
+// method, such as "store", "lz4", "lz4:block=1M", "lzma:dict=64M" or
+// "ppmd:order=8".
+func ParseCompression(spec string) (info uint32, err error) {
+	name, args, _ := strings.Cut(spec, ":")
+	if name == "store" {
+		return compressionInfo(METHOD_STORED, 0), nil
+	}
+
+	for method, c := range codecs {
+		if c.name() != name {
+			continue
+		}
+
+		var params uint32
+		var list []string
+		if args != "" {
+			list = strings.Split(args, ",")
+		}
+
+		params, err = c.parseParams(list)
+		if err != nil {
+			return
+		}
+
+		return compressionInfo(method, params), nil
+	}
+
+	err = UnsupportedCompression
+	return
+}
+
+// CompressionName describes the method of CompressionInfo in the form
+// accepted by ParseCompression.
+func CompressionName(info uint32) string {
+	method := MethodOf(info)
+	if method == METHOD_STORED {
+		return "store"
+	}
+
+	c, ok := codecs[method]
+	if !ok {
+		return "method " + strconv.Itoa(int(method))
+	}
+
+	params := c.formatParams(paramsOf(info))
+	if params == "" {
+		return c.name()
+	}
+
+	return c.name() + ":" + params
+}
+
+func codecOf(info uint32) (c codec, err error) {
+	c, ok := codecs[MethodOf(info)]
+	if !ok {
+		err = UnsupportedCompression
+	}
+
+	return
+}
+
+// parseSize parses a size with an optional K, M or G suffix.
+func parseSize(s string) (size uint64, err error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+
+	size, err = strconv.ParseUint(s, 10, 64)
+	if err != nil || size > (1<<(64-shift))-1 {
+		return 0, InvalidCompressionParams
+	}
+
+	return size << shift, nil
+}
+
+// formatSize formats a size with the largest suffix dividing it.
+func formatSize(size uint64) string {
+	for _, unit := range []struct {
+		suffix string
+		shift  uint
+	}{{"G", 30}, {"M", 20}, {"K", 10}} {
+		if size >= 1<<unit.shift && size%(1<<unit.shift) == 0 {
+			return strconv.FormatUint(size>>unit.shift, 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatUint(size, 10)
+}
+
+// log2Size returns the binary logarithm of size, which must be a power
+// of two between 1<<min and 1<<max.
+func log2Size(size uint64, min, max uint) (log uint32, err error) {
+	for log = uint32(min); log <= uint32(max); log++ {
+		if size == 1<<log {
+			return
+		}
+	}
+
+	return 0, InvalidCompressionParams
+}
+
+// fragmentSize is the size of packed data stored in one record when
+// data of the file is split into fragments.
+const fragmentSize = 4 << 20
+
+// fragmentSink receives fragments of packed data of a file in order.
+// continued tells whether more fragments follow.
+type fragmentSink interface {
+	writeFragment(data []byte, continued bool) error
+}
+
+// fragmentWriter splits packed data written to it into fragments of at
+// most limit bytes and passes them to sink. Each fragment is passed
+// once it is known whether more data follow it.
+type fragmentWriter struct {
+	sink   fragmentSink
+	buf    []byte
+	limit  int
+	cut    bool
+	packed uint64
+}
+
+// newFragmentWriter returns a fragment writer for data packed by the
+// codec c with CompressionInfo info, nil c meaning no compression.
+func newFragmentWriter(sink fragmentSink, c codec, info uint32) (
+	fw *fragmentWriter,
+) {
+	fw = &fragmentWriter{sink: sink, limit: fragmentSize}
+	if bc, ok := c.(blockCodec); ok {
+		// A block with its size must fit into one fragment.
+		fw.limit = max(fw.limit, bc.blockSize(paramsOf(info))+4)
+	}
+
+	return
+}
+
+func (fw *fragmentWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(fw.buf) >= fw.limit || fw.cut {
+			err = fw.emit(true)
+			if err != nil {
+				return
+			}
+		}
+
+		chunk := p
+		if room := fw.limit - len(fw.buf); len(chunk) > room {
+			chunk = chunk[:room]
+		}
+
+		fw.buf = append(fw.buf, chunk...)
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return
+}
+
+// cutFragment ends the current fragment, so that data written next
+// starts a new one.
+func (fw *fragmentWriter) cutFragment() {
+	if len(fw.buf) > 0 {
+		fw.cut = true
+	}
+}
+
+func (fw *fragmentWriter) emit(continued bool) (err error) {
+	err = fw.sink.writeFragment(fw.buf, continued)
+	if err != nil {
+		return
+	}
+
+	fw.packed += uint64(len(fw.buf))
+	fw.buf = fw.buf[:0]
+	fw.cut = false
+
+	return
+}
+
+// Close passes the last fragment.
+func (fw *fragmentWriter) Close() error {
+	return fw.emit(false)
+}
+
+// recordSink writes fragments as the added data of the file header
+// record of kcf.currentFile, or of the head record if it is set,
+// followed by data fragment records.
+type recordSink struct {
+	kcf     *Kcf
+	head    RecordData
+	records int
+}
+
+func (rs *recordSink) writeFragment(data []byte, continued bool) (
+	err error,
+) {
+	var rec Record
+
+	if rs.records == 0 && rs.head != nil {
+		rec, err = rs.head.AsRecord()
+		if err != nil {
+			return
+		}
+	} else if rs.records == 0 {
+		rec, err = rs.kcf.currentFile.AsRecord()
+		if err != nil {
+			return
+		}
+	} else {
+		rec.HeadType = DATA_FRAGMENT
+	}
+
+	if continued {
+		rec.HeadFlags |= 0x01
+	}
+
+	err = rs.kcf.writeRecordData(rec, data)
+	if err != nil {
+		return
+	}
+
+	if rs.records == 0 && rs.head == nil {
+		rs.kcf.hdrOffset = rs.kcf.recOffset
+		rs.kcf.hdrRecord = rs.kcf.lastRecord
+	}
+
+	rs.records++
+	return
+}
+
+// fragmentReader reads packed data of the current file from the added
+// data of the file header record and subsequent data fragment records.
+type fragmentReader struct {
+	kcf *Kcf
+}
+
+func (fr *fragmentReader) Read(p []byte) (n int, err error) {
+	kcf := fr.kcf
+
+	for kcf.state.GetStage() != stageRecordAddedData {
+		if kcf.lastRecord.HeadFlags&0x01 == 0 {
+			return 0, io.EOF
+		}
+
+		err = fr.nextFragment()
+		if err != nil {
+			return
+		}
+	}
+
+	n, err = kcf.readAddedData(p)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (fr *fragmentReader) nextFragment() (err error) {
+	_, err = fr.kcf.readRecord()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+
+	if fr.kcf.lastRecord.HeadType != DATA_FRAGMENT {
+		err = InvalidFormat
+	}
+
+	return
+}
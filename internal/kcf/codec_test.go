@@ -0,0 +1,241 @@
+package kcf
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// randomData returns n bytes which do not compress.
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// textData returns n bytes of words picked at random from a small
+// vocabulary, which compress like text.
+func textData(n int, seed int64) []byte {
+	words := []string{"archive", "file", "record", "header", "data",
+		"the", "of", "a", "is", "packed", "block", "fragment", "\n"}
+	rnd := rand.New(rand.NewSource(seed))
+
+	data := make([]byte, 0, n+16)
+	for len(data) < n {
+		data = append(data, words[rnd.Intn(len(words))]...)
+		data = append(data, ' ')
+	}
+
+	return data[:n]
+}
+
+// codecRoundTrip compresses data by the method of info in writes of
+// varying sizes, decompresses it and compares the result with data.
+func codecRoundTrip(t *testing.T, info uint32, data []byte) {
+	t.Helper()
+
+	c, err := codecOf(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packed bytes.Buffer
+	w, err := c.newWriter(&packed, paramsOf(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, step := data, 1; len(p) > 0; step = (step*7 + 1) % 65537 {
+		n := min(len(p), step)
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.newReader(&packed, paramsOf(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(r, got); err != nil {
+		t.Fatalf("%s, %d bytes: %v", CompressionName(info), len(data),
+			err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%s, %d bytes: data differ", CompressionName(info),
+			len(data))
+	}
+}
+
+// filterRoundTrip encodes data by the filter of info in writes of
+// several sizes, checks that the results do not depend on how data is
+// split, and decodes them back through readers returning data in
+// pieces of several sizes. It returns the encoded data.
+func filterRoundTrip(t *testing.T, info uint32, data []byte) []byte {
+	t.Helper()
+
+	c, err := codecOf(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encoded []byte
+	for _, step := range []int{1, 3, 4093, filterChunkSize - 1,
+		filterChunkSize, len(data) + 1} {
+		var packed bytes.Buffer
+		w, err := c.newWriter(&packed, paramsOf(info))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for p := data; len(p) > 0; p = p[min(len(p), step):] {
+			if _, err = w.Write(p[:min(len(p), step)]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if encoded == nil {
+			encoded = packed.Bytes()
+		} else if !bytes.Equal(packed.Bytes(), encoded) {
+			t.Fatalf("%s: writes of %d bytes encode differently",
+				CompressionName(info), step)
+		}
+	}
+
+	readers := []func(io.Reader) io.Reader{
+		func(r io.Reader) io.Reader { return r },
+		iotest.OneByteReader,
+		iotest.HalfReader,
+		iotest.DataErrReader,
+	}
+	for i, wrap := range readers {
+		r, err := c.newReader(wrap(bytes.NewReader(encoded)),
+			paramsOf(info))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: data differ with reader %d",
+				CompressionName(info), i)
+		}
+	}
+
+	return encoded
+}
+
+// decodeStream decodes the packed stream by the method of info until
+// an error or the end of data.
+func decodeStream(info uint32, packed []byte) (data []byte, err error) {
+	c, err := codecOf(info)
+	if err != nil {
+		return
+	}
+
+	r, err := c.newReader(bytes.NewReader(packed), paramsOf(info))
+	if err != nil {
+		return
+	}
+
+	return io.ReadAll(r)
+}
+
+// packTestFile creates an archive at path holding one regular file
+// with data packed by the method of info after filters.
+func packTestFile(tb testing.TB, path string, info uint32,
+	filters []uint32, data []byte) {
+	tb.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		tb.Fatal(err)
+	}
+
+	var hdr FileHeader
+	hdr.FileName = "file"
+	hdr.FileType = REGULAR_FILE
+	hdr.CompressionInfo = info
+	hdr.Filters = filters
+	hdr.SetUnpackedSize(uint64(len(data)))
+
+	if err = kcf.PackFile(hdr, bytes.NewReader(data)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// unpackTestFile unpacks the first file of the archive at path into w.
+func unpackTestFile(tb testing.TB, path string, opts ReaderOptions,
+	w io.Writer) {
+	tb.Helper()
+
+	kcf, err := OpenArchive(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		tb.Fatal(err)
+	}
+	kcf.SetReaderOptions(opts)
+
+	if _, err = kcf.GetCurrentFile(); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err = kcf.UnpackFile(w); err != nil && err != io.EOF {
+		tb.Fatal(err)
+	}
+}
+
+const benchmarkSize = 4 << 20
+
+// nullWriter discards data like io.Discard, which files are not
+// decompressed into.
+type nullWriter struct{}
+
+func (nullWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func benchmarkPack(b *testing.B, info uint32) {
+	data := textData(benchmarkSize, 1)
+	path := filepath.Join(b.TempDir(), "bench.kcf")
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		packTestFile(b, path, info, nil, data)
+	}
+}
+
+func benchmarkUnpack(b *testing.B, info uint32) {
+	data := textData(benchmarkSize, 1)
+	path := filepath.Join(b.TempDir(), "bench.kcf")
+	packTestFile(b, path, info, nil, data)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		unpackTestFile(b, path, ReaderOptions{}, nullWriter{})
+	}
+}
@@ -0,0 +1,78 @@
+package kcf
+
+import "unicode/utf8"
+
+// commentAsRecord returns the comment record of the given type, which
+// is either ARCHIVE_COMMENT or FILE_COMMENT. If the comment does not
+// fit into the record, it is returned as its added data.
+func commentAsRecord(headType RecordType, comment string) (
+	rec Record,
+	data []byte,
+	err error,
+) {
+	if !utf8.ValidString(comment) {
+		err = InvalidComment
+		return
+	}
+
+	rec.HeadType = headType
+	rec.Data = []byte(comment)
+	err = rec.Fix()
+	if err == TooBigRecordData {
+		rec.Data = nil
+		data = []byte(comment)
+		err = rec.Fix()
+	}
+
+	return
+}
+
+func recordToComment(rec Record, data []byte) (comment string, err error) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != ARCHIVE_COMMENT && rec.HeadType != FILE_COMMENT {
+		err = InvalidFormat
+		return
+	}
+
+	if len(data) > 0 {
+		return string(data), nil
+	}
+
+	return string(rec.Data), nil
+}
+
+// Comment returns the archive comment. When reading, it is known once
+// the first file header has been read.
+func (kcf *Kcf) Comment() string {
+	return kcf.comment
+}
+
+// SetComment writes the archive comment. It should be called right
+// after InitArchive, since readers learn of the comment only when they
+// reach its record.
+func (kcf *Kcf) SetComment(comment string) (err error) {
+	if !kcf.state.IsWriting() ||
+		kcf.state.GetPackerPos() != pposFileHeader {
+		panic(InvalidState)
+	}
+
+	var rec Record
+	var data []byte
+
+	rec, data, err = commentAsRecord(ARCHIVE_COMMENT, comment)
+	if err != nil {
+		return
+	}
+
+	err = kcf.writeRecordData(rec, data)
+	if err != nil {
+		return
+	}
+
+	kcf.comment = comment
+	return
+}
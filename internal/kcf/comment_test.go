@@ -0,0 +1,123 @@
+package kcf
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommentRoundTrip(t *testing.T) {
+	long := strings.Repeat("Kommentár ", 10000)
+
+	tests := []struct {
+		name    string
+		comment string
+		added   bool
+	}{
+		{"none", "", false},
+		{"short", "Archive of ünïcode files\n", false},
+		{"long", long, true},
+	}
+
+	// Files are commented like the archive, except the first one.
+	dir := t.TempDir()
+	for _, tt := range tests {
+		_, data, err := commentAsRecord(FILE_COMMENT, tt.comment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(data) > 0) != tt.added {
+			t.Errorf("%s: %d bytes of added data", tt.name, len(data))
+		}
+
+		path := filepath.Join(dir, "test.kcf")
+		kcf, err := CreateNewArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		if tt.comment != "" {
+			if err = kcf.SetComment(tt.comment); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"plain", "commented"} {
+			var hdr FileHeader
+			hdr.FileName = name
+			hdr.FileType = REGULAR_FILE
+			if name == "commented" {
+				hdr.Comment = tt.comment
+			}
+			hdr.SetUnpackedSize(uint64(len(name)))
+			err = kcf.PackFile(hdr, strings.NewReader(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		kcf.Close()
+
+		kcf, err = OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{"", tt.comment} {
+			hdr, err := kcf.GetCurrentFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kcf.Comment() != tt.comment {
+				t.Errorf("%s: got archive comment of %d bytes, want %d",
+					tt.name, len(kcf.Comment()), len(tt.comment))
+			}
+			if hdr.Comment != want {
+				t.Errorf("%s: got comment of %d bytes for %s, want %d",
+					tt.name, len(hdr.Comment), hdr.FileName, len(want))
+			}
+
+			_, err = kcf.UnpackFile(io.Discard)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+		}
+		kcf.Close()
+	}
+}
+
+func TestInvalidComment(t *testing.T) {
+	tests := []string{"\xFF", "valid\xC3(", strings.Repeat("x", 70000) +
+		"\xFE"}
+
+	dir := t.TempDir()
+	for i, comment := range tests {
+		kcf, err := CreateNewArchive(filepath.Join(dir, "test.kcf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = kcf.SetComment(comment); err != InvalidComment {
+			t.Errorf("comment %d: got %v, want %v", i, err, InvalidComment)
+		}
+
+		var hdr FileHeader
+		hdr.FileName = "file"
+		hdr.FileType = REGULAR_FILE
+		hdr.Comment = comment
+		err = kcf.PackFile(hdr, strings.NewReader(""))
+		if err != InvalidComment {
+			t.Errorf("file comment %d: got %v, want %v", i, err,
+				InvalidComment)
+		}
+		kcf.Close()
+	}
+}
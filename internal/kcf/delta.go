@@ -0,0 +1,225 @@
+package kcf
+
+import (
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Delta stores each byte as the difference from the byte dist bytes
+// before it, bytes before the start of data being zero. It turns slowly
+// changing values of fixed-size records, such as PCM samples or pixels,
+// into runs of small numbers.
+//
+// Parameters:
+//   - bits 0 to 15: distance minus one, so that zero selects
+//     distance 1.
+type deltaCodec struct{}
+
+const deltaMaxDist = 1 << 16
+
+func (deltaCodec) name() string {
+	return "delta"
+}
+
+func (deltaCodec) parseParams(args []string) (params uint32, err error) {
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		if key != "dist" {
+			return 0, InvalidCompressionParams
+		}
+
+		var dist uint64
+		dist, err = strconv.ParseUint(value, 10, 32)
+		if err != nil || dist < 1 || dist > deltaMaxDist {
+			return 0, InvalidCompressionParams
+		}
+
+		params = uint32(dist - 1)
+	}
+
+	return
+}
+
+func (deltaCodec) formatParams(params uint32) string {
+	if params == 0 {
+		return ""
+	}
+
+	return "dist=" + strconv.FormatUint(uint64(params)+1, 10)
+}
+
+func (deltaCodec) memoryUsage(params uint32) uint64 {
+	return filterChunkSize + uint64(params) + 1
+}
+
+func (deltaCodec) newWriter(w io.Writer, params uint32) (
+	io.WriteCloser,
+	error,
+) {
+	if params >= deltaMaxDist {
+		return nil, InvalidCompressionParams
+	}
+
+	return &filterWriter{w: w, conv: newDelta(params+1, true)}, nil
+}
+
+func (deltaCodec) newReader(r io.Reader, params uint32) (io.Reader, error) {
+	if params >= deltaMaxDist {
+		return nil, InvalidCompressionParams
+	}
+
+	return &filterReader{r: r, conv: newDelta(params+1, false)}, nil
+}
+
+// delta converts data keeping the last dist bytes of the original data
+// in a ring buffer.
+type delta struct {
+	encode  bool
+	history []byte
+	i       int
+}
+
+func newDelta(dist uint32, encode bool) *delta {
+	return &delta{encode: encode, history: make([]byte, dist)}
+}
+
+func (d *delta) convert(buf []byte, pos uint32) int {
+	for k, b := range buf {
+		if d.encode {
+			buf[k] = b - d.history[d.i]
+		} else {
+			b += d.history[d.i]
+			buf[k] = b
+		}
+
+		d.history[d.i] = b
+		d.i++
+		if d.i == len(d.history) {
+			d.i = 0
+		}
+	}
+
+	return len(buf)
+}
+
+// Limits of the search for the distance of the delta filter.
+const (
+	autoDeltaSample  = 16 << 10
+	autoDeltaMaxDist = 256
+)
+
+// autoDelta returns the delta filter for the file if its data looks
+// like fixed-size records. The distance is taken from the header of WAV
+// files, otherwise it is the one which makes bytes of a sample from the
+// middle of the file most predictable, if it does so markedly.
+func autoDelta(file *os.File, size int64) (filters []uint32) {
+	sample := make([]byte, min(size, autoDeltaSample))
+	if len(sample) < 64 {
+		return
+	}
+
+	if _, err := file.ReadAt(sample[:min(len(sample), 512)], 0); err != nil {
+		return
+	}
+
+	dist := wavBlockAlign(sample[:min(len(sample), 512)])
+	if dist == 0 {
+		offset := (size - int64(len(sample))) / 2
+		if _, err := file.ReadAt(sample, offset); err != nil {
+			return
+		}
+
+		dist = deltaDistance(sample)
+	}
+
+	if dist > 0 {
+		filters = []uint32{compressionInfo(METHOD_DELTA, uint32(dist-1))}
+	}
+
+	return
+}
+
+// wavBlockAlign returns the size of sample frames of a PCM WAV file
+// with the header given, or zero for other files.
+func wavBlockAlign(header []byte) int {
+	if len(header) < 12 || string(header[:4]) != "RIFF" ||
+		string(header[8:12]) != "WAVE" {
+		return 0
+	}
+
+	for chunk := header[12:]; len(chunk) >= 8; {
+		size := le.Uint32(chunk[4:])
+		if string(chunk[:4]) == "fmt " {
+			if size < 16 || len(chunk) < 24 {
+				return 0
+			}
+
+			// Only PCM (1) and extensible (0xFFFE) formats
+			// hold raw samples.
+			format := le.Uint16(chunk[8:])
+			align := int(le.Uint16(chunk[20:]))
+			if (format != 1 && format != 0xFFFE) ||
+				align > autoDeltaMaxDist {
+				return 0
+			}
+
+			return align
+		}
+
+		if uint64(size)+8 > uint64(len(chunk)) {
+			break
+		}
+		chunk = chunk[8+(size+1)&^1:]
+	}
+
+	return 0
+}
+
+// deltaDistance returns the distance of the delta filter which lowers
+// the order-0 entropy of data most, or zero if no distance lowers it by
+// at least a tenth. A longer distance is preferred only if it gains
+// noticeably more, so that multiples of the record size are not taken.
+func deltaDistance(data []byte) (dist int) {
+	bestBits := entropyBits(data, 0)
+	threshold := bestBits * 0.9
+
+	for d := 1; d <= autoDeltaMaxDist && d < len(data)/4; d++ {
+		if bits := entropyBits(data, d); bits < bestBits*0.98 {
+			bestBits = bits
+			dist = d
+		}
+	}
+
+	if bestBits >= threshold {
+		dist = 0
+	}
+
+	return
+}
+
+// entropyBits returns the order-0 entropy in bits of data passed
+// through the delta filter of distance dist, or of data itself if dist
+// is zero.
+func entropyBits(data []byte, dist int) (bits float64) {
+	var counts [256]int
+
+	for i, b := range data {
+		if i >= dist && dist > 0 {
+			b -= data[i-dist]
+		}
+		counts[b]++
+	}
+
+	n := float64(len(data))
+	for _, count := range counts {
+		if count > 0 {
+			c := float64(count)
+			bits -= c * math.Log2(c/n)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,129 @@
+package kcf
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func deltaInfo(dist int) uint32 {
+	return compressionInfo(METHOD_DELTA, uint32(dist-1))
+}
+
+// recordData returns n bytes of records of size dist whose fields
+// change by small random steps from record to record.
+func recordData(n, dist int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+
+	data := make([]byte, n)
+	copy(data, randomData(dist, seed))
+	for i := dist; i < n; i++ {
+		data[i] = data[i-dist] + byte(rnd.Intn(5)-2)
+	}
+
+	return data
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	for dist := 1; dist <= autoDeltaMaxDist; dist++ {
+		// Data of some distances span several chunks of filters.
+		size := 4096 + 3*dist + 1
+		if dist%64 == 1 || dist == autoDeltaMaxDist {
+			size += 2 * filterChunkSize
+		}
+
+		data := recordData(size, dist, int64(dist))
+		encoded := filterRoundTrip(t, deltaInfo(dist), data)
+
+		// Bytes before the start of data are zero.
+		if !bytes.Equal(encoded[:dist], data[:dist]) {
+			t.Fatalf("distance %d: first record is changed", dist)
+		}
+		for i := dist; i < len(data); i += 997 {
+			if encoded[i] != data[i]-data[i-dist] {
+				t.Fatalf("distance %d: byte %d is % X, want % X",
+					dist, i, encoded[i], data[i]-data[i-dist])
+			}
+		}
+	}
+
+	for _, dist := range []int{1000, deltaMaxDist} {
+		filterRoundTrip(t, deltaInfo(dist), randomData(3*dist+7, 1))
+	}
+}
+
+func TestDeltaDistance(t *testing.T) {
+	for _, dist := range []int{1, 2, 3, 4, 6, 8, 12, 16, 24, 32, 64,
+		100, 128} {
+		data := recordData(autoDeltaSample, dist, int64(dist))
+		if got := deltaDistance(data); got != dist {
+			t.Errorf("records of %d bytes: got distance %d", dist, got)
+		}
+	}
+
+	for _, data := range [][]byte{randomData(autoDeltaSample, 1),
+		textData(autoDeltaSample, 2)} {
+		if got := deltaDistance(data); got != 0 {
+			t.Errorf("got distance %d for data without records", got)
+		}
+	}
+}
+
+// wavHeader returns the header of a WAV file with the format and size
+// of sample frames given.
+func wavHeader(format uint16, align int) []byte {
+	h := []byte("RIFF\x00\x00\x00\x00WAVE")
+	h = append(h, "LIST\x03\x00\x00\x00abc\x00"...)
+	h = append(h, "fmt \x10\x00\x00\x00"...)
+	h = le.AppendUint16(h, format)
+	h = le.AppendUint16(h, uint16(align/2))
+	h = le.AppendUint32(h, 44100)
+	h = le.AppendUint32(h, 44100*uint32(align))
+	h = le.AppendUint16(h, uint16(align))
+	h = le.AppendUint16(h, 16)
+	return append(h, "data\x00\x00\x00\x00"...)
+}
+
+func TestAutoDelta(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		dist int
+	}{
+		{"wav", append(wavHeader(1, 4), randomData(20000, 1)...), 4},
+		{"extensible wav",
+			append(wavHeader(0xFFFE, 6), randomData(20000, 1)...), 6},
+		{"compressed wav",
+			append(wavHeader(2, 4), randomData(20000, 1)...), 0},
+		{"records", recordData(100000, 12, 1), 12},
+		{"random", randomData(100000, 2), 0},
+		{"small", recordData(63, 1, 1), 0},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "file")
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filters := autoDelta(file, int64(len(tt.data)))
+		file.Close()
+
+		var want []uint32
+		if tt.dist > 0 {
+			want = []uint32{deltaInfo(tt.dist)}
+		}
+		if len(filters) != len(want) ||
+			len(want) > 0 && filters[0] != want[0] {
+			t.Errorf("%s: got %v, want %v", tt.name,
+				CoderChainName(filters, 0), CoderChainName(want, 0))
+		}
+	}
+}
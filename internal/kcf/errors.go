@@ -1,12 +1,77 @@
 package kcf
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+)
 
 var InvalidFormat = errors.New("kcf: invalid archive format")
 var CorruptedRecordData = errors.New("kcf: invalid record data")
 var TooBigFileName = errors.New("record: too big file name, " +
 	"more than 65535 bytes")
 var TooBigRecordData = errors.New("record: too big record data")
+var InvalidExtra = errors.New("record: extended header keys and " +
+	"values must be non-empty UTF-8 strings")
+var InvalidComment = errors.New("record: comment must be a UTF-8 string")
 
 var InvalidState = errors.New("kcf: invalid state")
 var InvalidAddedData = errors.New("kcf: invalid added data")
+var UnsupportedChecksum = errors.New("kcf: unsupported checksum algorithm")
+var UnsupportedCompression = errors.New("kcf: unsupported compression method")
+var InvalidCompressionParams = errors.New("kcf: invalid parameters of " +
+	"compression method")
+var UnsupportedFeature = errors.New("kcf: feature is not supported by " +
+	"the archive format version")
+
+// XattrError records an extended attribute which could not be set.
+type XattrError struct {
+	Path string
+	Name string
+	Err  error
+}
+
+func (e *XattrError) Error() string {
+	return "kcf: cannot set " + e.Name + " of " + e.Path + ": " +
+		e.Err.Error()
+}
+
+func (e *XattrError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownRecordError reports a mandatory record of unknown type. The
+// archive needs a newer version of the reader.
+type UnknownRecordError struct {
+	Type RecordType
+}
+
+func (e *UnknownRecordError) Error() string {
+	return "kcf: unsupported mandatory record of type 0x" +
+		strconv.FormatUint(uint64(e.Type), 16)
+}
+
+// ErrUnsupportedVersion reports an archive format version the package
+// cannot read or write. Supported is the latest supported version.
+type ErrUnsupportedVersion struct {
+	Found     uint16
+	Supported uint16
+}
+
+func (e *ErrUnsupportedVersion) Error() string {
+	return "kcf: unsupported format version " +
+		strconv.FormatUint(uint64(e.Found), 10) + ", supported up to " +
+		strconv.FormatUint(uint64(e.Supported), 10)
+}
+
+// MemoryLimitError reports a file whose decompression needs more memory
+// than allowed by ReaderOptions.
+type MemoryLimitError struct {
+	Needed uint64
+	Limit  uint64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return "kcf: decompression needs " +
+		strconv.FormatUint(e.Needed, 10) + " bytes of memory, limit is " +
+		strconv.FormatUint(e.Limit, 10)
+}
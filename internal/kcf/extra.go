@@ -0,0 +1,110 @@
+package kcf
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// Extra holds key/value metadata in the manner of PAX extended headers.
+// Keys and values are UTF-8 strings. The archiver attaches no meaning
+// to the keys, so readers must ignore keys they do not know. Keys of
+// third-party tools should be prefixed with the tool name and a dot.
+type Extra map[string]string
+
+// AsRecord returns the extended header record of the given type, which
+// is either EXTENDED_HEADER or GLOBAL_HEADER. Pairs are sorted by key.
+// If they do not fit into the record, they are returned as its added
+// data.
+func (extra Extra) AsRecord(headType RecordType) (
+	rec Record,
+	data []byte,
+	err error,
+) {
+	rec.HeadType = headType
+
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	list := make([]byte, 0)
+	for _, key := range keys {
+		value := extra[key]
+
+		if key == "" || !utf8.ValidString(key) || !utf8.ValidString(value) {
+			err = InvalidExtra
+			return
+		}
+
+		if len(key) > 0xFFFF || uint64(len(value)) > 0xFFFFFFFF {
+			err = TooBigRecordData
+			return
+		}
+
+		list = le.AppendUint16(list, uint16(len(key)))
+		list = append(list, key...)
+		list = le.AppendUint32(list, uint32(len(value)))
+		list = append(list, value...)
+	}
+
+	rec.Data = list
+	err = rec.Fix()
+	if err == TooBigRecordData {
+		rec.Data = nil
+		data = list
+		err = rec.Fix()
+	}
+
+	return
+}
+
+func RecordToExtra(rec Record, data []byte) (
+	extra Extra,
+	err error,
+) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != EXTENDED_HEADER && rec.HeadType != GLOBAL_HEADER {
+		err = InvalidFormat
+		return
+	}
+
+	list := rec.Data
+	if len(data) > 0 {
+		list = data
+	}
+
+	extra = make(Extra)
+	for ptr := 0; ptr < len(list); {
+		if len(list) < ptr+2 {
+			err = CorruptedRecordData
+			return
+		}
+
+		keySize := int(le.Uint16(list[ptr:]))
+		ptr += 2
+		if len(list) < ptr+keySize+4 {
+			err = CorruptedRecordData
+			return
+		}
+
+		key := string(list[ptr : ptr+keySize])
+		ptr += keySize
+
+		valueSize := uint64(le.Uint32(list[ptr:]))
+		ptr += 4
+		if uint64(len(list)-ptr) < valueSize {
+			err = CorruptedRecordData
+			return
+		}
+
+		extra[key] = string(list[ptr : ptr+int(valueSize)])
+		ptr += int(valueSize)
+	}
+
+	return
+}
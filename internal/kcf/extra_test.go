@@ -0,0 +1,193 @@
+package kcf
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtraRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra Extra
+		added bool
+	}{
+		{"none", nil, false},
+		{"pairs", Extra{"path": "ünïcode/path", "tool.key": "",
+			"mtime": "1704164645.000000678"}, false},
+		{"large", Extra{"tool.large": strings.Repeat("x", 70000),
+			"tool.small": "y"}, true},
+	}
+
+	var hdrs []FileHeader
+	for _, tt := range tests {
+		rec, data, err := tt.extra.AsRecord(EXTENDED_HEADER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(data) > 0) != tt.added {
+			t.Errorf("%s: %d bytes of added data", tt.name, len(data))
+		}
+
+		// Lists cut short are refused.
+		list := rec.Data
+		if tt.added {
+			list = data
+		}
+		for _, n := range []int{1, len(list) - 1} {
+			if n < 1 || n >= len(list) {
+				continue
+			}
+			short := Record{HeadType: EXTENDED_HEADER}
+			short.Data = list[:n]
+			short.Fix()
+
+			_, err = RecordToExtra(short, nil)
+			if err != CorruptedRecordData {
+				t.Errorf("%s: list of %d bytes: got %v", tt.name, n, err)
+			}
+		}
+
+		hdrs = append(hdrs, FileHeader{
+			FileName: tt.name,
+			FileType: REGULAR_FILE,
+			Extra:    tt.extra,
+		})
+	}
+
+	got := packHeaders(t, filepath.Join(t.TempDir(), "test.kcf"), hdrs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d files, want %d", len(got), len(tests))
+	}
+
+	for i, tt := range tests {
+		if !maps.Equal(got[i].Extra, tt.extra) {
+			t.Errorf("%s: got %v, want %v", tt.name, got[i].Extra,
+				tt.extra)
+		}
+	}
+}
+
+func TestInvalidExtra(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra Extra
+	}{
+		{"empty key", Extra{"": "value"}},
+		{"invalid key", Extra{"key\xFF": "value"}},
+		{"invalid value", Extra{"key": "\xC3("}},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		_, _, err := tt.extra.AsRecord(EXTENDED_HEADER)
+		if err != InvalidExtra {
+			t.Errorf("%s: got %v, want %v", tt.name, err, InvalidExtra)
+		}
+
+		kcf, err := CreateNewArchive(filepath.Join(dir, "test.kcf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = kcf.SetGlobalExtra(tt.extra); err != InvalidExtra {
+			t.Errorf("%s: global header: got %v, want %v", tt.name, err,
+				InvalidExtra)
+		}
+
+		var hdr FileHeader
+		hdr.FileName = tt.name
+		hdr.FileType = REGULAR_FILE
+		hdr.Extra = tt.extra
+		err = kcf.PackFile(hdr, bytes.NewReader(nil))
+		if err != InvalidExtra {
+			t.Errorf("%s: file: got %v, want %v", tt.name, err,
+				InvalidExtra)
+		}
+		kcf.Close()
+	}
+}
+
+func TestGlobalExtra(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.kcf")
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second header overrides a key of the first and the third
+	// one, written between files, is seen only from the second file on.
+	globals := []Extra{
+		{"tool.a": "1", "tool.b": "2"},
+		{"tool.b": "3", "tool.c": "4"},
+		{"tool.d": "5"},
+	}
+	for _, extra := range globals[:2] {
+		if err = kcf.SetGlobalExtra(extra); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := Extra{"tool.a": "1", "tool.b": "3", "tool.c": "4"}
+	if got := kcf.GlobalExtra(); !maps.Equal(got, first) {
+		t.Errorf("writer: got %v, want %v", got, first)
+	}
+
+	for i, name := range []string{"first", "second"} {
+		if i == 1 {
+			if err = kcf.SetGlobalExtra(globals[2]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var hdr FileHeader
+		hdr.FileName = name
+		hdr.FileType = REGULAR_FILE
+		hdr.Extra = Extra{"tool.b": name}
+		if err = kcf.PackFile(hdr, bytes.NewReader(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kcf.Close()
+
+	second := maps.Clone(first)
+	second["tool.d"] = "5"
+
+	kcf, err = OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []Extra{first, second} {
+		hdr, err := kcf.GetCurrentFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Pairs of the file do not mix with global ones.
+		if got := kcf.GlobalExtra(); !maps.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", hdr.FileName, got, want)
+		}
+		if hdr.Extra["tool.b"] != hdr.FileName || len(hdr.Extra) != 1 {
+			t.Errorf("%s: got file pairs %v", hdr.FileName, hdr.Extra)
+		}
+
+		_, err = kcf.UnpackFile(io.Discard)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package kcf
+
+import "io"
+
+// filterChunkSize is the amount of data filters convert at once.
+const filterChunkSize = 64 << 10
+
+// converter converts data of a filter in place. buf starts at position
+// pos of the stream. convert returns the number of converted bytes, the
+// remaining ones need following data to be converted. At the end of the
+// stream they are left as they are.
+type converter interface {
+	convert(buf []byte, pos uint32) int
+}
+
+// filterWriter writes data converted by conv to w. Filters keep the
+// size of data, so they need no end marker.
+type filterWriter struct {
+	w    io.Writer
+	conv converter
+	buf  []byte
+	pos  uint32
+}
+
+func (fw *filterWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		k := min(len(p)-n, filterChunkSize)
+		fw.buf = append(fw.buf, p[n:n+k]...)
+		n += k
+
+		done := fw.conv.convert(fw.buf, fw.pos)
+		_, err = fw.w.Write(fw.buf[:done])
+		if err != nil {
+			return
+		}
+
+		fw.pos += uint32(done)
+		fw.buf = fw.buf[:copy(fw.buf, fw.buf[done:])]
+	}
+
+	return
+}
+
+// Close writes the rest of data which cannot be converted.
+func (fw *filterWriter) Close() (err error) {
+	_, err = fw.w.Write(fw.buf)
+	fw.buf = fw.buf[:0]
+	return
+}
+
+// filterReader reads data from r and converts it by conv. Bytes of
+// buf[start:done] are converted, bytes of buf[done:end] wait for more
+// data.
+type filterReader struct {
+	r    io.Reader
+	conv converter
+	buf  []byte
+	pos  uint32
+	err  error
+
+	start, done, end int
+}
+
+func (fr *filterReader) Read(p []byte) (n int, err error) {
+	for fr.start == fr.done {
+		if fr.err != nil {
+			if fr.done == fr.end {
+				return 0, fr.err
+			}
+
+			fr.done = fr.end
+			break
+		}
+
+		if fr.buf == nil {
+			fr.buf = make([]byte, filterChunkSize)
+		}
+
+		fr.end = copy(fr.buf, fr.buf[fr.done:fr.end])
+		fr.start, fr.done = 0, 0
+
+		var k int
+		k, fr.err = fr.r.Read(fr.buf[fr.end:])
+		fr.end += k
+
+		fr.done = fr.conv.convert(fr.buf[:fr.end], fr.pos)
+		fr.pos += uint32(fr.done)
+	}
+
+	n = copy(p, fr.buf[fr.start:fr.done])
+	fr.start += n
+	return
+}
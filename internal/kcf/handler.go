@@ -0,0 +1,65 @@
+package kcf
+
+import "sync"
+
+// RecordHandler parses a record of a registered type which precedes
+// the file header. data is the added data of the record, if any. The
+// handler may store what it has parsed into fhdr.
+type RecordHandler func(fhdr *FileHeader, rec Record, data []byte) error
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[RecordType]RecordHandler)
+)
+
+// IsSkippable reports whether readers which do not know records of
+// the type may skip them. Types of such records are lowercase ASCII
+// letters, that is, they have bit 0x20 set.
+func (t RecordType) IsSkippable() bool {
+	return t&0x20 != 0
+}
+
+// isBuiltinRecord reports whether records of the type are parsed by
+// the package itself.
+func isBuiltinRecord(t RecordType) bool {
+	switch t {
+	case MARKER, ARCHIVE_HEADER, FILE_HEADER, DATA_FRAGMENT,
+		LONG_NAME, FILE_METADATA, SPARSE_MAP, XATTRS,
+		EXTENDED_HEADER, GLOBAL_HEADER, ARCHIVE_COMMENT, FILE_COMMENT,
+		CODER_CHAIN, SOLID_BLOCK:
+		return true
+	}
+
+	return false
+}
+
+// RegisterRecordHandler makes records of the type known to readers.
+// Such records are passed to fn and copied by CopyFileRaw as they are.
+// It panics if the type is used by the package or already registered.
+func RegisterRecordHandler(t RecordType, fn RecordHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if fn == nil {
+		panic("kcf: RegisterRecordHandler with nil handler")
+	}
+
+	if isBuiltinRecord(t) {
+		panic("kcf: RegisterRecordHandler for built-in type " +
+			string(rune(t)))
+	}
+
+	if _, dup := handlers[t]; dup {
+		panic("kcf: RegisterRecordHandler called twice for type " +
+			string(rune(t)))
+	}
+
+	handlers[t] = fn
+}
+
+func recordHandler(t RecordType) RecordHandler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	return handlers[t]
+}
@@ -0,0 +1,180 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// packRecord creates an archive at path holding files first and second
+// with the record and its added data written before the second file.
+func packRecord(t *testing.T, path string, rec Record, data []byte) {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if name == "second" {
+			if err = rec.Fix(); err != nil {
+				t.Fatal(err)
+			}
+
+			kcf.state.SetPackerPos(pposFileMetadata)
+			if err = kcf.writeRecordData(rec, data); err != nil {
+				t.Fatal(err)
+			}
+			kcf.state.SetPackerPos(pposFileHeader)
+		}
+
+		var hdr FileHeader
+		hdr.FileName = name
+		hdr.FileType = REGULAR_FILE
+		hdr.SetUnpackedSize(uint64(len(name)))
+		err = kcf.PackFile(hdr, strings.NewReader(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Records of the type y are stored as the file comment, so tests can
+// tell whether they have been parsed. Handlers cannot be unregistered,
+// so it is done once for all runs of the tests.
+func init() {
+	RegisterRecordHandler('y', func(fhdr *FileHeader, rec Record,
+		data []byte) error {
+		fhdr.Comment = string(rec.Data) + string(data)
+		return nil
+	})
+}
+
+func TestIsSkippable(t *testing.T) {
+	tests := []struct {
+		t    RecordType
+		want bool
+	}{
+		{'a', true},
+		{'z', true},
+		{XATTRS, true},
+		{FILE_COMMENT, true},
+		{'A', false},
+		{'Z', false},
+		{FILE_HEADER, false},
+		{LONG_NAME, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.t.IsSkippable(); got != tt.want {
+			t.Errorf("type %q: got %v, want %v", rune(tt.t), got, tt.want)
+		}
+	}
+}
+
+func TestUnknownRecord(t *testing.T) {
+	added := bytes.Repeat([]byte("x"), 1000)
+
+	tests := []struct {
+		name    string
+		rec     Record
+		data    []byte
+		err     error
+		comment string
+	}{
+		{"skippable", Record{HeadType: 'q', Data: []byte("data")}, nil,
+			nil, ""},
+		{"skippable with added data", Record{HeadType: 'q'}, added, nil,
+			""},
+		{"mandatory", Record{HeadType: 'Q', Data: []byte("data")}, nil,
+			&UnknownRecordError{Type: 'Q'}, ""},
+		{"mandatory with added data", Record{HeadType: 'Q'}, added,
+			&UnknownRecordError{Type: 'Q'}, ""},
+		{"registered", Record{HeadType: 'y', Data: []byte("data")},
+			[]byte("added"), nil, "dataadded"},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "test.kcf")
+		packRecord(t, path, tt.rec, tt.data)
+
+		kcf, err := OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		var hdr FileHeader
+		for _, name := range []string{"first", "second"} {
+			hdr, err = kcf.GetCurrentFile()
+			if err != nil {
+				break
+			}
+			if hdr.FileName != name {
+				t.Errorf("%s: got file %s, want %s", tt.name,
+					hdr.FileName, name)
+			}
+
+			var data bytes.Buffer
+			_, err = kcf.UnpackFile(&data)
+			if err != nil && err != io.EOF {
+				break
+			}
+			err = nil
+			if data.String() != name {
+				t.Errorf("%s: data of %s differ", tt.name, name)
+			}
+		}
+		kcf.Close()
+
+		var unknown *UnknownRecordError
+		if tt.err == nil && err != nil ||
+			tt.err != nil && (!errors.As(err, &unknown) ||
+				*unknown != *tt.err.(*UnknownRecordError)) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && hdr.Comment != tt.comment {
+			t.Errorf("%s: handler got %q, want %q", tt.name, hdr.Comment,
+				tt.comment)
+		}
+	}
+}
+
+func TestRegisterRecordHandler(t *testing.T) {
+	handler := func(*FileHeader, Record, []byte) error { return nil }
+
+	tests := []struct {
+		name string
+		t    RecordType
+		fn   RecordHandler
+	}{
+		{"built-in", FILE_HEADER, handler},
+		{"built-in skippable", XATTRS, handler},
+		{"nil handler", 'w', nil},
+		{"registered twice", 'y', handler},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", tt.name)
+				}
+			}()
+
+			RegisterRecordHandler(tt.t, tt.fn)
+		}()
+	}
+}
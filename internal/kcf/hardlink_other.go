@@ -0,0 +1,11 @@
+//go:build !unix
+
+package kcf
+
+import "os"
+
+// inodeOf returns the device and inode numbers of the file. They are
+// not available on this system, so ok is always false.
+func inodeOf(info os.FileInfo) (id inodeID, ok bool) {
+	return
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package kcf
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the device and inode numbers of the file. If the file
+// has only one link, ok is false.
+func inodeOf(info os.FileInfo) (id inodeID, ok bool) {
+	st, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat || st.Nlink < 2 {
+		return
+	}
+
+	id.dev = uint64(st.Dev)
+	id.ino = uint64(st.Ino)
+	ok = true
+
+	return
+}
@@ -0,0 +1,398 @@
+package kcf
+
+import (
+	"io"
+	"strings"
+)
+
+// LZ4 compresses data in independent blocks using the LZ4 block format.
+// Each block is preceded by 4 bytes holding the size of its packed
+// data. If bit 31 of the size is set, the block is stored as is.
+//
+// Parameters:
+//   - bits 0 to 4: binary logarithm of the block size, from 16 to 26.
+//     Zero selects blocks of 4 MiB.
+type lz4Codec struct{}
+
+const (
+	lz4DefaultBlockLog = 22
+	lz4MinBlockLog     = 16
+	lz4MaxBlockLog     = 26
+
+	lz4Stored = 1 << 31
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+func (lz4Codec) name() string {
+	return "lz4"
+}
+
+func (lz4Codec) parseParams(args []string) (params uint32, err error) {
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		if key != "block" {
+			return 0, InvalidCompressionParams
+		}
+
+		var size uint64
+		size, err = parseSize(value)
+		if err != nil {
+			return
+		}
+
+		params, err = log2Size(size, lz4MinBlockLog, lz4MaxBlockLog)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c lz4Codec) formatParams(params uint32) string {
+	if params == 0 {
+		return ""
+	}
+
+	return "block=" + formatSize(uint64(c.blockSize(params)))
+}
+
+func (lz4Codec) blockSize(params uint32) int {
+	log := params & 0x1F
+	if log == 0 {
+		log = lz4DefaultBlockLog
+	}
+
+	return 1 << log
+}
+
+func (c lz4Codec) memoryUsage(params uint32) uint64 {
+	return 2 * uint64(c.blockSize(params))
+}
+
+func (c lz4Codec) newWriter(w io.Writer, params uint32) (
+	io.WriteCloser,
+	error,
+) {
+	size := c.blockSize(params)
+	if size > 1<<lz4MaxBlockLog {
+		return nil, InvalidCompressionParams
+	}
+
+	return &lz4Writer{
+		w:     w,
+		block: make([]byte, 0, size),
+		table: new([1 << lz4HashLog]int32),
+	}, nil
+}
+
+func (c lz4Codec) newReader(r io.Reader, params uint32) (io.Reader, error) {
+	size := c.blockSize(params)
+	if size > 1<<lz4MaxBlockLog {
+		return nil, InvalidCompressionParams
+	}
+
+	return &lz4Reader{r: r, size: size}, nil
+}
+
+type lz4Writer struct {
+	w     io.Writer
+	block []byte
+	out   []byte
+	table *[1 << lz4HashLog]int32
+}
+
+func (lw *lz4Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if room := cap(lw.block) - len(lw.block); len(chunk) > room {
+			chunk = chunk[:room]
+		}
+
+		lw.block = append(lw.block, chunk...)
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		if len(lw.block) == cap(lw.block) {
+			err = lw.flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (lw *lz4Writer) flush() (err error) {
+	if len(lw.block) == 0 {
+		return
+	}
+
+	lw.out = append(lw.out[:0], 0, 0, 0, 0)
+	lw.out = lz4CompressBlock(lw.out, lw.block, lw.table)
+
+	size := uint32(len(lw.out) - 4)
+	if len(lw.out)-4 >= len(lw.block) {
+		lw.out = append(lw.out[:4], lw.block...)
+		size = uint32(len(lw.block)) | lz4Stored
+	}
+	le.PutUint32(lw.out, size)
+
+	_, err = lw.w.Write(lw.out)
+	if err != nil {
+		return
+	}
+
+	// Blocks do not depend on each other, so each one gets its own
+	// fragment and can be unpacked on its own.
+	if fw, ok := lw.w.(interface{ cutFragment() }); ok {
+		fw.cutFragment()
+	}
+
+	lw.block = lw.block[:0]
+	return
+}
+
+func (lw *lz4Writer) Close() error {
+	return lw.flush()
+}
+
+// lz4Hash returns the hash table slot of 4 bytes at the start of p.
+func lz4Hash(p []byte) uint32 {
+	return (le.Uint32(p) * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4CompressBlock appends src compressed in the LZ4 block format to
+// dst. It finds matches greedily using a hash table of recent
+// positions, which is cleared before use.
+func lz4CompressBlock(dst, src []byte, table *[1 << lz4HashLog]int32) []byte {
+	clear(table[:])
+
+	anchor := 0
+	if len(src) > lz4MFLimit {
+		limit := len(src) - lz4MFLimit
+		matchLimit := len(src) - lz4LastLiterals
+
+		for i := 0; i < limit; {
+			h := lz4Hash(src[i:])
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+
+			if ref < 0 || i-ref > lz4MaxOffset ||
+				le.Uint32(src[ref:]) != le.Uint32(src[i:]) {
+				// Skip faster through data without matches.
+				i += 1 + (i-anchor)>>6
+				continue
+			}
+
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+			}
+
+			length := lz4MinMatch
+			for i+length < matchLimit && src[i+length] == src[ref+length] {
+				length++
+			}
+
+			dst = lz4AppendSequence(dst, src[anchor:i], i-ref, length)
+			i += length
+			anchor = i
+
+			if i-2 < limit {
+				table[lz4Hash(src[i-2:])] = int32(i - 2 + 1)
+			}
+		}
+	}
+
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match. The last
+// sequence of a block has no match, which is denoted by zero length.
+func lz4AppendSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-lz4MinMatch, 15))
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+
+	if length == 0 {
+		return dst
+	}
+
+	dst = le.AppendUint16(dst, uint16(offset))
+	if length-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, length-lz4MinMatch-15)
+	}
+
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock appends data decompressed from src to dst. The
+// result may not grow beyond cap(dst).
+func lz4DecompressBlock(dst, src []byte) ([]byte, error) {
+	limit := cap(dst)
+
+	for ip := 0; ip < len(src); {
+		token := src[ip]
+		ip++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var ok bool
+			literals, ip, ok = lz4ReadLength(src, ip, literals)
+			if !ok {
+				return dst, InvalidAddedData
+			}
+		}
+
+		if literals > len(src)-ip || literals > limit-len(dst) {
+			return dst, InvalidAddedData
+		}
+		dst = append(dst, src[ip:ip+literals]...)
+		ip += literals
+
+		if ip == len(src) {
+			break
+		}
+
+		if len(src)-ip < 2 {
+			return dst, InvalidAddedData
+		}
+		offset := int(le.Uint16(src[ip:]))
+		ip += 2
+
+		length := int(token & 15)
+		if length == 15 {
+			var ok bool
+			length, ip, ok = lz4ReadLength(src, ip, length)
+			if !ok {
+				return dst, InvalidAddedData
+			}
+		}
+		length += lz4MinMatch
+
+		if offset == 0 || offset > len(dst) || length > limit-len(dst) {
+			return dst, InvalidAddedData
+		}
+
+		// Overlapping matches repeat the last offset bytes, so they
+		// are copied in pieces no longer than the offset.
+		for length > 0 {
+			n := min(offset, length)
+			start := len(dst) - offset
+			dst = append(dst, dst[start:start+n]...)
+			length -= n
+		}
+	}
+
+	return dst, nil
+}
+
+func lz4ReadLength(src []byte, ip, n int) (int, int, bool) {
+	for {
+		if ip >= len(src) || n > 1<<30 {
+			return n, ip, false
+		}
+
+		b := src[ip]
+		ip++
+		n += int(b)
+		if b != 255 {
+			return n, ip, true
+		}
+	}
+}
+
+type lz4Reader struct {
+	r     io.Reader
+	size  int
+	in    []byte
+	block []byte
+	pos   int
+}
+
+func (lr *lz4Reader) Read(p []byte) (n int, err error) {
+	if lr.pos == len(lr.block) {
+		err = lr.readBlock()
+		if err != nil {
+			return
+		}
+	}
+
+	n = copy(p, lr.block[lr.pos:])
+	lr.pos += n
+	return
+}
+
+func (lr *lz4Reader) readBlock() (err error) {
+	var header [4]byte
+
+	_, err = io.ReadFull(lr.r, header[:])
+	if err == io.ErrUnexpectedEOF {
+		err = InvalidAddedData
+	}
+	if err != nil {
+		return
+	}
+
+	size := le.Uint32(header[:])
+	stored := size&lz4Stored != 0
+	size &^= lz4Stored
+	if size == 0 || size > uint32(lr.size) {
+		return InvalidAddedData
+	}
+
+	if lr.block == nil {
+		lr.block = make([]byte, 0, lr.size)
+	}
+
+	buf := lr.block[:size]
+	if !stored {
+		if cap(lr.in) < int(size) {
+			lr.in = make([]byte, size)
+		}
+		lr.in = lr.in[:size]
+		buf = lr.in
+	}
+
+	_, err = io.ReadFull(lr.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = InvalidAddedData
+	}
+	if err != nil {
+		return
+	}
+
+	if stored {
+		lr.block = buf
+	} else {
+		lr.block, err = lz4DecompressBlock(lr.block[:0], lr.in)
+		if err != nil {
+			return
+		}
+	}
+
+	lr.pos = 0
+	return
+}
@@ -0,0 +1,55 @@
+package kcf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	// Blocks of 64 KiB, the smallest ones.
+	info := compressionInfo(METHOD_LZ4, lz4MinBlockLog)
+	block := 1 << lz4MinBlockLog
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{42}},
+		{"random", randomData(3*block+17, 1)},
+		{"zeros", make([]byte, 3*block)},
+		{"repeated", bytes.Repeat([]byte("abc"), block)},
+		{"text", textData(2*block, 2)},
+		{"block", textData(block, 3)},
+		{"block and a byte", textData(block+1, 4)},
+		{"random block", randomData(block, 5)},
+		{"random block and a byte", randomData(block+1, 6)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codecRoundTrip(t, info, tt.data)
+		})
+	}
+}
+
+func TestLZ4DefaultBlock(t *testing.T) {
+	codecRoundTrip(t, compressionInfo(METHOD_LZ4, 0),
+		textData(1<<lz4DefaultBlockLog+1, 1))
+}
+
+func BenchmarkStoredPack(b *testing.B) {
+	benchmarkPack(b, compressionInfo(METHOD_STORED, 0))
+}
+
+func BenchmarkStoredUnpack(b *testing.B) {
+	benchmarkUnpack(b, compressionInfo(METHOD_STORED, 0))
+}
+
+func BenchmarkLZ4Pack(b *testing.B) {
+	benchmarkPack(b, compressionInfo(METHOD_LZ4, 0))
+}
+
+func BenchmarkLZ4Unpack(b *testing.B) {
+	benchmarkUnpack(b, compressionInfo(METHOD_LZ4, 0))
+}
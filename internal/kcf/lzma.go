@@ -0,0 +1,590 @@
+package kcf
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// LZMA compresses data with the LZMA algorithm of 7-Zip. Packed data is
+// a raw LZMA stream, that is, the range coder data without the header
+// of .lzma files, terminated by the end marker.
+//
+// Parameters:
+//   - bits 0 to 4: binary logarithm of the dictionary size, from 12
+//     to 30;
+//   - bits 5 to 8: number of literal context bits lc, up to 8;
+//   - bits 9 to 11: number of literal position bits lp, up to 4;
+//   - bits 12 to 14: number of position bits pb, up to 4.
+//
+// Zero parameters select a dictionary of 8 MiB, lc=3, lp=0 and pb=2.
+type lzmaCodec struct{}
+
+type lzmaParams struct {
+	dictLog uint32
+	lc      uint32
+	lp      uint32
+	pb      uint32
+}
+
+const (
+	lzmaDefaultParams = 23 | 3<<5 | 0<<9 | 2<<12
+
+	lzmaMinDictLog = 12
+	lzmaMaxDictLog = 30
+)
+
+func (lzmaCodec) name() string {
+	return "lzma"
+}
+
+func unpackLzmaParams(params uint32) (lp lzmaParams, err error) {
+	if params == 0 {
+		params = lzmaDefaultParams
+	}
+
+	lp.dictLog = params & 0x1F
+	lp.lc = (params >> 5) & 0xF
+	lp.lp = (params >> 9) & 0x7
+	lp.pb = (params >> 12) & 0x7
+
+	if lp.dictLog < lzmaMinDictLog || lp.dictLog > lzmaMaxDictLog ||
+		lp.lc > 8 || lp.lp > 4 || lp.pb > 4 {
+		err = InvalidCompressionParams
+	}
+
+	return
+}
+
+func (lp lzmaParams) pack() uint32 {
+	return lp.dictLog | lp.lc<<5 | lp.lp<<9 | lp.pb<<12
+}
+
+func (lzmaCodec) parseParams(args []string) (params uint32, err error) {
+	lp, _ := unpackLzmaParams(0)
+
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+
+		if key == "dict" {
+			var size uint64
+			size, err = parseSize(value)
+			if err != nil {
+				return
+			}
+
+			lp.dictLog, err = log2Size(size, lzmaMinDictLog, lzmaMaxDictLog)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		var field *uint32
+		var limit uint64
+		switch key {
+		case "lc":
+			field, limit = &lp.lc, 8
+		case "lp":
+			field, limit = &lp.lp, 4
+		case "pb":
+			field, limit = &lp.pb, 4
+		default:
+			return 0, InvalidCompressionParams
+		}
+
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 8)
+		if err != nil || n > limit {
+			return 0, InvalidCompressionParams
+		}
+		*field = uint32(n)
+	}
+
+	params = lp.pack()
+	if params == lzmaDefaultParams {
+		params = 0
+	}
+
+	return
+}
+
+func (lzmaCodec) formatParams(params uint32) string {
+	if params == 0 {
+		return ""
+	}
+
+	lp, err := unpackLzmaParams(params)
+	if err != nil {
+		return "invalid"
+	}
+
+	return "dict=" + formatSize(1<<lp.dictLog) +
+		",lc=" + strconv.Itoa(int(lp.lc)) +
+		",lp=" + strconv.Itoa(int(lp.lp)) +
+		",pb=" + strconv.Itoa(int(lp.pb))
+}
+
+func (lzmaCodec) memoryUsage(params uint32) uint64 {
+	lp, err := unpackLzmaParams(params)
+	if err != nil {
+		return 0
+	}
+
+	return 1<<lp.dictLog + 0x300*2<<(lp.lc+lp.lp)
+}
+
+func (lzmaCodec) newWriter(w io.Writer, params uint32) (
+	io.WriteCloser,
+	error,
+) {
+	lp, err := unpackLzmaParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLzmaEncoder(w, lp), nil
+}
+
+func (lzmaCodec) newReader(r io.Reader, params uint32) (io.Reader, error) {
+	lp, err := unpackLzmaParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLzmaDecoder(r, lp), nil
+}
+
+const (
+	lzmaNumStates   = 12
+	lzmaPosBitsMax  = 4
+	lzmaMatchMinLen = 2
+	lzmaMatchMaxLen = 273
+
+	lzmaLenLowBits  = 3
+	lzmaLenMidBits  = 3
+	lzmaLenHighBits = 8
+	lzmaLenLowSyms  = 1 << lzmaLenLowBits
+	lzmaLenMidSyms  = 1 << lzmaLenMidBits
+
+	lzmaNumLenToPosStates = 4
+	lzmaPosSlotBits       = 6
+	lzmaStartPosModel     = 4
+	lzmaEndPosModel       = 14
+	lzmaNumFullDistances  = 1 << (lzmaEndPosModel >> 1)
+	lzmaAlignBits         = 4
+	lzmaAlignSize         = 1 << lzmaAlignBits
+
+	lzmaProbBits = 11
+	lzmaProbInit = 1 << (lzmaProbBits - 1)
+	lzmaMoveBits = 5
+
+	lzmaEndMarker = 0xFFFFFFFF
+)
+
+type lzmaProb uint16
+
+type lzmaLenProbs struct {
+	choice  lzmaProb
+	choice2 lzmaProb
+	low     [1 << lzmaPosBitsMax][lzmaLenLowSyms]lzmaProb
+	mid     [1 << lzmaPosBitsMax][lzmaLenMidSyms]lzmaProb
+	high    [1 << lzmaLenHighBits]lzmaProb
+}
+
+// lzmaModel holds probabilities of the LZMA model and its state, which
+// are the same for the encoder and the decoder.
+type lzmaModel struct {
+	literal     []lzmaProb
+	isMatch     [lzmaNumStates][1 << lzmaPosBitsMax]lzmaProb
+	isRep       [lzmaNumStates]lzmaProb
+	isRepG0     [lzmaNumStates]lzmaProb
+	isRepG1     [lzmaNumStates]lzmaProb
+	isRepG2     [lzmaNumStates]lzmaProb
+	isRep0Long  [lzmaNumStates][1 << lzmaPosBitsMax]lzmaProb
+	posSlot     [lzmaNumLenToPosStates][1 << lzmaPosSlotBits]lzmaProb
+	posSpecial  [1 + lzmaNumFullDistances - lzmaEndPosModel]lzmaProb
+	align       [lzmaAlignSize]lzmaProb
+	lenProbs    lzmaLenProbs
+	repLenProbs lzmaLenProbs
+
+	params lzmaParams
+	state  uint32
+	reps   [4]uint32
+}
+
+func (m *lzmaModel) init(params lzmaParams) {
+	m.params = params
+	m.literal = make([]lzmaProb, 0x300<<(params.lc+params.lp))
+
+	fill := func(probs []lzmaProb) {
+		for i := range probs {
+			probs[i] = lzmaProbInit
+		}
+	}
+
+	fill(m.literal)
+	for s := 0; s < lzmaNumStates; s++ {
+		fill(m.isMatch[s][:])
+		fill(m.isRep0Long[s][:])
+	}
+	fill(m.isRep[:])
+	fill(m.isRepG0[:])
+	fill(m.isRepG1[:])
+	fill(m.isRepG2[:])
+	for i := range m.posSlot {
+		fill(m.posSlot[i][:])
+	}
+	fill(m.posSpecial[:])
+	fill(m.align[:])
+
+	for _, lp := range []*lzmaLenProbs{&m.lenProbs, &m.repLenProbs} {
+		lp.choice = lzmaProbInit
+		lp.choice2 = lzmaProbInit
+		for i := range lp.low {
+			fill(lp.low[i][:])
+			fill(lp.mid[i][:])
+		}
+		fill(lp.high[:])
+	}
+}
+
+// literalProbs returns probabilities of the literal at the position
+// following prevByte.
+func (m *lzmaModel) literalProbs(pos uint64, prevByte byte) []lzmaProb {
+	lc, lp := m.params.lc, m.params.lp
+	litState := (uint32(pos)&(1<<lp-1))<<lc + uint32(prevByte)>>(8-lc)
+	return m.literal[0x300*litState : 0x300*(litState+1)]
+}
+
+func lzmaLiteralNext(state uint32) uint32 {
+	switch {
+	case state < 4:
+		return 0
+	case state < 10:
+		return state - 3
+	}
+
+	return state - 6
+}
+
+func lzmaMatchNext(state uint32) uint32 {
+	if state < 7 {
+		return 7
+	}
+
+	return 10
+}
+
+func lzmaRepNext(state uint32) uint32 {
+	if state < 7 {
+		return 8
+	}
+
+	return 11
+}
+
+func lzmaShortRepNext(state uint32) uint32 {
+	if state < 7 {
+		return 9
+	}
+
+	return 11
+}
+
+func lzmaLenToPosState(length uint32) uint32 {
+	return min(length-lzmaMatchMinLen, lzmaNumLenToPosStates-1)
+}
+
+// lzmaPosSlot returns the slot of the distance, which consists of two
+// top bits of the distance and their position.
+func lzmaPosSlot(dist uint32) uint32 {
+	if dist < lzmaStartPosModel {
+		return dist
+	}
+
+	n := uint32(bits.Len32(dist)) - 1
+	return n<<1 | (dist>>(n-1))&1
+}
+
+func (rd *rangeDecoder) bit(prob *lzmaProb) uint32 {
+	bound := (rd.rng >> lzmaProbBits) * uint32(*prob)
+	var bit uint32
+
+	if rd.code < bound {
+		rd.rng = bound
+		*prob += (1<<lzmaProbBits - *prob) >> lzmaMoveBits
+	} else {
+		rd.code -= bound
+		rd.rng -= bound
+		*prob -= *prob >> lzmaMoveBits
+		bit = 1
+	}
+
+	rd.normalize()
+	return bit
+}
+
+func (rd *rangeDecoder) directBits(n uint32) (result uint32) {
+	for ; n > 0; n-- {
+		rd.rng >>= 1
+		bit := uint32(0)
+		if rd.code >= rd.rng {
+			rd.code -= rd.rng
+			bit = 1
+		}
+		result = result<<1 | bit
+		rd.normalize()
+	}
+
+	return
+}
+
+func (rd *rangeDecoder) bitTree(probs []lzmaProb, n uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < n; i++ {
+		m = m<<1 | rd.bit(&probs[m])
+	}
+
+	return m - 1<<n
+}
+
+// reverseBitTree decodes n bits starting from the least significant
+// one. probs[offset+m] is the probability for the tree node m.
+func (rd *rangeDecoder) reverseBitTree(probs []lzmaProb, offset int,
+	n uint32) (result uint32) {
+	m := 1
+	for i := uint32(0); i < n; i++ {
+		bit := rd.bit(&probs[offset+m])
+		m = m<<1 | int(bit)
+		result |= bit << i
+	}
+
+	return
+}
+
+func (rd *rangeDecoder) length(lp *lzmaLenProbs, posState uint32) uint32 {
+	if rd.bit(&lp.choice) == 0 {
+		return rd.bitTree(lp.low[posState][:], lzmaLenLowBits)
+	}
+
+	if rd.bit(&lp.choice2) == 0 {
+		return lzmaLenLowSyms + rd.bitTree(lp.mid[posState][:], lzmaLenMidBits)
+	}
+
+	return lzmaLenLowSyms + lzmaLenMidSyms +
+		rd.bitTree(lp.high[:], lzmaLenHighBits)
+}
+
+// lzmaDecoder unpacks a raw LZMA stream. Unpacked data are kept in the
+// dictionary, which is a ring buffer growing up to the dictionary size.
+type lzmaDecoder struct {
+	lzmaModel
+	rd rangeDecoder
+
+	dict     []byte
+	dictSize int
+	pos      int
+	total    uint64
+	unread   int
+	eos      bool
+	started  bool
+}
+
+func newLzmaDecoder(r io.Reader, params lzmaParams) *lzmaDecoder {
+	d := &lzmaDecoder{dictSize: 1 << params.dictLog}
+	d.init(params)
+
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d.rd.r = br
+
+	return d
+}
+
+func (d *lzmaDecoder) put(b byte) {
+	if len(d.dict) < d.dictSize {
+		// Grow the dictionary as needed, but not beyond its size.
+		if len(d.dict) == cap(d.dict) {
+			size := min(max(2*cap(d.dict), 64<<10), d.dictSize)
+			d.dict = append(make([]byte, 0, size), d.dict...)
+		}
+		d.dict = append(d.dict, b)
+		d.pos = len(d.dict) % d.dictSize
+	} else {
+		d.dict[d.pos] = b
+		d.pos++
+		if d.pos == d.dictSize {
+			d.pos = 0
+		}
+	}
+
+	d.total++
+	d.unread++
+}
+
+// get returns the byte dist+1 bytes back.
+func (d *lzmaDecoder) get(dist uint32) byte {
+	i := d.pos - int(dist) - 1
+	if i < 0 {
+		i += len(d.dict)
+	}
+
+	return d.dict[i]
+}
+
+func (d *lzmaDecoder) Read(p []byte) (n int, err error) {
+	if !d.started {
+		d.rd.init()
+		d.started = true
+	}
+
+	for d.unread < len(p) && !d.eos && d.rd.err == nil &&
+		d.unread+lzmaMatchMaxLen <= d.dictSize {
+		err = d.decodeSymbol()
+		if err != nil {
+			return
+		}
+	}
+
+	if d.rd.err != nil {
+		return 0, d.rd.err
+	}
+
+	if d.unread == 0 && d.eos {
+		return 0, io.EOF
+	}
+
+	// Unread data end at d.pos and may wrap around the ring buffer.
+	start := d.pos - d.unread
+	if start < 0 {
+		start += len(d.dict)
+		n = copy(p, d.dict[start:])
+		start = 0
+	}
+	end := start + min(d.unread-n, len(p)-n)
+	n += copy(p[n:], d.dict[start:end])
+	d.unread -= n
+
+	return
+}
+
+func (d *lzmaDecoder) decodeSymbol() (err error) {
+	rd := &d.rd
+	posState := uint32(d.total) & (1<<d.params.pb - 1)
+	state := d.state
+
+	if rd.bit(&d.isMatch[state][posState]) == 0 {
+		var prevByte byte
+		if d.total > 0 {
+			prevByte = d.get(0)
+		}
+		probs := d.literalProbs(d.total, prevByte)
+
+		symbol := uint32(1)
+		if state < 7 {
+			for symbol < 0x100 {
+				symbol = symbol<<1 | rd.bit(&probs[symbol])
+			}
+		} else {
+			matchByte := uint32(d.get(d.reps[0]))
+			offs := uint32(0x100)
+			for symbol < 0x100 {
+				matchByte <<= 1
+				matchBit := matchByte & offs
+				bit := rd.bit(&probs[offs+matchBit+symbol])
+				symbol = symbol<<1 | bit
+				if bit == 0 {
+					offs &^= matchBit
+				} else {
+					offs &= matchBit
+				}
+			}
+		}
+
+		d.put(byte(symbol))
+		d.state = lzmaLiteralNext(state)
+		return
+	}
+
+	var length uint32
+	if rd.bit(&d.isRep[state]) != 0 {
+		if d.total == 0 {
+			return InvalidAddedData
+		}
+
+		if rd.bit(&d.isRepG0[state]) == 0 {
+			if rd.bit(&d.isRep0Long[state][posState]) == 0 {
+				d.state = lzmaShortRepNext(state)
+				d.put(d.get(d.reps[0]))
+				return
+			}
+		} else {
+			var dist uint32
+			if rd.bit(&d.isRepG1[state]) == 0 {
+				dist = d.reps[1]
+			} else {
+				if rd.bit(&d.isRepG2[state]) == 0 {
+					dist = d.reps[2]
+				} else {
+					dist = d.reps[3]
+					d.reps[3] = d.reps[2]
+				}
+				d.reps[2] = d.reps[1]
+			}
+			d.reps[1] = d.reps[0]
+			d.reps[0] = dist
+		}
+
+		length = rd.length(&d.repLenProbs, posState)
+		d.state = lzmaRepNext(state)
+	} else {
+		d.reps[3] = d.reps[2]
+		d.reps[2] = d.reps[1]
+		d.reps[1] = d.reps[0]
+
+		length = rd.length(&d.lenProbs, posState)
+		d.state = lzmaMatchNext(state)
+
+		dist := d.decodeDistance(length + lzmaMatchMinLen)
+		if dist == lzmaEndMarker {
+			d.eos = true
+			return
+		}
+		d.reps[0] = dist
+	}
+
+	if uint64(d.reps[0]) >= d.total || int(d.reps[0]) >= d.dictSize {
+		return InvalidAddedData
+	}
+
+	for i := uint32(0); i < length+lzmaMatchMinLen; i++ {
+		d.put(d.get(d.reps[0]))
+	}
+
+	return
+}
+
+func (d *lzmaDecoder) decodeDistance(length uint32) uint32 {
+	rd := &d.rd
+
+	slot := rd.bitTree(d.posSlot[lzmaLenToPosState(length)][:],
+		lzmaPosSlotBits)
+	if slot < lzmaStartPosModel {
+		return slot
+	}
+
+	n := slot>>1 - 1
+	dist := (2 | slot&1) << n
+	if slot < lzmaEndPosModel {
+		return dist + rd.reverseBitTree(d.posSpecial[:],
+			int(dist)-int(slot)-1, n)
+	}
+
+	dist += rd.directBits(n-lzmaAlignBits) << lzmaAlignBits
+	return dist + rd.reverseBitTree(d.align[:], -1, lzmaAlignBits)
+}
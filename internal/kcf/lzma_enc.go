@@ -0,0 +1,894 @@
+package kcf
+
+import (
+	"io"
+	"math"
+	"math/bits"
+)
+
+const (
+	// lzmaNumOpts is the number of positions the optimal parser looks
+	// ahead to choose the cheapest sequence of literals and matches.
+	lzmaNumOpts = 1 << 12
+
+	// Matches at least lzmaNiceLen bytes long are taken at once.
+	lzmaNiceLen = 64
+
+	// lzmaDepth limits the number of positions checked in a tree of
+	// the match finder.
+	lzmaDepth = 48
+
+	lzmaHash3Bits = 16
+
+	// lzmaLookahead is the amount of input needed to encode a position
+	// before all input is known.
+	lzmaLookahead = lzmaNumOpts + lzmaMatchMaxLen + 1
+
+	lzmaChunkSize   = 1 << 20
+	lzmaOutputLimit = 1 << 16
+
+	lzmaPriceShift    = 4
+	lzmaInfinityPrice = 1 << 30
+	lzmaDistRefresh   = 128
+	lzmaAlignRefresh  = lzmaAlignSize
+)
+
+// lzmaProbPrices holds prices of bits in 1/16 of a bit, indexed by the
+// probability of the bit shifted right by 4.
+var lzmaProbPrices = func() (prices [1 << (lzmaProbBits - 4)]uint32) {
+	for i := range prices {
+		p := (float64(i)*16 + 8) / (1 << lzmaProbBits)
+		prices[i] = uint32(math.Round(-math.Log2(p) * (1 << lzmaPriceShift)))
+	}
+
+	return
+}()
+
+func lzmaBitPrice(prob lzmaProb, bit uint32) uint32 {
+	if bit == 0 {
+		return lzmaProbPrices[prob>>4]
+	}
+
+	return lzmaProbPrices[(1<<lzmaProbBits-prob)>>4]
+}
+
+func lzmaBitTreePrice(probs []lzmaProb, n, symbol uint32) (price uint32) {
+	symbol |= 1 << n
+	for symbol > 1 {
+		price += lzmaBitPrice(probs[symbol>>1], symbol&1)
+		symbol >>= 1
+	}
+
+	return
+}
+
+func lzmaReverseBitTreePrice(probs []lzmaProb, offset int, n,
+	symbol uint32) (price uint32) {
+	m := 1
+	for i := uint32(0); i < n; i++ {
+		bit := symbol & 1
+		symbol >>= 1
+		price += lzmaBitPrice(probs[offset+m], bit)
+		m = m<<1 | int(bit)
+	}
+
+	return
+}
+
+func lzmaLenPrice(lp *lzmaLenProbs, symbol, posState uint32) uint32 {
+	if symbol < lzmaLenLowSyms {
+		return lzmaBitPrice(lp.choice, 0) +
+			lzmaBitTreePrice(lp.low[posState][:], lzmaLenLowBits, symbol)
+	}
+
+	price := lzmaBitPrice(lp.choice, 1)
+	symbol -= lzmaLenLowSyms
+	if symbol < lzmaLenMidSyms {
+		return price + lzmaBitPrice(lp.choice2, 0) +
+			lzmaBitTreePrice(lp.mid[posState][:], lzmaLenMidBits, symbol)
+	}
+
+	return price + lzmaBitPrice(lp.choice2, 1) +
+		lzmaBitTreePrice(lp.high[:], lzmaLenHighBits, symbol-lzmaLenMidSyms)
+}
+
+func (re *rangeEncoder) bit(prob *lzmaProb, bit uint32) {
+	bound := (re.rng >> lzmaProbBits) * uint32(*prob)
+
+	if bit == 0 {
+		re.rng = bound
+		*prob += (1<<lzmaProbBits - *prob) >> lzmaMoveBits
+	} else {
+		re.low += uint64(bound)
+		re.rng -= bound
+		*prob -= *prob >> lzmaMoveBits
+	}
+
+	for re.rng < rangeTopValue {
+		re.rng <<= 8
+		re.shiftLow()
+	}
+}
+
+func (re *rangeEncoder) directBits(value, n uint32) {
+	for n > 0 {
+		n--
+		re.rng >>= 1
+		if (value>>n)&1 != 0 {
+			re.low += uint64(re.rng)
+		}
+
+		for re.rng < rangeTopValue {
+			re.rng <<= 8
+			re.shiftLow()
+		}
+	}
+}
+
+func (re *rangeEncoder) bitTree(probs []lzmaProb, n, symbol uint32) {
+	m := uint32(1)
+	for n > 0 {
+		n--
+		bit := (symbol >> n) & 1
+		re.bit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (re *rangeEncoder) reverseBitTree(probs []lzmaProb, offset int,
+	n, symbol uint32) {
+	m := 1
+	for i := uint32(0); i < n; i++ {
+		bit := symbol & 1
+		symbol >>= 1
+		re.bit(&probs[offset+m], bit)
+		m = m<<1 | int(bit)
+	}
+}
+
+func (re *rangeEncoder) length(lp *lzmaLenProbs, symbol, posState uint32) {
+	if symbol < lzmaLenLowSyms {
+		re.bit(&lp.choice, 0)
+		re.bitTree(lp.low[posState][:], lzmaLenLowBits, symbol)
+		return
+	}
+
+	re.bit(&lp.choice, 1)
+	symbol -= lzmaLenLowSyms
+	if symbol < lzmaLenMidSyms {
+		re.bit(&lp.choice2, 0)
+		re.bitTree(lp.mid[posState][:], lzmaLenMidBits, symbol)
+		return
+	}
+
+	re.bit(&lp.choice2, 1)
+	re.bitTree(lp.high[:], lzmaLenHighBits, symbol-lzmaLenMidSyms)
+}
+
+type lzmaMatch struct {
+	length int
+	dist   uint32
+}
+
+// lzmaOpt is a node of the optimal parser: the cheapest known way to
+// reach a position from the start of the step. back is -1 for a
+// literal, a rep index below 4 and the distance plus 4 for a match.
+type lzmaOpt struct {
+	price  uint32
+	prev   int
+	back   int
+	length int
+	state  uint32
+	reps   [4]uint32
+}
+
+// lzmaLenPriceTable caches prices of lengths per position state. A
+// table is recomputed after it has been used for as many lengths as it
+// holds, so that prices follow the adapting probabilities.
+type lzmaLenPriceTable struct {
+	prices  [1 << lzmaPosBitsMax][lzmaMatchMaxLen - lzmaMatchMinLen + 1]uint32
+	counter [1 << lzmaPosBitsMax]int
+}
+
+func (t *lzmaLenPriceTable) update(lp *lzmaLenProbs, posState uint32) {
+	for i := range t.prices[posState] {
+		t.prices[posState][i] = lzmaLenPrice(lp, uint32(i), posState)
+	}
+	t.counter[posState] = len(t.prices[posState])
+}
+
+// lzmaEncoder packs data into a raw LZMA stream. Input is kept in buf,
+// which holds up to the dictionary size of already encoded data for
+// matches and the lookahead. Positions of buf are stored plus one in
+// tables of the match finder, so that zero means none.
+type lzmaEncoder struct {
+	lzmaModel
+	re  rangeEncoder
+	w   io.Writer
+	err error
+
+	dictSize int
+	buf      []byte
+	pos      int
+	base     uint64
+
+	hashBits uint32
+	head3    []int32
+	head     []int32
+	son      []int32
+	matches  []lzmaMatch
+
+	opts []lzmaOpt
+	end  int
+	path []int
+
+	lenPrices     lzmaLenPriceTable
+	repLenPrices  lzmaLenPriceTable
+	posSlotPrices [lzmaNumLenToPosStates][1 << lzmaPosSlotBits]uint32
+	distPrices    [lzmaNumLenToPosStates][lzmaNumFullDistances]uint32
+	alignPrices   [lzmaAlignSize]uint32
+	matchCount    int
+	alignCount    int
+}
+
+func newLzmaEncoder(w io.Writer, params lzmaParams) *lzmaEncoder {
+	e := &lzmaEncoder{
+		w:        w,
+		dictSize: 1 << params.dictLog,
+		opts:     make([]lzmaOpt, lzmaNumOpts),
+	}
+
+	e.init(params)
+	e.re.init()
+
+	for posState := uint32(0); posState < 1<<params.pb; posState++ {
+		e.lenPrices.update(&e.lenProbs, posState)
+		e.repLenPrices.update(&e.repLenProbs, posState)
+	}
+	e.updateDistPrices()
+	e.updateAlignPrices()
+
+	return e
+}
+
+func (e *lzmaEncoder) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && e.err == nil {
+		chunk := p[:min(len(p), lzmaChunkSize)]
+
+		e.buf = append(e.buf, chunk...)
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		e.encode(false)
+	}
+
+	return n, e.err
+}
+
+// Close encodes the rest of input followed by the end marker.
+func (e *lzmaEncoder) Close() error {
+	e.encode(true)
+	if e.err != nil {
+		return e.err
+	}
+
+	e.encodeMatch(lzmaEndMarker, lzmaMatchMinLen, e.pos)
+	e.re.flush()
+	e.writeOutput()
+
+	return e.err
+}
+
+func (e *lzmaEncoder) writeOutput() {
+	if e.err == nil && len(e.re.out) > 0 {
+		_, e.err = e.w.Write(e.re.out)
+		e.re.out = e.re.out[:0]
+	}
+}
+
+// encode encodes input while enough of it is buffered, or all of it if
+// final is set.
+func (e *lzmaEncoder) encode(final bool) {
+	if len(e.buf)-e.pos < lzmaLookahead && !final {
+		return
+	}
+
+	e.growTables()
+
+	for e.err == nil {
+		avail := len(e.buf) - e.pos
+		if avail == 0 || (!final && avail < lzmaLookahead) {
+			break
+		}
+
+		e.step()
+
+		if len(e.re.out) >= lzmaOutputLimit {
+			e.writeOutput()
+		}
+	}
+
+	if e.pos > 2*e.dictSize {
+		e.slide()
+	}
+}
+
+// growTables allocates tables of the match finder for buffered input,
+// so that small files do not need tables for the whole dictionary.
+func (e *lzmaEncoder) growTables() {
+	if e.head == nil {
+		e.hashBits = min(max(uint32(bits.Len(uint(len(e.buf)))), 10),
+			max(e.params.dictLog-4, 16), 20)
+		e.head3 = make([]int32, 1<<min(e.hashBits, lzmaHash3Bits))
+		e.head = make([]int32, 1<<e.hashBits)
+	}
+
+	nodes := int(min(e.base+uint64(len(e.buf)), uint64(e.dictSize)+1))
+	if len(e.son) < 2*nodes {
+		e.son = append(e.son, make([]int32, 2*nodes-len(e.son))...)
+	}
+}
+
+// slide drops data older than the dictionary from buf.
+func (e *lzmaEncoder) slide() {
+	delta := e.pos - e.dictSize
+
+	e.buf = e.buf[:copy(e.buf, e.buf[delta:])]
+	e.pos -= delta
+	e.base += uint64(delta)
+
+	rebase := func(list []int32) {
+		for i, v := range list {
+			list[i] = max(v-int32(delta), 0)
+		}
+	}
+	rebase(e.head3)
+	rebase(e.head)
+	rebase(e.son)
+}
+
+func (e *lzmaEncoder) hash(p int) uint32 {
+	return (le.Uint32(e.buf[p:]) * 2654435761) >> (32 - e.hashBits)
+}
+
+func (e *lzmaEncoder) hash3(p int) uint32 {
+	v := uint32(e.buf[p]) | uint32(e.buf[p+1])<<8 | uint32(e.buf[p+2])<<16
+	return (v * 2654435761) >> (32 - min(e.hashBits, lzmaHash3Bits))
+}
+
+// node returns the index of the tree node of the position in son.
+func (e *lzmaEncoder) node(p int) int {
+	return 2 * int((e.base+uint64(p))%(uint64(e.dictSize)+1))
+}
+
+// findMatches returns matches at the position in the order of growing
+// length and distance, and inserts the position into the match finder.
+func (e *lzmaEncoder) findMatches(p int) []lzmaMatch {
+	e.matches = e.matches[:0]
+	e.search(p, true)
+
+	// The tree keeps matches no longer than lzmaNiceLen, so the longest
+	// one may continue.
+	maxLen := min(len(e.buf)-p, lzmaMatchMaxLen)
+	if n := len(e.matches); n > 0 && e.matches[n-1].length == lzmaNiceLen {
+		m := &e.matches[n-1]
+		start := p - int(m.dist) - 1
+		m.length = lzmaMatchLen(e.buf[start:], e.buf[p:], maxLen)
+	}
+
+	return e.matches
+}
+
+func (e *lzmaEncoder) skip(p, n int) {
+	for i := 0; i < n; i++ {
+		e.search(p+i, false)
+	}
+}
+
+// search inserts the position into the binary tree of positions with
+// the same hash of four bytes, which is sorted by data following the
+// positions. On the way down it finds matches, which are recorded if
+// record is set. Matches of three bytes are looked up only at the last
+// position with the same hash of three bytes. son holds the left and
+// the right child of each position, plus one, and covers the
+// dictionary as a ring.
+func (e *lzmaEncoder) search(p int, record bool) {
+	avail := len(e.buf) - p
+	if avail < 4 {
+		return
+	}
+
+	best := lzmaMatchMinLen
+
+	h3 := e.hash3(p)
+	cand3 := int(e.head3[h3]) - 1
+	e.head3[h3] = int32(p + 1)
+	if record && cand3 >= 0 && p-cand3 <= e.dictSize {
+		n := lzmaMatchLen(e.buf[cand3:], e.buf[p:], min(avail, lzmaNiceLen))
+		if n > best {
+			best = n
+			e.matches = append(e.matches,
+				lzmaMatch{length: n, dist: uint32(p - cand3 - 1)})
+		}
+	}
+
+	h := e.hash(p)
+	cur := int(e.head[h]) - 1
+	e.head[h] = int32(p + 1)
+
+	limit := min(avail, lzmaNiceLen)
+	ptr1 := e.node(p)
+	ptr0 := ptr1 + 1
+	len0, len1 := 0, 0
+
+	for depth := lzmaDepth; ; depth-- {
+		if cur < 0 || depth == 0 || p-cur > e.dictSize {
+			e.son[ptr0] = 0
+			e.son[ptr1] = 0
+			return
+		}
+
+		pair := e.node(cur)
+		n := min(len0, len1)
+		if e.buf[cur+n] == e.buf[p+n] {
+			n++
+			n += lzmaMatchLen(e.buf[cur+n:], e.buf[p+n:], limit-n)
+
+			if record && n > best {
+				best = n
+				e.matches = append(e.matches,
+					lzmaMatch{length: n, dist: uint32(p - cur - 1)})
+			}
+
+			if n == limit {
+				e.son[ptr1] = e.son[pair]
+				e.son[ptr0] = e.son[pair+1]
+				return
+			}
+		}
+
+		if e.buf[cur+n] < e.buf[p+n] {
+			e.son[ptr1] = int32(cur + 1)
+			ptr1 = pair + 1
+			cur = int(e.son[ptr1]) - 1
+			len1 = n
+		} else {
+			e.son[ptr0] = int32(cur + 1)
+			ptr0 = pair
+			cur = int(e.son[ptr0]) - 1
+			len0 = n
+		}
+	}
+}
+
+func lzmaMatchLen(a, b []byte, limit int) int {
+	n := 0
+	for ; n+8 <= limit; n += 8 {
+		x := le.Uint64(a[n:]) ^ le.Uint64(b[n:])
+		if x != 0 {
+			return n + bits.TrailingZeros64(x)>>3
+		}
+	}
+
+	for n < limit && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+// repLen returns the length of the match at the position with the
+// distance of a rep.
+func (e *lzmaEncoder) repLen(p int, rep uint32, limit int) int {
+	d := int(rep) + 1
+	if d > p || limit < lzmaMatchMinLen {
+		return 0
+	}
+
+	return lzmaMatchLen(e.buf[p-d:], e.buf[p:], limit)
+}
+
+func (e *lzmaEncoder) posState(p int) uint32 {
+	return uint32(e.base+uint64(p)) & (1<<e.params.pb - 1)
+}
+
+func (e *lzmaEncoder) prevByte(p int) byte {
+	if p == 0 {
+		return 0
+	}
+
+	return e.buf[p-1]
+}
+
+func (e *lzmaEncoder) updateDistPrices() {
+	slots := 2 * e.params.dictLog
+	for ls := range e.posSlotPrices {
+		for slot := uint32(0); slot < slots; slot++ {
+			price := lzmaBitTreePrice(e.posSlot[ls][:], lzmaPosSlotBits, slot)
+			if slot >= lzmaEndPosModel {
+				price += (slot>>1 - 1 - lzmaAlignBits) << lzmaPriceShift
+			}
+			e.posSlotPrices[ls][slot] = price
+		}
+
+		for dist := uint32(0); dist < lzmaNumFullDistances; dist++ {
+			slot := lzmaPosSlot(dist)
+			price := e.posSlotPrices[ls][slot]
+			if slot >= lzmaStartPosModel {
+				n := slot>>1 - 1
+				base := (2 | slot&1) << n
+				price += lzmaReverseBitTreePrice(e.posSpecial[:],
+					int(base)-int(slot)-1, n, dist-base)
+			}
+			e.distPrices[ls][dist] = price
+		}
+	}
+
+	e.matchCount = 0
+}
+
+func (e *lzmaEncoder) updateAlignPrices() {
+	for i := range e.alignPrices {
+		e.alignPrices[i] = lzmaReverseBitTreePrice(e.align[:], -1,
+			lzmaAlignBits, uint32(i))
+	}
+
+	e.alignCount = 0
+}
+
+func (e *lzmaEncoder) distPrice(dist uint32, length int) uint32 {
+	ls := lzmaLenToPosState(uint32(length))
+	if dist < lzmaNumFullDistances {
+		return e.distPrices[ls][dist]
+	}
+
+	return e.posSlotPrices[ls][lzmaPosSlot(dist)] +
+		e.alignPrices[dist&(lzmaAlignSize-1)]
+}
+
+func (e *lzmaEncoder) literalPrice(p int, state uint32, rep0 uint32) uint32 {
+	probs := e.literalProbs(e.base+uint64(p), e.prevByte(p))
+	b := uint32(e.buf[p])
+	price := uint32(0)
+
+	m := uint32(1)
+	if state < 7 {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			price += lzmaBitPrice(probs[m], bit)
+			m = m<<1 | bit
+		}
+		return price
+	}
+
+	matchByte := uint32(e.buf[p-int(rep0)-1])
+	offs := uint32(0x100)
+	for i := 7; i >= 0; i-- {
+		matchByte <<= 1
+		matchBit := matchByte & offs
+		bit := (b >> i) & 1
+		price += lzmaBitPrice(probs[offs+matchBit+m], bit)
+		m = m<<1 | bit
+		if bit == 0 {
+			offs &^= matchBit
+		} else {
+			offs &= matchBit
+		}
+	}
+
+	return price
+}
+
+// repPrice returns the price of choosing the rep after the match flag.
+func (e *lzmaEncoder) repPrice(i int, state, posState uint32) uint32 {
+	if i == 0 {
+		return lzmaBitPrice(e.isRepG0[state], 0) +
+			lzmaBitPrice(e.isRep0Long[state][posState], 1)
+	}
+
+	price := lzmaBitPrice(e.isRepG0[state], 1)
+	if i == 1 {
+		return price + lzmaBitPrice(e.isRepG1[state], 0)
+	}
+
+	return price + lzmaBitPrice(e.isRepG1[state], 1) +
+		lzmaBitPrice(e.isRepG2[state], uint32(i-2))
+}
+
+func (e *lzmaEncoder) encodeLiteral(p int) {
+	re := &e.re
+	re.bit(&e.isMatch[e.state][e.posState(p)], 0)
+
+	probs := e.literalProbs(e.base+uint64(p), e.prevByte(p))
+	b := uint32(e.buf[p])
+
+	m := uint32(1)
+	if e.state < 7 {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			re.bit(&probs[m], bit)
+			m = m<<1 | bit
+		}
+	} else {
+		matchByte := uint32(e.buf[p-int(e.reps[0])-1])
+		offs := uint32(0x100)
+		for i := 7; i >= 0; i-- {
+			matchByte <<= 1
+			matchBit := matchByte & offs
+			bit := (b >> i) & 1
+			re.bit(&probs[offs+matchBit+m], bit)
+			m = m<<1 | bit
+			if bit == 0 {
+				offs &^= matchBit
+			} else {
+				offs &= matchBit
+			}
+		}
+	}
+
+	e.state = lzmaLiteralNext(e.state)
+}
+
+func (e *lzmaEncoder) encodeLength(lp *lzmaLenProbs, t *lzmaLenPriceTable,
+	length int, posState uint32) {
+	e.re.length(lp, uint32(length-lzmaMatchMinLen), posState)
+
+	t.counter[posState]--
+	if t.counter[posState] <= 0 {
+		t.update(lp, posState)
+	}
+}
+
+func (e *lzmaEncoder) encodeMatch(dist uint32, length int, p int) {
+	re := &e.re
+	posState := e.posState(p)
+
+	re.bit(&e.isMatch[e.state][posState], 1)
+	re.bit(&e.isRep[e.state], 0)
+	e.encodeLength(&e.lenProbs, &e.lenPrices, length, posState)
+
+	slot := lzmaPosSlot(dist)
+	re.bitTree(e.posSlot[lzmaLenToPosState(uint32(length))][:],
+		lzmaPosSlotBits, slot)
+
+	if slot >= lzmaStartPosModel {
+		n := slot>>1 - 1
+		base := (2 | slot&1) << n
+		reduced := dist - base
+
+		if slot < lzmaEndPosModel {
+			re.reverseBitTree(e.posSpecial[:], int(base)-int(slot)-1, n,
+				reduced)
+		} else {
+			re.directBits(reduced>>lzmaAlignBits, n-lzmaAlignBits)
+			re.reverseBitTree(e.align[:], -1, lzmaAlignBits,
+				reduced&(lzmaAlignSize-1))
+			e.alignCount++
+		}
+	}
+
+	e.reps = [4]uint32{dist, e.reps[0], e.reps[1], e.reps[2]}
+	e.state = lzmaMatchNext(e.state)
+	e.matchCount++
+}
+
+// encodeRep encodes a match with the distance of the rep. A match of
+// rep 0 one byte long is a short rep.
+func (e *lzmaEncoder) encodeRep(i int, length int, p int) {
+	re := &e.re
+	posState := e.posState(p)
+	state := e.state
+
+	re.bit(&e.isMatch[state][posState], 1)
+	re.bit(&e.isRep[state], 1)
+
+	if i == 0 {
+		re.bit(&e.isRepG0[state], 0)
+		if length == 1 {
+			re.bit(&e.isRep0Long[state][posState], 0)
+			e.state = lzmaShortRepNext(state)
+			return
+		}
+		re.bit(&e.isRep0Long[state][posState], 1)
+	} else {
+		re.bit(&e.isRepG0[state], 1)
+		if i == 1 {
+			re.bit(&e.isRepG1[state], 0)
+		} else {
+			re.bit(&e.isRepG1[state], 1)
+			re.bit(&e.isRepG2[state], uint32(i-2))
+		}
+
+		dist := e.reps[i]
+		copy(e.reps[1:i+1], e.reps[:i])
+		e.reps[0] = dist
+	}
+
+	e.encodeLength(&e.repLenProbs, &e.repLenPrices, length, posState)
+	e.state = lzmaRepNext(state)
+}
+
+// step encodes input starting at e.pos. It finds the cheapest way to
+// encode up to lzmaNumOpts bytes by prices of the current model and
+// encodes it, unless a long match makes the search unnecessary.
+func (e *lzmaEncoder) step() {
+	if e.matchCount >= lzmaDistRefresh {
+		e.updateDistPrices()
+	}
+	if e.alignCount >= lzmaAlignRefresh {
+		e.updateAlignPrices()
+	}
+
+	p := e.pos
+	matches := e.findMatches(p)
+	avail := min(len(e.buf)-p, lzmaMatchMaxLen)
+
+	if avail < lzmaMatchMinLen {
+		e.encodeLiteral(p)
+		e.pos++
+		return
+	}
+
+	// Take long matches at once.
+	bestRep, bestRepLen := 0, 0
+	for i, rep := range e.reps {
+		n := e.repLen(p, rep, avail)
+		if n > bestRepLen {
+			bestRep, bestRepLen = i, n
+		}
+	}
+	if bestRepLen >= lzmaNiceLen {
+		e.encodeRep(bestRep, bestRepLen, p)
+		e.skip(p+1, bestRepLen-1)
+		e.pos += bestRepLen
+		return
+	}
+	if len(matches) > 0 && matches[len(matches)-1].length >= lzmaNiceLen {
+		m := matches[len(matches)-1]
+		e.encodeMatch(m.dist, m.length, p)
+		e.skip(p+1, m.length-1)
+		e.pos += m.length
+		return
+	}
+
+	opts := e.opts
+	opts[0] = lzmaOpt{state: e.state, reps: e.reps}
+	e.end = 0
+
+	cur := 1
+	longBack, longLen := 0, 0
+	e.relax(0, matches)
+
+	for ; cur < e.end; cur++ {
+		e.nodeState(cur)
+
+		matches = e.findMatches(p + cur)
+		if len(matches) > 0 &&
+			matches[len(matches)-1].length >= lzmaNiceLen {
+			m := matches[len(matches)-1]
+			longBack, longLen = int(m.dist)+4, m.length
+			break
+		}
+
+		e.relax(cur, matches)
+	}
+
+	// Walk back from the last node and encode the path.
+	e.path = e.path[:0]
+	for i := cur; i > 0; i = opts[i].prev {
+		e.path = append(e.path, i)
+	}
+
+	for i := len(e.path) - 1; i >= 0; i-- {
+		o := &opts[e.path[i]]
+		switch {
+		case o.back < 0:
+			e.encodeLiteral(e.pos)
+		case o.back < 4:
+			e.encodeRep(o.back, o.length, e.pos)
+		default:
+			e.encodeMatch(uint32(o.back-4), o.length, e.pos)
+		}
+		e.pos += o.length
+	}
+
+	if longLen > 0 {
+		e.encodeMatch(uint32(longBack-4), longLen, e.pos)
+		e.skip(e.pos+1, longLen-1)
+		e.pos += longLen
+	}
+}
+
+// nodeState sets state and reps of the node from its predecessor.
+func (e *lzmaEncoder) nodeState(cur int) {
+	o := &e.opts[cur]
+	prev := &e.opts[o.prev]
+	o.reps = prev.reps
+
+	switch {
+	case o.back < 0:
+		o.state = lzmaLiteralNext(prev.state)
+	case o.back == 0 && o.length == 1:
+		o.state = lzmaShortRepNext(prev.state)
+	case o.back < 4:
+		o.state = lzmaRepNext(prev.state)
+		dist := o.reps[o.back]
+		copy(o.reps[1:o.back+1], o.reps[:o.back])
+		o.reps[0] = dist
+	default:
+		o.state = lzmaMatchNext(prev.state)
+		o.reps = [4]uint32{uint32(o.back - 4), prev.reps[0], prev.reps[1],
+			prev.reps[2]}
+	}
+}
+
+// update records a cheaper way to reach the node.
+func (e *lzmaEncoder) update(to int, price uint32, from, back, length int) {
+	for ; e.end < to; e.end++ {
+		e.opts[e.end+1].price = lzmaInfinityPrice
+	}
+
+	o := &e.opts[to]
+	if price < o.price {
+		o.price = price
+		o.prev = from
+		o.back = back
+		o.length = length
+	}
+}
+
+// relax updates nodes reachable from the node cur by one literal, rep
+// or match.
+func (e *lzmaEncoder) relax(cur int, matches []lzmaMatch) {
+	o := &e.opts[cur]
+	p := e.pos + cur
+	state := o.state
+	posState := e.posState(p)
+	avail := min(len(e.buf)-p, lzmaMatchMaxLen, lzmaNumOpts-1-cur)
+
+	e.update(cur+1, o.price+lzmaBitPrice(e.isMatch[state][posState], 0)+
+		e.literalPrice(p, state, o.reps[0]), cur, -1, 1)
+
+	matchPrice := o.price + lzmaBitPrice(e.isMatch[state][posState], 1)
+	repMatchPrice := matchPrice + lzmaBitPrice(e.isRep[state], 1)
+
+	if d := int(o.reps[0]) + 1; d <= p && e.buf[p] == e.buf[p-d] {
+		e.update(cur+1, repMatchPrice+
+			lzmaBitPrice(e.isRepG0[state], 0)+
+			lzmaBitPrice(e.isRep0Long[state][posState], 0), cur, 0, 1)
+	}
+
+	if avail < lzmaMatchMinLen {
+		return
+	}
+
+	startLen := lzmaMatchMinLen
+	for i, rep := range o.reps {
+		n := e.repLen(p, rep, avail)
+		if n < lzmaMatchMinLen {
+			continue
+		}
+
+		// Shorter matches are cheaper with rep 0.
+		if i == 0 {
+			startLen = n + 1
+		}
+
+		price := repMatchPrice + e.repPrice(i, state, posState)
+		for ; n >= lzmaMatchMinLen; n-- {
+			e.update(cur+n, price+
+				e.repLenPrices.prices[posState][n-lzmaMatchMinLen],
+				cur, i, n)
+		}
+	}
+
+	normalPrice := matchPrice + lzmaBitPrice(e.isRep[state], 0)
+	n := startLen
+	for _, m := range matches {
+		for ; n <= min(m.length, avail); n++ {
+			e.update(cur+n, normalPrice+
+				e.lenPrices.prices[posState][n-lzmaMatchMinLen]+
+				e.distPrice(m.dist, n), cur, int(m.dist)+4, n)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func lzmaInfo(lp lzmaParams) uint32 {
+	return compressionInfo(METHOD_LZMA, lp.pack())
+}
+
+func TestLZMARoundTrip(t *testing.T) {
+	data := append(textData(40<<10, 1), randomData(8<<10, 2)...)
+	data = append(data, textData(40<<10, 1)...)
+
+	params := []lzmaParams{
+		{dictLog: 12, lc: 3, lp: 0, pb: 2},
+		{dictLog: 16, lc: 0, lp: 0, pb: 0},
+		{dictLog: 16, lc: 8, lp: 0, pb: 0},
+		{dictLog: 16, lc: 0, lp: 4, pb: 4},
+		{dictLog: 20, lc: 4, lp: 2, pb: 1},
+		{dictLog: 23, lc: 3, lp: 0, pb: 2},
+	}
+
+	for _, lp := range params {
+		info := lzmaInfo(lp)
+		t.Run(CompressionName(info), func(t *testing.T) {
+			codecRoundTrip(t, info, nil)
+			codecRoundTrip(t, info, []byte{42})
+			codecRoundTrip(t, info, data)
+		})
+	}
+
+	codecRoundTrip(t, compressionInfo(METHOD_LZMA, 0), data)
+}
+
+func TestLZMASlide(t *testing.T) {
+	// The encoder drops data older than the dictionary of 4 KiB once
+	// it has buffered twice as much. Repeats at distances just within
+	// and beyond the dictionary cross many such slides.
+	info := lzmaInfo(lzmaParams{dictLog: 12, lc: 3, lp: 0, pb: 2})
+	dict := 1 << 12
+
+	for _, period := range []int{dict - 300, dict - 1, dict, dict + 1,
+		2*dict + 5} {
+		chunk := randomData(period, int64(period))
+		data := bytes.Repeat(chunk, 20*dict/period)
+		codecRoundTrip(t, info, data)
+	}
+
+	// Long runs make matches of the longest length end at slides.
+	codecRoundTrip(t, info, make([]byte, 50*dict+7))
+	codecRoundTrip(t, info, textData(lzmaChunkSize+1, 3))
+}
+
+func TestLZMACorrupt(t *testing.T) {
+	info := lzmaInfo(lzmaParams{dictLog: 16, lc: 3, lp: 0, pb: 2})
+	data := textData(64<<10, 1)
+
+	var packed bytes.Buffer
+	w, _ := lzmaCodec{}.newWriter(&packed, paramsOf(info))
+	w.Write(data)
+	w.Close()
+
+	for _, n := range []int{0, 1, 5, 6, 100, packed.Len() / 2,
+		packed.Len() - 1} {
+		_, err := decodeStream(info, packed.Bytes()[:n])
+		if err == nil {
+			t.Errorf("stream truncated to %d bytes decoded", n)
+		}
+	}
+
+	for i := 0; i < packed.Len(); i += 97 {
+		corrupt := bytes.Clone(packed.Bytes())
+		corrupt[i] ^= 0x55
+
+		if _, err := decodeStream(info, corrupt); err == nil {
+			t.Errorf("stream corrupt at byte %d decoded", i)
+		}
+	}
+}
+
+func TestLZMAMemoryLimit(t *testing.T) {
+	info := lzmaInfo(lzmaParams{dictLog: 24, lc: 3, lp: 0, pb: 2})
+	data := textData(1000, 1)
+	needed := lzmaCodec{}.memoryUsage(paramsOf(info))
+
+	path := filepath.Join(t.TempDir(), "test.kcf")
+	packTestFile(t, path, info, nil, data)
+
+	kcf, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	kcf.SetReaderOptions(ReaderOptions{MemoryLimit: needed - 1})
+
+	if _, err = kcf.GetCurrentFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	_, err = kcf.UnpackFile(&got)
+
+	var limitErr *MemoryLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("got %v, want MemoryLimitError", err)
+	}
+	if limitErr.Needed != needed || limitErr.Limit != needed-1 {
+		t.Errorf("got %+v, want needed %d and limit %d", *limitErr,
+			needed, needed-1)
+	}
+
+	var buf bytes.Buffer
+	unpackTestFile(t, path, ReaderOptions{MemoryLimit: needed}, &buf)
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("data differ within the memory limit")
+	}
+}
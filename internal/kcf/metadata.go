@@ -0,0 +1,285 @@
+package kcf
+
+import (
+	"hash/crc32"
+	"io"
+	"maps"
+)
+
+// maxAuxDataSize limits added data of records preceding the file
+// header, which is kept in memory while the file is unpacked.
+const maxAuxDataSize = 1 << 30
+
+// auxRecord is a record preceding the file header together with its
+// added data. Such records are kept to copy the file without unpacking.
+type auxRecord struct {
+	rec  Record
+	data []byte
+}
+
+// readAllAddedData reads the whole added data of the last record.
+func (kcf *Kcf) readAllAddedData() (data []byte, err error) {
+	if kcf.state.GetStage() != stageRecordAddedData {
+		return nil, nil
+	}
+
+	if kcf.lastRecord.AddedDataSize > maxAuxDataSize {
+		err = TooBigRecordData
+		return
+	}
+
+	data = make([]byte, kcf.lastRecord.AddedDataSize)
+	for ptr := 0; ptr < len(data); {
+		var n int
+
+		n, err = kcf.readAddedData(data[ptr:])
+		if err != nil && err != io.EOF {
+			return
+		}
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+
+		ptr += n
+	}
+
+	err = nil
+	return
+}
+
+// readFileMetadata parses the last record which has been read before
+// the file header and stores its contents into kcf.currentFile.
+func (kcf *Kcf) readFileMetadata() (err error) {
+	var data []byte
+	var handler RecordHandler
+
+	rec := kcf.lastRecord
+	if !isBuiltinRecord(rec.HeadType) {
+		handler = recordHandler(rec.HeadType)
+		if handler == nil {
+			return kcf.skipUnknownRecord()
+		}
+	}
+
+	data, err = kcf.readAllAddedData()
+	if err != nil {
+		return
+	}
+
+	switch rec.HeadType {
+	case LONG_NAME:
+		if !rec.ValidateCRC() {
+			err = CorruptedRecordData
+		} else if len(data) == 0 {
+			err = InvalidFormat
+		}
+		kcf.currentFile.FileName = string(data)
+	case FILE_METADATA:
+		kcf.currentFile.Metadata, err = RecordToFileMetadata(rec)
+	case SPARSE_MAP:
+		kcf.currentFile.SparseMap, err = RecordToSparseMap(rec, data)
+	case XATTRS:
+		kcf.currentFile.Xattrs, err = RecordToXattrs(rec, data)
+	case EXTENDED_HEADER:
+		kcf.currentFile.Extra, err = RecordToExtra(rec, data)
+	case GLOBAL_HEADER:
+		// Global headers describe the archive rather than the file,
+		// so they are not copied along with the file.
+		return kcf.mergeGlobalExtra(rec, data)
+	case FILE_COMMENT:
+		kcf.currentFile.Comment, err = recordToComment(rec, data)
+	case CODER_CHAIN:
+		kcf.currentFile.Filters, err = recordToFilters(rec)
+	case ARCHIVE_COMMENT:
+		// The archive comment is not copied along with the file.
+		kcf.comment, err = recordToComment(rec, data)
+		return
+	case MARKER, ARCHIVE_HEADER, DATA_FRAGMENT, SOLID_BLOCK:
+		err = InvalidFormat
+	default:
+		if !rec.ValidateCRC() {
+			err = CorruptedRecordData
+		} else {
+			err = handler(&kcf.currentFile, rec, data)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	kcf.auxRecords = append(kcf.auxRecords, auxRecord{rec, data})
+	return
+}
+
+// skipUnknownRecord skips the last record if its type is unknown but
+// skippable. Otherwise the archive cannot be read further.
+func (kcf *Kcf) skipUnknownRecord() (err error) {
+	if !kcf.lastRecord.HeadType.IsSkippable() {
+		return &UnknownRecordError{Type: kcf.lastRecord.HeadType}
+	}
+
+	if kcf.state.GetStage() == stageRecordAddedData {
+		err = kcf.skipAddedData()
+	}
+
+	return
+}
+
+// writeRecordData writes the record followed by its added data. Size
+// and CRC32 of the added data are filled in by writeRecordData.
+func (kcf *Kcf) writeRecordData(rec Record, data []byte) (err error) {
+	if len(data) > 0 {
+		crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+
+		rec.HeadFlags &^= HAS_ADDED_8
+		rec.HeadFlags |= HAS_ADDED_4 | HAS_ADDED_CRC32
+		if len(data) > 2147483647 {
+			rec.HeadFlags |= HAS_ADDED_8
+		}
+		rec.AddedDataSize = uint64(len(data))
+		rec.AddedDataCRC32 = crc32.Checksum(data, crc32c_table)
+
+		err = rec.Fix()
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = kcf.writeRecord(rec)
+	if err != nil {
+		return
+	}
+
+	if kcf.state.GetStage() != stageRecordAddedData {
+		return
+	}
+
+	kcf.state.SetAddedCRCKnown(true)
+	_, err = kcf.writeAddedData(data)
+	if err != nil {
+		return
+	}
+
+	return kcf.finishAddedData()
+}
+
+// writeFileMetadata writes records which precede the file header of
+// kcf.currentFile.
+func (kcf *Kcf) writeFileMetadata() (err error) {
+	var rec Record
+
+	kcf.state.SetPackerPos(pposFileMetadata)
+
+	if kcf.currentFile.HasLongName() {
+		rec = Record{HeadType: LONG_NAME}
+		err = kcf.writeRecordData(rec, []byte(kcf.currentFile.FileName))
+		if err != nil {
+			return
+		}
+	}
+
+	if kcf.currentFile.Metadata.MetaFlags != 0 {
+		rec, err = kcf.currentFile.Metadata.AsRecord()
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	if (kcf.currentFile.FileFlags & IS_SPARSE) != 0 {
+		var data []byte
+
+		rec, data, err = kcf.currentFile.SparseMap.AsRecord()
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, data)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(kcf.currentFile.Filters) > 0 {
+		rec, err = filtersAsRecord(kcf.currentFile.Filters)
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(kcf.currentFile.Xattrs) > 0 {
+		var data []byte
+
+		rec, data, err = kcf.currentFile.Xattrs.AsRecord()
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, data)
+		if err != nil {
+			return
+		}
+	}
+
+	if kcf.currentFile.Comment != "" {
+		var data []byte
+
+		rec, data, err = commentAsRecord(FILE_COMMENT,
+			kcf.currentFile.Comment)
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, data)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(kcf.currentFile.Extra) > 0 {
+		var data []byte
+
+		rec, data, err = kcf.currentFile.Extra.AsRecord(EXTENDED_HEADER)
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, data)
+		if err != nil {
+			return
+		}
+	}
+
+	kcf.state.SetPackerPos(pposFileHeader)
+
+	return
+}
+
+// mergeGlobalExtra adds pairs of the global header record to the
+// archive-wide metadata. Later records override earlier values.
+func (kcf *Kcf) mergeGlobalExtra(rec Record, data []byte) (err error) {
+	var extra Extra
+
+	extra, err = RecordToExtra(rec, data)
+	if err != nil {
+		return
+	}
+
+	if kcf.globalExtra == nil {
+		kcf.globalExtra = make(Extra)
+	}
+	maps.Copy(kcf.globalExtra, extra)
+
+	return
+}
@@ -0,0 +1,232 @@
+package kcf
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// packHeaders creates an archive at path holding files of the given
+// headers, each with its name as data, and reads their headers back.
+func packHeaders(t *testing.T, path string, hdrs []FileHeader) (
+	got []FileHeader,
+) {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	for _, hdr := range hdrs {
+		hdr.SetUnpackedSize(uint64(len(hdr.FileName)))
+		err = kcf.PackFile(hdr, bytes.NewReader([]byte(hdr.FileName)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	kcf.Close()
+
+	kcf, err = OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		hdr, err := kcf.GetCurrentFile()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var data bytes.Buffer
+		_, err = kcf.UnpackFile(&data)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if data.String() != hdr.FileName {
+			t.Errorf("data of %s differ", hdr.FileName)
+		}
+
+		got = append(got, hdr)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 678, time.UTC)
+
+	// precise tells whether the file metadata hold the time.
+	tests := []struct {
+		name    string
+		mtime   time.Time
+		precise bool
+		want    time.Time
+	}{
+		{"seconds", mtime, false, mtime.Truncate(time.Second)},
+		{"nanoseconds", mtime, true, mtime},
+		{"before 1970", time.Unix(-86400, 0), false, time.Unix(-86400, 0)},
+		{"none", time.Time{}, false, time.Time{}},
+	}
+
+	var hdrs []FileHeader
+	for _, tt := range tests {
+		var hdr FileHeader
+		hdr.FileName = tt.name
+		hdr.FileType = REGULAR_FILE
+		if tt.precise {
+			hdr.Metadata.MetaFlags |= HAS_MTIME
+		}
+		hdr.SetModTime(tt.mtime)
+		hdrs = append(hdrs, hdr)
+	}
+
+	got := packHeaders(t, filepath.Join(t.TempDir(), "test.kcf"), hdrs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d files, want %d", len(got), len(tests))
+	}
+
+	for i, tt := range tests {
+		hasTime := got[i].FileFlags&HAS_TIMESTAMP != 0
+		if hasTime == tt.want.IsZero() {
+			t.Errorf("%s: file has timestamp: %v", tt.name, hasTime)
+		}
+		if !got[i].ModTime().Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got[i].ModTime(),
+				tt.want)
+		}
+	}
+}
+
+func TestFileMetadataRoundTrip(t *testing.T) {
+	times := FileMetadata{
+		MetaFlags:  HAS_MTIME | HAS_ATIME | HAS_CTIME | HAS_BTIME,
+		ModTime:    time.Date(2024, 1, 2, 3, 4, 5, 999999999, time.UTC),
+		AccessTime: time.Date(2024, 2, 3, 4, 5, 6, 1, time.UTC),
+		ChangeTime: time.Unix(-1, 500),
+		BirthTime:  time.Unix(0, 0),
+	}
+	all := times
+	all.MetaFlags |= HAS_MODE | HAS_OWNER | HAS_NAMES | HAS_DEVICE
+	all.Mode = 0o4755
+	all.Uid, all.Gid = 1000, 100
+	all.UserName, all.GroupName = "user", "users"
+	all.DevMajor, all.DevMinor = 259, 1<<20
+
+	tests := []struct {
+		name string
+		meta FileMetadata
+	}{
+		{"times", times},
+		{"mtime", FileMetadata{MetaFlags: HAS_MTIME,
+			ModTime: times.ModTime}},
+		{"mode", FileMetadata{MetaFlags: HAS_MODE, Mode: 0o1777}},
+		{"empty names", FileMetadata{MetaFlags: HAS_OWNER | HAS_NAMES}},
+		{"all", all},
+	}
+
+	var hdrs []FileHeader
+	for _, tt := range tests {
+		rec, err := tt.meta.AsRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Records cut short at any point are refused.
+		for n := range len(rec.Data) {
+			short := rec
+			short.Data = rec.Data[:n]
+			short.Fix()
+
+			_, err = RecordToFileMetadata(short)
+			if err != CorruptedRecordData {
+				t.Errorf("%s: record of %d bytes: got %v", tt.name, n,
+					err)
+			}
+		}
+
+		hdrs = append(hdrs, FileHeader{
+			FileName: tt.name,
+			FileType: REGULAR_FILE,
+			Metadata: tt.meta,
+		})
+	}
+
+	got := packHeaders(t, filepath.Join(t.TempDir(), "test.kcf"), hdrs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d files, want %d", len(got), len(tests))
+	}
+
+	for i, tt := range tests {
+		meta := got[i].Metadata
+		want := tt.meta
+		if meta.MetaFlags != want.MetaFlags ||
+			!meta.ModTime.Equal(want.ModTime) ||
+			!meta.AccessTime.Equal(want.AccessTime) ||
+			!meta.ChangeTime.Equal(want.ChangeTime) ||
+			!meta.BirthTime.Equal(want.BirthTime) {
+			t.Errorf("%s: got times %+v, want %+v", tt.name, meta, want)
+		}
+
+		meta.ModTime, want.ModTime = time.Time{}, time.Time{}
+		meta.AccessTime, want.AccessTime = time.Time{}, time.Time{}
+		meta.ChangeTime, want.ChangeTime = time.Time{}, time.Time{}
+		meta.BirthTime, want.BirthTime = time.Time{}, time.Time{}
+		if meta != want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, meta, want)
+		}
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o2640); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	atime := time.Date(2023, 5, 6, 7, 8, 9, 987654321, time.UTC)
+	if err := os.Chtimes(path, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := readMetadata(file, info)
+	if meta.MetaFlags&HAS_MTIME == 0 || !meta.ModTime.Equal(mtime) {
+		t.Errorf("got modification time %v, want %v", meta.ModTime,
+			mtime)
+	}
+	if meta.MetaFlags&HAS_ATIME != 0 && !meta.AccessTime.Equal(atime) {
+		t.Errorf("got access time %v, want %v", meta.AccessTime, atime)
+	}
+	if meta.MetaFlags&HAS_CTIME == 0 || meta.ChangeTime.IsZero() {
+		t.Error("change time is missing")
+	}
+	if meta.FileMode() != info.Mode()&(os.ModePerm|os.ModeSetgid) {
+		t.Errorf("got mode %v, want %v", meta.FileMode(), info.Mode())
+	}
+}
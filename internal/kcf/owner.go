@@ -0,0 +1,128 @@
+package kcf
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+	modePerm   = 0o0777
+)
+
+// unixMode converts permission bits of mode to their Unix
+// representation.
+func unixMode(mode os.FileMode) (m uint16) {
+	m = uint16(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= modeSticky
+	}
+
+	return
+}
+
+// FileMode returns permission bits of the file. If the metadata has no
+// mode, it returns zero.
+func (meta FileMetadata) FileMode() (mode os.FileMode) {
+	if (meta.MetaFlags & HAS_MODE) == 0 {
+		return 0
+	}
+
+	mode = os.FileMode(meta.Mode & modePerm)
+	if meta.Mode&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if meta.Mode&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if meta.Mode&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return
+}
+
+// Owner returns user and group ids to be given to the unpacked file.
+// Unless numeric is set, user and group names known on this system
+// take precedence over the stored ids. If the metadata has no owner,
+// ok is false.
+func (meta FileMetadata) Owner(numeric bool) (uid, gid int, ok bool) {
+	if (meta.MetaFlags & HAS_OWNER) == 0 {
+		return -1, -1, false
+	}
+
+	uid, gid, ok = int(meta.Uid), int(meta.Gid), true
+	if numeric || (meta.MetaFlags&HAS_NAMES) == 0 {
+		return
+	}
+
+	if u, err := user.Lookup(meta.UserName); err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+
+	if g, err := user.LookupGroup(meta.GroupName); err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+
+	return
+}
+
+var ownerNames struct {
+	sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+// setOwner fills owner ids and names of the metadata. Names are looked
+// up once per id.
+func (meta *FileMetadata) setOwner(uid, gid uint32) {
+	meta.MetaFlags |= HAS_OWNER
+	meta.Uid = uid
+	meta.Gid = gid
+
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+
+	if ownerNames.users == nil {
+		ownerNames.users = make(map[uint32]string)
+		ownerNames.groups = make(map[uint32]string)
+	}
+
+	userName, ok := ownerNames.users[uid]
+	if !ok {
+		u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+		if err == nil {
+			userName = u.Username
+		}
+		ownerNames.users[uid] = userName
+	}
+
+	groupName, ok := ownerNames.groups[gid]
+	if !ok {
+		g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+		if err == nil {
+			groupName = g.Name
+		}
+		ownerNames.groups[gid] = groupName
+	}
+
+	if userName != "" || groupName != "" {
+		meta.MetaFlags |= HAS_NAMES
+		meta.UserName = userName
+		meta.GroupName = groupName
+	}
+}
@@ -0,0 +1,106 @@
+package kcf
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		unix uint16
+	}{
+		{0644, 0o644},
+		{0755 | os.ModeDir, 0o755},
+		{0755 | os.ModeSetuid, 0o4755},
+		{0750 | os.ModeSetgid, 0o2750},
+		{0777 | os.ModeSticky | os.ModeDir, 0o1777},
+		{0777 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky, 0o7777},
+	}
+
+	for _, tt := range tests {
+		if got := unixMode(tt.mode); got != tt.unix {
+			t.Errorf("mode %v: got %#o, want %#o", tt.mode, got, tt.unix)
+		}
+
+		meta := FileMetadata{MetaFlags: HAS_MODE, Mode: tt.unix}
+		want := tt.mode &^ os.ModeDir
+		if got := meta.FileMode(); got != want {
+			t.Errorf("mode %#o: got %v, want %v", tt.unix, got, want)
+		}
+	}
+
+	if mode := (FileMetadata{Mode: 0o755}).FileMode(); mode != 0 {
+		t.Errorf("got mode %v without HAS_MODE", mode)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	g, err := user.LookupGroup("daemon")
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(g.Gid)
+
+	ids := FileMetadata{MetaFlags: HAS_OWNER, Uid: 1234, Gid: 5678}
+	names := ids
+	names.MetaFlags |= HAS_NAMES
+	names.UserName, names.GroupName = "nobody", "daemon"
+	unknown := names
+	unknown.UserName, unknown.GroupName = "kcf-no-such-user", ""
+
+	// Names known on the system take precedence over the ids unless
+	// the numeric owner is asked for.
+	tests := []struct {
+		name     string
+		meta     FileMetadata
+		numeric  bool
+		uid, gid int
+		ok       bool
+	}{
+		{"ids", ids, false, 1234, 5678, true},
+		{"names", names, false, uid, gid, true},
+		{"numeric", names, true, 1234, 5678, true},
+		{"unknown names", unknown, false, 1234, 5678, true},
+		{"no owner", FileMetadata{}, false, -1, -1, false},
+	}
+
+	for _, tt := range tests {
+		uid, gid, ok := tt.meta.Owner(tt.numeric)
+		if uid != tt.uid || gid != tt.gid || ok != tt.ok {
+			t.Errorf("%s: got %d, %d, %v, want %d, %d, %v", tt.name,
+				uid, gid, ok, tt.uid, tt.gid, tt.ok)
+		}
+	}
+}
+
+func TestSetOwner(t *testing.T) {
+	var meta FileMetadata
+	meta.setOwner(0, 0)
+
+	want := FileMetadata{
+		MetaFlags: HAS_OWNER | HAS_NAMES,
+		UserName:  "root",
+		GroupName: "root",
+	}
+	if _, err := user.LookupId("0"); err != nil {
+		want = FileMetadata{MetaFlags: HAS_OWNER}
+	}
+	if meta != want {
+		t.Errorf("got %+v, want %+v", meta, want)
+	}
+
+	// Ids without names keep only the ids.
+	meta = FileMetadata{}
+	meta.setOwner(1<<31-7, 1<<31-7)
+	if meta.MetaFlags != HAS_OWNER || meta.Uid != 1<<31-7 {
+		t.Errorf("got %+v for ids without names", meta)
+	}
+}
@@ -0,0 +1,502 @@
+package kcf
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// Pipeline packs files into the archive in parallel. Files are read and
+// compressed by up to workers goroutines at once, large files of block
+// compression methods block by block. Packed data wait in memory or in
+// temporary files until a single goroutine writes the records of files
+// in the order they were added, so the archive does not depend on the
+// number of workers. The archive must not be used otherwise until
+// Close returns, except after Flush.
+//
+// In solid archives, regular files are collected into groups and
+// queued together once their solid block is full, so they follow
+// files queued after them.
+type Pipeline struct {
+	kcf     *Kcf
+	options WriterOptions
+
+	// solid controls solid blocks of the archive. groups lists groups
+	// of files waiting for their blocks to fill up, in the order they
+	// were started.
+	solid  SolidOptions
+	groups []*solidGroup
+
+	// tokens limits the number of goroutines compressing data.
+	tokens  chan struct{}
+	workers int
+
+	queue   chan *packJob
+	pending sync.WaitGroup
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// packJob is a file queued for packing. Once ready is closed, write
+// writes the file into the archive unless err is set, and cleanup
+// releases resources of the file.
+type packJob struct {
+	opts    WriterOptions
+	ready   chan struct{}
+	err     error
+	write   func() error
+	cleanup func()
+}
+
+// spillMemory is the amount of packed data of a file kept in memory
+// before the rest is stored in a temporary file.
+const spillMemory = 8 << 20
+
+// NewPipeline returns a pipeline packing files by the given number of
+// workers into the archive. The writer options of the archive are
+// restored when the pipeline is closed.
+func (kcf *Kcf) NewPipeline(workers int) *Pipeline {
+	if !kcf.state.IsWriting() {
+		panic(InvalidState)
+	}
+
+	workers = max(workers, 1)
+	p := &Pipeline{
+		kcf:     kcf,
+		options: kcf.options,
+		tokens:  make(chan struct{}, workers),
+		workers: workers,
+		queue:   make(chan *packJob, 2*workers),
+		done:    make(chan struct{}),
+	}
+
+	if kcf.archiveHdr.ArchiveFlags&IS_SOLID != 0 {
+		p.solid = kcf.options.Solid
+	}
+
+	go p.writeJobs()
+	return p
+}
+
+// Err returns the first error met by the pipeline.
+func (p *Pipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Pipeline) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// PackPath queues the file at path to be packed with opts as
+// Kcf.PackPath does. It returns errors met so far, which stop the
+// pipeline, and blocks while too many files wait to be written.
+func (p *Pipeline) PackPath(path string, opts WriterOptions) (err error) {
+	if err = p.Err(); err != nil {
+		return
+	}
+
+	var info os.FileInfo
+
+	info, err = os.Lstat(path)
+	if err != nil {
+		return
+	}
+
+	kcf := p.kcf
+	job := &packJob{opts: opts, ready: make(chan struct{})}
+
+	special := os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+	id, isLinked := inodeOf(info)
+	isLinked = isLinked && info.Mode().IsRegular()
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		job.write = func() error { return kcf.packSymlink(path, info) }
+		close(job.ready)
+	case info.Mode()&special != 0:
+		job.write = func() error { return kcf.packSpecial(path, info) }
+		close(job.ready)
+	case isLinked && kcf.hardLinks[id] != "":
+		// The file linked to may wait for its solid block.
+		p.queueGroups()
+
+		target := kcf.hardLinks[id]
+		job.write = func() error { return kcf.packHardLink(path, target) }
+		close(job.ready)
+	default:
+		if isLinked {
+			if kcf.hardLinks == nil {
+				kcf.hardLinks = make(map[inodeID]string)
+			}
+			kcf.hardLinks[id] = path
+		}
+
+		size := uint64(info.Size())
+		if info.Mode().IsRegular() && p.isSolid(size, opts) {
+			p.addSolid(solidFile{path: path, opts: opts}, size)
+			return
+		}
+
+		go p.prepare(job, path)
+	}
+
+	p.queueJob(job)
+	return
+}
+
+// PackFile queues the file described by hdr with data kept in memory
+// to be packed as Kcf.PackFile does. For sparse files data holds data
+// of their extents only. In solid archives regular files go to solid
+// blocks of their compression methods, others are packed by the
+// writer.
+func (p *Pipeline) PackFile(hdr FileHeader, data []byte) (err error) {
+	if err = p.Err(); err != nil {
+		return
+	}
+
+	hdr.FileFlags &^= IN_SOLID_BLOCK
+	opts := WriterOptions{Compression: hdr.CompressionInfo,
+		Filters: hdr.Filters}
+
+	size := uint64(len(data))
+	if hdr.FileType == REGULAR_FILE && p.isSolid(size, opts) {
+		p.addSolid(solidFile{
+			path: hdr.FileName,
+			opts: opts,
+			hdr:  &hdr,
+			data: data,
+		}, size)
+		return
+	}
+
+	// The file linked to may wait for its solid block.
+	if hdr.FileType == HARDLINK {
+		p.queueGroups()
+	}
+
+	kcf := p.kcf
+	job := &packJob{opts: p.options, ready: make(chan struct{})}
+	job.write = func() error {
+		return kcf.PackFile(hdr, bytes.NewReader(data))
+	}
+	close(job.ready)
+
+	p.queueJob(job)
+	return
+}
+
+func (p *Pipeline) queueJob(job *packJob) {
+	p.pending.Add(1)
+	p.queue <- job
+}
+
+// Flush waits until all queued files are written and returns the first
+// error met by the pipeline.
+func (p *Pipeline) Flush() error {
+	p.queueGroups()
+	p.pending.Wait()
+	return p.Err()
+}
+
+// Close waits until all queued files are written and stops the
+// pipeline. It returns the first error met by the pipeline.
+func (p *Pipeline) Close() error {
+	p.queueGroups()
+	close(p.queue)
+	<-p.done
+	return p.Err()
+}
+
+// writeJobs writes queued files in order. After an error, files are
+// only released.
+func (p *Pipeline) writeJobs() {
+	defer close(p.done)
+
+	for job := range p.queue {
+		<-job.ready
+
+		err := job.err
+		if err == nil && p.Err() == nil {
+			p.kcf.options = job.opts
+			err = job.write()
+		}
+		if job.cleanup != nil {
+			job.cleanup()
+		}
+		if err != nil {
+			p.setErr(err)
+		}
+
+		p.pending.Done()
+	}
+
+	p.kcf.options = p.options
+}
+
+// prepare reads the header of the file or directory at path and packs
+// its data, unless they are stored, which the writer copies itself.
+func (p *Pipeline) prepare(job *packJob, path string) {
+	defer close(job.ready)
+
+	p.tokens <- struct{}{}
+	defer func() { <-p.tokens }()
+
+	file, err := os.Open(path)
+	if err != nil {
+		job.err = err
+		return
+	}
+	job.cleanup = func() { file.Close() }
+
+	kcf := p.kcf
+	hdr, data, size, err := kcf.fileHeaderOf(file, job.opts)
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	storeData := func() error { return kcf.packData(hdr, data(), size) }
+	if hdr.FileType != REGULAR_FILE {
+		job.write = storeData
+		return
+	}
+
+	c, err := kcf.prepareHeader(&hdr, size)
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	if c == nil && len(hdr.Filters) == 0 {
+		job.write = storeData
+		return
+	}
+
+	enc := &spill{}
+	job.cleanup = func() {
+		enc.close()
+		file.Close()
+	}
+
+	crc := newFileHash(hdr)
+	r := io.TeeReader(data(), crc)
+	if hdr.FileFlags&INDEPENDENT_FRAGMENTS != 0 {
+		err = p.encodeBlocks(enc, c, hdr.CompressionInfo, r, size)
+	} else {
+		fw := newFragmentWriter(enc, c, hdr.CompressionInfo)
+		err = encodeData(fw, r, size, hdr.Filters, hdr.CompressionInfo)
+	}
+	if err != nil {
+		job.err = err
+		return
+	}
+
+	// Unlike Kcf.PackPath, the pipeline stores files which do not
+	// compress well in any archive, since their data can be read anew
+	// before anything is written.
+	if job.opts.AutoCompression && enc.size >= size {
+		enc.close()
+		hdr.CompressionInfo = compressionInfo(METHOD_STORED, 0)
+		hdr.Filters = nil
+		job.write = storeData
+		return
+	}
+
+	if hdr.FileFlags&HAS_FILE_CRC32 != 0 {
+		hdr.FileCRC32 = crc.Sum32()
+	}
+	job.write = func() error { return kcf.writeEncoded(hdr, enc) }
+}
+
+// encodeBlocks encodes size bytes read from r by the block codec c into
+// sink. Blocks are compressed in parallel, each by its own writer of
+// the codec, which packs them the same way as a single writer does.
+func (p *Pipeline) encodeBlocks(sink fragmentSink, c codec, info uint32,
+	r io.Reader, size uint64) (err error) {
+	type block struct {
+		frags fragmentList
+		done  chan struct{}
+		err   error
+	}
+
+	// The caller's token is given back while blocks hold their own.
+	<-p.tokens
+	defer func() { p.tokens <- struct{}{} }()
+
+	var blocks []*block
+	finish := func() error {
+		b := blocks[0]
+		blocks = blocks[1:]
+
+		<-b.done
+		if b.err != nil {
+			return b.err
+		}
+
+		for _, frag := range b.frags {
+			if err := sink.writeFragment(frag, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	blockSize := uint64(c.(blockCodec).blockSize(paramsOf(info)))
+	for size > 0 || len(blocks) > 0 {
+		if size == 0 || len(blocks) == p.workers {
+			if err = finish(); err != nil {
+				break
+			}
+			continue
+		}
+
+		p.tokens <- struct{}{}
+
+		buf := make([]byte, min(size, blockSize))
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			<-p.tokens
+			break
+		}
+		size -= uint64(len(buf))
+
+		b := &block{done: make(chan struct{})}
+		blocks = append(blocks, b)
+
+		go func() {
+			defer close(b.done)
+			defer func() { <-p.tokens }()
+
+			fw := newFragmentWriter(&b.frags, c, info)
+			b.err = encodeData(fw, bytes.NewReader(buf),
+				uint64(len(buf)), nil, info)
+		}()
+	}
+
+	// Wait for blocks still being compressed after an error.
+	for _, b := range blocks {
+		<-b.done
+	}
+
+	return
+}
+
+// writeEncoded writes the file header hdr together with records
+// preceding it and packed data of the file kept in enc.
+func (kcf *Kcf) writeEncoded(hdr FileHeader, enc *spill) (err error) {
+	kcf.currentFile = hdr
+	err = kcf.writeFileMetadata()
+	if err != nil {
+		return
+	}
+
+	err = enc.replay(&recordSink{kcf: kcf})
+	if err != nil {
+		return
+	}
+
+	kcf.packedSize = enc.size
+	kcf.state.SetPackerPos(pposFileHeader)
+
+	return
+}
+
+// fragmentList keeps fragments in memory.
+type fragmentList [][]byte
+
+func (l *fragmentList) writeFragment(data []byte, continued bool) error {
+	*l = append(*l, bytes.Clone(data))
+	return nil
+}
+
+// spill keeps fragments of packed data of a file, up to spillMemory
+// bytes in memory and the rest in a temporary file.
+type spill struct {
+	frags []spillFragment
+	mem   int
+	size  uint64
+	file  *os.File
+}
+
+// spillFragment is a fragment kept in data, or in the temporary file at
+// offset if data is nil.
+type spillFragment struct {
+	data   []byte
+	offset int64
+	length int
+}
+
+func (s *spill) writeFragment(data []byte, continued bool) (err error) {
+	frag := spillFragment{length: len(data)}
+
+	if s.mem+len(data) <= spillMemory {
+		frag.data = append([]byte{}, data...)
+		s.mem += len(data)
+	} else {
+		if s.file == nil {
+			s.file, err = os.CreateTemp("", "kcf-spill-")
+			if err != nil {
+				return
+			}
+		}
+
+		frag.offset, err = s.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return
+		}
+
+		_, err = s.file.Write(data)
+		if err != nil {
+			return
+		}
+	}
+
+	s.frags = append(s.frags, frag)
+	s.size += uint64(len(data))
+	return
+}
+
+// replay passes the fragments to sink in order.
+func (s *spill) replay(sink fragmentSink) (err error) {
+	var buf []byte
+
+	for i, frag := range s.frags {
+		data := frag.data
+		if data == nil {
+			buf = append(buf[:0], make([]byte, frag.length)...)
+			_, err = s.file.ReadAt(buf, frag.offset)
+			if err != nil {
+				return
+			}
+			data = buf
+		}
+
+		err = sink.writeFragment(data, i < len(s.frags)-1)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// close removes the temporary file.
+func (s *spill) close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+
+	s.frags = nil
+}
@@ -0,0 +1,173 @@
+package kcf
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pipelineFile is a file packed by a pipeline with opts.
+type pipelineFile struct {
+	name string
+	data []byte
+	opts WriterOptions
+}
+
+// packPipeline packs files and the directory dir holding them into a
+// new archive at path by a pipeline of workers.
+func packPipeline(t *testing.T, path, dir string, files []pipelineFile,
+	workers int) {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	// The archive header would hold the time of InitArchive otherwise.
+	kcf.SetWriterOptions(WriterOptions{
+		CreationTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := kcf.NewPipeline(workers)
+	if err = p.PackPath(dir, WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		err = p.PackPath(filepath.Join(dir, f.name), f.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipelineWorkers(t *testing.T) {
+	lz4 := WriterOptions{
+		Compression: compressionInfo(METHOD_LZ4, lz4MinBlockLog),
+	}
+	files := []pipelineFile{
+		{"small.txt", textData(1000, 1), lz4},
+		{"stored.txt", textData(5000, 2), WriterOptions{}},
+		{"empty", nil, lz4},
+		// Blocks of 64 KiB make the file a few dozens of fragments.
+		{"large.txt", textData(3<<20+7, 3), lz4},
+		{"lzma.txt", textData(200<<10, 4), WriterOptions{
+			Compression: compressionInfo(METHOD_LZMA, 0),
+		}},
+		{"delta.bin", textData(100<<10, 5), WriterOptions{
+			Compression: compressionInfo(METHOD_LZ4, 0),
+			Filters:     []uint32{compressionInfo(METHOD_DELTA, 0)},
+		}},
+		// Random data do not compress, so that more packed data than
+		// spillMemory go to a temporary file.
+		{"random.bin", randomData(spillMemory+1<<20, 6), lz4},
+		{"last.txt", textData(3000, 7), lz4},
+	}
+
+	dir := filepath.Join(t.TempDir(), "tree")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		err := os.WriteFile(filepath.Join(dir, f.name), f.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading the files may update their access times once, which the
+	// first archive holds then.
+	var archives [][]byte
+	for _, workers := range []int{1, 1, 8} {
+		path := filepath.Join(t.TempDir(), "test.kcf")
+		packPipeline(t, path, dir, files, workers)
+
+		entries, err := readSolid(path)
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if len(entries) != len(files)+1 {
+			t.Fatalf("%d workers: got %d files, want %d", workers,
+				len(entries), len(files)+1)
+		}
+		if entries[0].name != dir || entries[0].fileType != DIRECTORY {
+			t.Errorf("%d workers: got %s first", workers,
+				entries[0].name)
+		}
+		for i, f := range files {
+			e := entries[i+1]
+			if e.name != filepath.Join(dir, f.name) ||
+				e.data != string(f.data) {
+				t.Errorf("%d workers: file %d is %s, want %s", workers,
+					i+1, e.name, f.name)
+			}
+		}
+
+		archive, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, archive)
+	}
+
+	if !bytes.Equal(archives[1], archives[2]) {
+		t.Error("archives of different workers differ")
+	}
+}
+
+func TestPipelineError(t *testing.T) {
+	dir := t.TempDir()
+	paths, _ := writeFiles(t, dir, []string{"a", "b", "c"},
+		[]int{1000, 2000, 3000})
+
+	kcf, err := CreateNewArchive(filepath.Join(dir, "test.kcf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	// Filters need format version 2, so the worker packing the second
+	// file fails.
+	kcf.SetWriterOptions(WriterOptions{Version: 1})
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	lz4 := WriterOptions{Compression: compressionInfo(METHOD_LZ4, 0)}
+	delta := lz4
+	delta.Filters = []uint32{compressionInfo(METHOD_DELTA, 0)}
+
+	p := kcf.NewPipeline(4)
+	for i, path := range paths {
+		opts := lz4
+		if i == 1 {
+			opts = delta
+		}
+		if err = p.PackPath(path, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = p.Flush(); err != UnsupportedFeature {
+		t.Errorf("Flush returned %v, want %v", err, UnsupportedFeature)
+	}
+	if err = p.PackPath(paths[0], lz4); err != UnsupportedFeature {
+		t.Errorf("PackPath returned %v, want %v", err,
+			UnsupportedFeature)
+	}
+	if err = p.Close(); err != UnsupportedFeature {
+		t.Errorf("Close returned %v, want %v", err, UnsupportedFeature)
+	}
+	if err = p.Err(); err != UnsupportedFeature {
+		t.Errorf("Err returned %v, want %v", err, UnsupportedFeature)
+	}
+}
@@ -0,0 +1,1469 @@
+package kcf
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PPMd compresses data with the PPMd variant H model of Dmitry Shkarin,
+// as used by 7-Zip. It predicts each byte from the preceding ones and
+// suits text much better than LZ methods. Packed data is range coder
+// data terminated by the end marker, which is an escape from the order
+// -1 context.
+//
+// Parameters:
+//   - bits 0 to 5: model order, from 2 to 32;
+//   - bits 6 to 10: binary logarithm of the model memory size, from 16
+//     to 30.
+//
+// Zero fields select order 6 and 16 MiB of memory. When the memory is
+// exhausted, the model is restarted.
+type ppmdCodec struct{}
+
+const (
+	ppmdDefaultOrder  = 6
+	ppmdMinOrder      = 2
+	ppmdMaxOrderParam = 32
+	ppmdDefaultMemLog = 24
+	ppmdMinMemLog     = 16
+	ppmdMaxMemLog     = 30
+)
+
+func (ppmdCodec) name() string {
+	return "ppmd"
+}
+
+func unpackPpmdParams(params uint32) (order, memLog uint32, err error) {
+	order = params & 0x3F
+	if order == 0 {
+		order = ppmdDefaultOrder
+	}
+
+	memLog = (params >> 6) & 0x1F
+	if memLog == 0 {
+		memLog = ppmdDefaultMemLog
+	}
+
+	if order < ppmdMinOrder || order > ppmdMaxOrderParam ||
+		memLog < ppmdMinMemLog || memLog > ppmdMaxMemLog {
+		err = InvalidCompressionParams
+	}
+
+	return
+}
+
+func (ppmdCodec) parseParams(args []string) (params uint32, err error) {
+	var order, memLog uint32
+
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+
+		switch key {
+		case "order":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 8)
+			if err != nil || n < ppmdMinOrder || n > ppmdMaxOrderParam {
+				return 0, InvalidCompressionParams
+			}
+			order = uint32(n)
+		case "mem":
+			var size uint64
+			size, err = parseSize(value)
+			if err != nil {
+				return
+			}
+
+			memLog, err = log2Size(size, ppmdMinMemLog, ppmdMaxMemLog)
+			if err != nil {
+				return
+			}
+		default:
+			return 0, InvalidCompressionParams
+		}
+	}
+
+	if order == ppmdDefaultOrder {
+		order = 0
+	}
+	if memLog == ppmdDefaultMemLog {
+		memLog = 0
+	}
+
+	return order | memLog<<6, nil
+}
+
+func (ppmdCodec) formatParams(params uint32) string {
+	if params == 0 {
+		return ""
+	}
+
+	order, memLog, err := unpackPpmdParams(params)
+	if err != nil {
+		return "invalid"
+	}
+
+	return "order=" + strconv.Itoa(int(order)) +
+		",mem=" + formatSize(1<<memLog)
+}
+
+func (ppmdCodec) memoryUsage(params uint32) uint64 {
+	_, memLog, err := unpackPpmdParams(params)
+	if err != nil {
+		return 0
+	}
+
+	return 1<<memLog + ppmdUnitSize + 64<<10
+}
+
+func (ppmdCodec) newWriter(w io.Writer, params uint32) (
+	io.WriteCloser,
+	error,
+) {
+	order, memLog, err := unpackPpmdParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ppmdEncoder{w: w}
+	e.init(order, 1<<memLog)
+	e.re.init()
+
+	return e, nil
+}
+
+func (ppmdCodec) newReader(r io.Reader, params uint32) (io.Reader, error) {
+	order, memLog, err := unpackPpmdParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	d := &ppmdDecoder{}
+	d.init(order, 1<<memLog)
+	d.rd.r = br
+
+	return d, nil
+}
+
+const (
+	ppmdMaxOrder   = 64
+	ppmdIntBits    = 7
+	ppmdPeriodBits = 7
+	ppmdBinScale   = 1 << (ppmdIntBits + ppmdPeriodBits)
+	ppmdMaxFreq    = 124
+
+	ppmdUnitSize   = 12
+	ppmdStateSize  = 6
+	ppmdNumIndexes = 4 + 4 + 4 + 26
+
+	ppmdOutputLimit = 1 << 16
+)
+
+var ppmdInitBinEsc = [8]uint16{
+	0x3CDD, 0x1F3F, 0x59BF, 0x48F3, 0x64A1, 0x5ABC, 0x6632, 0x6051,
+}
+
+var ppmdExpEscape = [16]uint8{
+	25, 14, 9, 7, 5, 5, 4, 4, 4, 3, 3, 3, 2, 2, 2, 2,
+}
+
+// Tables of the model which do not depend on its state.
+var (
+	ppmdIndx2Units [ppmdNumIndexes]uint32
+	ppmdUnits2Indx [128]uint32
+	ppmdNS2Indx    [256]uint32
+	ppmdNS2BSIndx  [256]uint32
+	ppmdHB2Flag    [256]uint32
+)
+
+func init() {
+	k := 0
+	for i := 0; i < ppmdNumIndexes; i++ {
+		step := i/4 + 1
+		if i >= 12 {
+			step = 4
+		}
+
+		for ; step > 0; step-- {
+			ppmdUnits2Indx[k] = uint32(i)
+			k++
+		}
+		ppmdIndx2Units[i] = uint32(k)
+	}
+
+	ppmdNS2BSIndx[0] = 0 << 1
+	ppmdNS2BSIndx[1] = 1 << 1
+	for i := 2; i < 11; i++ {
+		ppmdNS2BSIndx[i] = 2 << 1
+	}
+	for i := 11; i < 256; i++ {
+		ppmdNS2BSIndx[i] = 3 << 1
+	}
+
+	m, step := uint32(3), 1
+	for i := 0; i < 256; i++ {
+		if i < 3 {
+			ppmdNS2Indx[i] = uint32(i)
+			continue
+		}
+
+		ppmdNS2Indx[i] = m
+		step--
+		if step == 0 {
+			m++
+			step = int(m) - 2
+		}
+	}
+
+	for i := 0x40; i < 256; i++ {
+		ppmdHB2Flag[i] = 8
+	}
+}
+
+// ppmdMemPool keeps model memory of finished coders. The model does not
+// depend on the initial contents of its memory, so it is reused as is.
+var ppmdMemPool sync.Pool
+
+// ppmdSee is an adaptive estimator of escape frequencies.
+type ppmdSee struct {
+	summ  uint16
+	shift uint8
+	count uint8
+}
+
+func (see *ppmdSee) update() {
+	if see.shift < ppmdPeriodBits {
+		see.count--
+		if see.count == 0 {
+			see.summ <<= 1
+			see.count = uint8(3 << see.shift)
+			see.shift++
+		}
+	}
+}
+
+// ppmdModel is the PPMd model shared by the encoder and the decoder.
+//
+// Contexts and symbol states are kept in mem and referred to by their
+// offsets, zero meaning none. A context takes one unit of 12 bytes:
+// NumStats and SummFreq (2 bytes each), Stats and Suffix (4 bytes
+// each). A context with one symbol keeps its state in place of
+// SummFreq and Stats. A state takes 6 bytes: Symbol, Freq and
+// Successor (4 bytes). A successor is either a context or, until the
+// context is needed, the position in the text area which follows the
+// symbol.
+//
+// The text area grows from the bottom of mem up to unitsStart. Units
+// are allocated above it, states from loUnit upwards and contexts from
+// hiUnit downwards, and are returned to free lists by size.
+type ppmdModel struct {
+	mem         []byte
+	size        uint32
+	alignOffset uint32
+
+	minContext uint32
+	maxContext uint32
+	foundState uint32
+
+	orderFall   uint32
+	initEsc     uint32
+	prevSuccess uint32
+	maxOrder    uint32
+	hiBitsFlag  uint32
+	runLength   int32
+	initRL      int32
+
+	glueCount  uint32
+	text       uint32
+	loUnit     uint32
+	hiUnit     uint32
+	unitsStart uint32
+	freeList   [ppmdNumIndexes]uint32
+
+	dummySee ppmdSee
+	see      [25][16]ppmdSee
+	binSumm  [128][64]uint16
+
+	charMask [256]uint8
+}
+
+func (m *ppmdModel) init(order, size uint32) {
+	m.size = size
+	m.alignOffset = 4 - size&3
+
+	n := int(m.alignOffset + size + ppmdUnitSize)
+	if mem, ok := ppmdMemPool.Get().(*[]byte); ok && cap(*mem) >= n {
+		m.mem = (*mem)[:n]
+	} else {
+		m.mem = make([]byte, n)
+	}
+
+	m.maxOrder = order
+	m.restartModel()
+	m.dummySee.shift = ppmdPeriodBits
+	m.dummySee.count = 64
+}
+
+// release returns memory of the model to the pool.
+func (m *ppmdModel) release() {
+	if mem := m.mem; mem != nil {
+		ppmdMemPool.Put(&mem)
+		m.mem = nil
+	}
+}
+
+func (m *ppmdModel) u16(off uint32) uint32 {
+	return uint32(le.Uint16(m.mem[off:]))
+}
+
+func (m *ppmdModel) setU16(off uint32, v uint32) {
+	le.PutUint16(m.mem[off:], uint16(v))
+}
+
+func (m *ppmdModel) u32(off uint32) uint32 {
+	return le.Uint32(m.mem[off:])
+}
+
+func (m *ppmdModel) setU32(off uint32, v uint32) {
+	le.PutUint32(m.mem[off:], v)
+}
+
+// Fields of contexts.
+
+func (m *ppmdModel) numStats(c uint32) uint32  { return m.u16(c) }
+func (m *ppmdModel) setNumStats(c, v uint32)   { m.setU16(c, v) }
+func (m *ppmdModel) summFreq(c uint32) uint32  { return m.u16(c + 2) }
+func (m *ppmdModel) setSummFreq(c, v uint32)   { m.setU16(c+2, v) }
+func (m *ppmdModel) stats(c uint32) uint32     { return m.u32(c + 4) }
+func (m *ppmdModel) setStats(c, v uint32)      { m.setU32(c+4, v) }
+func (m *ppmdModel) suffix(c uint32) uint32    { return m.u32(c + 8) }
+func (m *ppmdModel) setSuffix(c, v uint32)     { m.setU32(c+8, v) }
+func (m *ppmdModel) oneState(c uint32) uint32  { return c + 2 }
+func (m *ppmdModel) symbol(s uint32) uint32    { return uint32(m.mem[s]) }
+func (m *ppmdModel) freq(s uint32) uint32      { return uint32(m.mem[s+1]) }
+func (m *ppmdModel) setFreq(s, v uint32)       { m.mem[s+1] = byte(v) }
+func (m *ppmdModel) successor(s uint32) uint32 { return m.u32(s + 2) }
+func (m *ppmdModel) setSuccessor(s, v uint32)  { m.setU32(s+2, v) }
+
+func (m *ppmdModel) copyState(dst, src uint32) {
+	copy(m.mem[dst:dst+ppmdStateSize], m.mem[src:])
+}
+
+func (m *ppmdModel) copyUnits(dst, src, nu uint32) {
+	copy(m.mem[dst:dst+nu*ppmdUnitSize], m.mem[src:])
+}
+
+// findState returns the state of the symbol in the context with more
+// than one symbol, which must be present there.
+func (m *ppmdModel) findState(c, symbol uint32) (s uint32) {
+	for s = m.stats(c); m.symbol(s) != symbol; s += ppmdStateSize {
+	}
+	return
+}
+
+func (m *ppmdModel) swapStates(s1, s2 uint32) {
+	var tmp [ppmdStateSize]byte
+	copy(tmp[:], m.mem[s1:])
+	copy(m.mem[s1:s1+ppmdStateSize], m.mem[s2:])
+	copy(m.mem[s2:s2+ppmdStateSize], tmp[:])
+}
+
+// Fields of free blocks, which are linked into a list while gluing.
+
+func (m *ppmdModel) stamp(n uint32) uint32     { return m.u16(n) }
+func (m *ppmdModel) setStamp(n, v uint32)      { m.setU16(n, v) }
+func (m *ppmdModel) nodeUnits(n uint32) uint32 { return m.u16(n + 2) }
+func (m *ppmdModel) setNodeUnits(n, v uint32)  { m.setU16(n+2, v) }
+func (m *ppmdModel) next(n uint32) uint32      { return m.u32(n + 4) }
+func (m *ppmdModel) setNext(n, v uint32)       { m.setU32(n+4, v) }
+func (m *ppmdModel) prev(n uint32) uint32      { return m.u32(n + 8) }
+func (m *ppmdModel) setPrev(n, v uint32)       { m.setU32(n+8, v) }
+
+func ppmdU2I(nu uint32) uint32 {
+	return ppmdUnits2Indx[nu-1]
+}
+
+func ppmdI2U(indx uint32) uint32 {
+	return ppmdIndx2Units[indx]
+}
+
+func (m *ppmdModel) insertNode(node, indx uint32) {
+	m.setU32(node, m.freeList[indx])
+	m.freeList[indx] = node
+}
+
+func (m *ppmdModel) removeNode(indx uint32) uint32 {
+	node := m.freeList[indx]
+	m.freeList[indx] = m.u32(node)
+	return node
+}
+
+// splitBlock returns the rest of the block after newIndx units to the
+// free lists.
+func (m *ppmdModel) splitBlock(ptr, oldIndx, newIndx uint32) {
+	nu := ppmdI2U(oldIndx) - ppmdI2U(newIndx)
+	ptr += ppmdI2U(newIndx) * ppmdUnitSize
+
+	i := ppmdU2I(nu)
+	if ppmdI2U(i) != nu {
+		i--
+		k := ppmdI2U(i)
+		m.insertNode(ptr+k*ppmdUnitSize, nu-k-1)
+	}
+
+	m.insertNode(ptr, i)
+}
+
+// glueFreeBlocks merges adjacent free blocks. Used units never start
+// with two zero bytes, so free blocks are marked by zero stamps.
+func (m *ppmdModel) glueFreeBlocks() {
+	head := m.alignOffset + m.size
+	n := head
+
+	m.glueCount = 255
+
+	// Make a doubly linked list of free blocks.
+	for i := uint32(0); i < ppmdNumIndexes; i++ {
+		nu := ppmdI2U(i)
+		next := m.freeList[i]
+		m.freeList[i] = 0
+
+		for next != 0 {
+			node := next
+			m.setNext(node, n)
+			m.setPrev(n, next)
+			n = next
+			next = m.u32(node)
+			m.setStamp(node, 0)
+			m.setNodeUnits(node, nu)
+		}
+	}
+
+	m.setStamp(head, 1)
+	m.setNext(head, n)
+	m.setPrev(n, head)
+	if m.loUnit != m.hiUnit {
+		m.setStamp(m.loUnit, 1)
+	}
+
+	// Glue adjacent free blocks.
+	for n != head {
+		node := n
+		nu := m.nodeUnits(node)
+
+		for {
+			node2 := node + nu*ppmdUnitSize
+			nu += m.nodeUnits(node2)
+			if m.stamp(node2) != 0 || nu >= 0x10000 {
+				break
+			}
+
+			m.setNext(m.prev(node2), m.next(node2))
+			m.setPrev(m.next(node2), m.prev(node2))
+			m.setNodeUnits(node, nu)
+		}
+
+		n = m.next(node)
+	}
+
+	// Fill free lists.
+	for n = m.next(head); n != head; {
+		node := n
+		next := m.next(node)
+
+		nu := m.nodeUnits(node)
+		for ; nu > 128; nu -= 128 {
+			m.insertNode(node, ppmdNumIndexes-1)
+			node += 128 * ppmdUnitSize
+		}
+
+		i := ppmdU2I(nu)
+		if ppmdI2U(i) != nu {
+			i--
+			k := ppmdI2U(i)
+			m.insertNode(node+k*ppmdUnitSize, nu-k-1)
+		}
+		m.insertNode(node, i)
+
+		n = next
+	}
+}
+
+// allocUnitsRare allocates units when the free list of their size is
+// empty and there is no room between loUnit and hiUnit. It returns
+// zero if memory is exhausted.
+func (m *ppmdModel) allocUnitsRare(indx uint32) uint32 {
+	if m.glueCount == 0 {
+		m.glueFreeBlocks()
+		if m.freeList[indx] != 0 {
+			return m.removeNode(indx)
+		}
+	}
+
+	i := indx
+	for {
+		i++
+		if i == ppmdNumIndexes {
+			numBytes := ppmdI2U(indx) * ppmdUnitSize
+			m.glueCount--
+			if m.unitsStart-m.text > numBytes {
+				m.unitsStart -= numBytes
+				return m.unitsStart
+			}
+			return 0
+		}
+
+		if m.freeList[i] != 0 {
+			break
+		}
+	}
+
+	block := m.removeNode(i)
+	m.splitBlock(block, i, indx)
+	return block
+}
+
+func (m *ppmdModel) allocUnits(indx uint32) uint32 {
+	if m.freeList[indx] != 0 {
+		return m.removeNode(indx)
+	}
+
+	numBytes := ppmdI2U(indx) * ppmdUnitSize
+	if numBytes <= m.hiUnit-m.loUnit {
+		block := m.loUnit
+		m.loUnit += numBytes
+		return block
+	}
+
+	return m.allocUnitsRare(indx)
+}
+
+func (m *ppmdModel) allocContext() uint32 {
+	if m.hiUnit != m.loUnit {
+		m.hiUnit -= ppmdUnitSize
+		return m.hiUnit
+	}
+
+	if m.freeList[0] != 0 {
+		return m.removeNode(0)
+	}
+
+	return m.allocUnitsRare(0)
+}
+
+func (m *ppmdModel) shrinkUnits(old, oldNU, newNU uint32) uint32 {
+	i0 := ppmdU2I(oldNU)
+	i1 := ppmdU2I(newNU)
+	if i0 == i1 {
+		return old
+	}
+
+	if m.freeList[i1] != 0 {
+		block := m.removeNode(i1)
+		m.copyUnits(block, old, newNU)
+		m.insertNode(old, i0)
+		return block
+	}
+
+	m.splitBlock(old, i0, i1)
+	return old
+}
+
+func (m *ppmdModel) restartModel() {
+	clear(m.freeList[:])
+
+	m.text = m.alignOffset
+	m.hiUnit = m.text + m.size
+	m.loUnit = m.hiUnit - m.size/8/ppmdUnitSize*7*ppmdUnitSize
+	m.unitsStart = m.loUnit
+	m.glueCount = 0
+
+	m.orderFall = m.maxOrder
+	m.initRL = -int32(min(m.maxOrder, 12)) - 1
+	m.runLength = m.initRL
+	m.prevSuccess = 0
+	m.initEsc = 0
+
+	m.hiUnit -= ppmdUnitSize
+	m.minContext = m.hiUnit
+	m.maxContext = m.hiUnit
+	m.setSuffix(m.minContext, 0)
+	m.setNumStats(m.minContext, 256)
+	m.setSummFreq(m.minContext, 256+1)
+
+	m.foundState = m.loUnit
+	m.setStats(m.minContext, m.foundState)
+	m.loUnit += 256 / 2 * ppmdUnitSize
+	for i := uint32(0); i < 256; i++ {
+		s := m.foundState + i*ppmdStateSize
+		m.mem[s] = byte(i)
+		m.setFreq(s, 1)
+		m.setSuccessor(s, 0)
+	}
+
+	for i := range m.binSumm {
+		for k, esc := range ppmdInitBinEsc {
+			val := uint16(ppmdBinScale - uint32(esc)/uint32(i+2))
+			for j := 0; j < 64; j += 8 {
+				m.binSumm[i][k+j] = val
+			}
+		}
+	}
+
+	for i := range m.see {
+		for k := range m.see[i] {
+			m.see[i][k] = ppmdSee{
+				summ:  uint16((5*i + 10) << (ppmdPeriodBits - 4)),
+				shift: ppmdPeriodBits - 4,
+				count: 4,
+			}
+		}
+	}
+}
+
+// createSuccessors creates contexts for the found symbol in the chain
+// of suffixes up to the one which already has them. It returns zero if
+// memory is exhausted.
+func (m *ppmdModel) createSuccessors(skip bool) uint32 {
+	c := m.minContext
+	upBranch := m.successor(m.foundState)
+	symbol := m.symbol(m.foundState)
+
+	var ps [ppmdMaxOrder]uint32
+	numPs := 0
+	if !skip {
+		ps[numPs] = m.foundState
+		numPs++
+	}
+
+	for m.suffix(c) != 0 {
+		c = m.suffix(c)
+
+		var s uint32
+		if m.numStats(c) != 1 {
+			s = m.findState(c, symbol)
+		} else {
+			s = m.oneState(c)
+		}
+
+		if succ := m.successor(s); succ != upBranch {
+			c = succ
+			if numPs == 0 {
+				return c
+			}
+			break
+		}
+
+		ps[numPs] = s
+		numPs++
+	}
+
+	upSymbol := uint32(m.mem[upBranch])
+	var upFreq uint32
+	if m.numStats(c) == 1 {
+		upFreq = m.freq(m.oneState(c))
+	} else {
+		s := m.findState(c, upSymbol)
+		cf := m.freq(s) - 1
+		s0 := m.summFreq(c) - m.numStats(c) - cf
+
+		upFreq = 1
+		if 2*cf <= s0 {
+			if 5*cf > s0 {
+				upFreq++
+			}
+		} else {
+			upFreq += (2*cf + 3*s0 - 1) / (2 * s0)
+		}
+	}
+
+	for numPs > 0 {
+		c1 := m.allocContext()
+		if c1 == 0 {
+			return 0
+		}
+
+		m.setNumStats(c1, 1)
+		s := m.oneState(c1)
+		m.mem[s] = byte(upSymbol)
+		m.setFreq(s, upFreq)
+		m.setSuccessor(s, upBranch+1)
+		m.setSuffix(c1, c)
+
+		numPs--
+		m.setSuccessor(ps[numPs], c1)
+		c = c1
+	}
+
+	return c
+}
+
+// updateModel adds the found symbol to contexts from maxContext down to
+// minContext, where it has been found, and moves to the next context.
+func (m *ppmdModel) updateModel() {
+	fs := m.foundState
+	fSymbol := m.symbol(fs)
+	fFreq := m.freq(fs)
+	fSuccessor := m.successor(fs)
+
+	if fFreq < ppmdMaxFreq/4 && m.suffix(m.minContext) != 0 {
+		c := m.suffix(m.minContext)
+
+		if m.numStats(c) == 1 {
+			s := m.oneState(c)
+			if m.freq(s) < 32 {
+				m.setFreq(s, m.freq(s)+1)
+			}
+		} else {
+			s := m.stats(c)
+			if m.symbol(s) != fSymbol {
+				s = m.findState(c, fSymbol)
+				if m.freq(s) >= m.freq(s-ppmdStateSize) {
+					m.swapStates(s, s-ppmdStateSize)
+					s -= ppmdStateSize
+				}
+			}
+
+			if m.freq(s) < ppmdMaxFreq-9 {
+				m.setFreq(s, m.freq(s)+2)
+				m.setSummFreq(c, m.summFreq(c)+2)
+			}
+		}
+	}
+
+	if m.orderFall == 0 {
+		m.minContext = m.createSuccessors(true)
+		m.maxContext = m.minContext
+		if m.minContext == 0 {
+			m.restartModel()
+			return
+		}
+
+		m.setSuccessor(m.foundState, m.minContext)
+		return
+	}
+
+	m.mem[m.text] = byte(fSymbol)
+	m.text++
+	successor := m.text
+	if m.text >= m.unitsStart {
+		m.restartModel()
+		return
+	}
+
+	if fSuccessor != 0 {
+		if fSuccessor <= successor {
+			cs := m.createSuccessors(false)
+			if cs == 0 {
+				m.restartModel()
+				return
+			}
+			fSuccessor = cs
+		}
+
+		m.orderFall--
+		if m.orderFall == 0 {
+			successor = fSuccessor
+			if m.maxContext != m.minContext {
+				m.text--
+			}
+		}
+	} else {
+		m.setSuccessor(m.foundState, successor)
+		fSuccessor = m.minContext
+	}
+
+	ns := m.numStats(m.minContext)
+	s0 := m.summFreq(m.minContext) - ns - (fFreq - 1)
+
+	for c := m.maxContext; c != m.minContext; c = m.suffix(c) {
+		ns1 := m.numStats(c)
+
+		if ns1 != 1 {
+			if ns1&1 == 0 {
+				// The array of states is full, grow it by a unit.
+				oldNU := ns1 >> 1
+				i := ppmdU2I(oldNU)
+				if i != ppmdU2I(oldNU+1) {
+					block := m.allocUnits(i + 1)
+					if block == 0 {
+						m.restartModel()
+						return
+					}
+
+					old := m.stats(c)
+					m.copyUnits(block, old, oldNU)
+					m.insertNode(old, i)
+					m.setStats(c, block)
+				}
+			}
+
+			sf := m.summFreq(c)
+			if 2*ns1 < ns {
+				sf++
+			}
+			if 4*ns1 <= ns && m.summFreq(c) <= 8*ns1 {
+				sf += 2
+			}
+			m.setSummFreq(c, sf)
+		} else {
+			s := m.allocUnits(0)
+			if s == 0 {
+				m.restartModel()
+				return
+			}
+
+			m.copyState(s, m.oneState(c))
+			m.setStats(c, s)
+
+			freq := m.freq(s)
+			if freq < ppmdMaxFreq/4-1 {
+				freq <<= 1
+			} else {
+				freq = ppmdMaxFreq - 4
+			}
+			m.setFreq(s, freq)
+
+			sf := freq + m.initEsc
+			if ns > 3 {
+				sf++
+			}
+			m.setSummFreq(c, sf)
+		}
+
+		cf := 2 * fFreq * (m.summFreq(c) + 6)
+		sf := s0 + m.summFreq(c)
+		if cf < 6*sf {
+			n := uint32(1)
+			if cf > sf {
+				n++
+			}
+			if cf >= 4*sf {
+				n++
+			}
+			cf = n
+			m.setSummFreq(c, m.summFreq(c)+3)
+		} else {
+			n := uint32(4)
+			if cf >= 9*sf {
+				n++
+			}
+			if cf >= 12*sf {
+				n++
+			}
+			if cf >= 15*sf {
+				n++
+			}
+			cf = n
+			m.setSummFreq(c, m.summFreq(c)+cf)
+		}
+
+		s := m.stats(c) + ns1*ppmdStateSize
+		m.setSuccessor(s, successor)
+		m.mem[s] = byte(fSymbol)
+		m.setFreq(s, cf)
+		m.setNumStats(c, ns1+1)
+	}
+
+	m.maxContext = fSuccessor
+	m.minContext = fSuccessor
+}
+
+// rescale halves frequencies of the current context and drops symbols
+// whose frequency becomes zero.
+func (m *ppmdModel) rescale() {
+	mc := m.minContext
+	stats := m.stats(mc)
+	s := m.foundState
+
+	// Move the found state to the front.
+	var tmp [ppmdStateSize]byte
+	copy(tmp[:], m.mem[s:])
+	for ; s != stats; s -= ppmdStateSize {
+		m.copyState(s, s-ppmdStateSize)
+	}
+	copy(m.mem[s:], tmp[:])
+
+	escFreq := m.summFreq(mc) - m.freq(s)
+	adder := uint32(0)
+	if m.orderFall != 0 {
+		adder = 1
+	}
+	m.setFreq(s, (m.freq(s)+4+adder)>>1)
+	sumFreq := m.freq(s)
+
+	i := m.numStats(mc) - 1
+	for ; i > 0; i-- {
+		s += ppmdStateSize
+		escFreq -= m.freq(s)
+		m.setFreq(s, (m.freq(s)+adder)>>1)
+		sumFreq += m.freq(s)
+
+		if m.freq(s) > m.freq(s-ppmdStateSize) {
+			copy(tmp[:], m.mem[s:])
+			s1 := s
+			for {
+				m.copyState(s1, s1-ppmdStateSize)
+				s1 -= ppmdStateSize
+				if s1 == stats || uint32(tmp[1]) <= m.freq(s1-ppmdStateSize) {
+					break
+				}
+			}
+			copy(m.mem[s1:], tmp[:])
+		}
+	}
+
+	if m.freq(s) == 0 {
+		numStats := m.numStats(mc)
+		for {
+			i++
+			s -= ppmdStateSize
+			if m.freq(s) != 0 {
+				break
+			}
+		}
+
+		escFreq += i
+		m.setNumStats(mc, numStats-i)
+		if m.numStats(mc) == 1 {
+			copy(tmp[:], m.mem[stats:])
+			freq := uint32(tmp[1])
+			for {
+				freq -= freq >> 1
+				escFreq >>= 1
+				if escFreq <= 1 {
+					break
+				}
+			}
+			tmp[1] = byte(freq)
+
+			m.insertNode(stats, ppmdU2I((numStats+1)>>1))
+			m.foundState = m.oneState(mc)
+			copy(m.mem[m.foundState:], tmp[:])
+			return
+		}
+
+		n0 := (numStats + 1) >> 1
+		n1 := (m.numStats(mc) + 1) >> 1
+		if n0 != n1 {
+			m.setStats(mc, m.shrinkUnits(stats, n0, n1))
+		}
+	}
+
+	m.setSummFreq(mc, sumFreq+escFreq-escFreq>>1)
+	m.foundState = m.stats(mc)
+}
+
+// makeEscFreq returns the estimator of the escape frequency of the
+// current context with numMasked symbols excluded, and the frequency.
+func (m *ppmdModel) makeEscFreq(numMasked uint32) (*ppmdSee, uint32) {
+	mc := m.minContext
+	numStats := m.numStats(mc)
+	if numStats == 256 {
+		return &m.dummySee, 1
+	}
+
+	nonMasked := numStats - numMasked
+	k := m.hiBitsFlag
+	if nonMasked < m.numStats(m.suffix(mc))-numStats {
+		k++
+	}
+	if m.summFreq(mc) < 11*numStats {
+		k += 2
+	}
+	if numMasked > nonMasked {
+		k += 4
+	}
+
+	see := &m.see[ppmdNS2Indx[nonMasked-1]][k]
+	r := uint32(see.summ >> see.shift)
+	see.summ -= uint16(r)
+	if r == 0 {
+		r = 1
+	}
+
+	return see, r
+}
+
+func (m *ppmdModel) nextContext() {
+	c := m.successor(m.foundState)
+	if m.orderFall == 0 && c > m.text {
+		m.minContext = c
+		m.maxContext = c
+	} else {
+		m.updateModel()
+	}
+}
+
+// update1 updates the model after a symbol other than the first one was
+// found in the current context.
+func (m *ppmdModel) update1() {
+	s := m.foundState
+	m.setFreq(s, m.freq(s)+4)
+	m.setSummFreq(m.minContext, m.summFreq(m.minContext)+4)
+
+	if m.freq(s) > m.freq(s-ppmdStateSize) {
+		m.swapStates(s, s-ppmdStateSize)
+		s -= ppmdStateSize
+		m.foundState = s
+		if m.freq(s) > ppmdMaxFreq {
+			m.rescale()
+		}
+	}
+
+	m.nextContext()
+}
+
+// update1First updates the model after the first symbol of the current
+// context was found.
+func (m *ppmdModel) update1First() {
+	s := m.foundState
+	mc := m.minContext
+
+	m.prevSuccess = 0
+	if 2*m.freq(s) > m.summFreq(mc) {
+		m.prevSuccess = 1
+	}
+	m.runLength += int32(m.prevSuccess)
+	m.setSummFreq(mc, m.summFreq(mc)+4)
+
+	m.setFreq(s, m.freq(s)+4)
+	if m.freq(s) > ppmdMaxFreq {
+		m.rescale()
+	}
+
+	m.nextContext()
+}
+
+// updateBin updates the model after the symbol of a binary context was
+// found.
+func (m *ppmdModel) updateBin() {
+	s := m.foundState
+	if m.freq(s) < 128 {
+		m.setFreq(s, m.freq(s)+1)
+	}
+
+	m.prevSuccess = 1
+	m.runLength++
+	m.nextContext()
+}
+
+// update2 updates the model after a symbol was found following escapes.
+func (m *ppmdModel) update2() {
+	s := m.foundState
+	m.setFreq(s, m.freq(s)+4)
+	m.setSummFreq(m.minContext, m.summFreq(m.minContext)+4)
+	if m.freq(s) > ppmdMaxFreq {
+		m.rescale()
+	}
+
+	m.runLength = m.initRL
+	m.updateModel()
+}
+
+// binProb returns the probability of the symbol of the current binary
+// context.
+func (m *ppmdModel) binProb() *uint16 {
+	s := m.oneState(m.minContext)
+	m.hiBitsFlag = ppmdHB2Flag[m.symbol(m.foundState)]
+
+	i := m.freq(s) - 1
+	j := m.prevSuccess +
+		ppmdNS2BSIndx[m.numStats(m.suffix(m.minContext))-1] +
+		m.hiBitsFlag + 2*ppmdHB2Flag[m.symbol(s)] +
+		uint32((m.runLength>>26)&0x20)
+
+	return &m.binSumm[i][j]
+}
+
+func ppmdUpdateProb0(prob uint16) uint16 {
+	return prob + 1<<ppmdIntBits - ppmdGetMean(prob)
+}
+
+func ppmdUpdateProb1(prob uint16) uint16 {
+	return prob - ppmdGetMean(prob)
+}
+
+func ppmdGetMean(prob uint16) uint16 {
+	return (prob + 1<<(ppmdPeriodBits-2)) >> ppmdPeriodBits
+}
+
+// maskContext excludes symbols of the current context from contexts
+// visited after an escape.
+func (m *ppmdModel) maskContext() {
+	for i := range m.charMask {
+		m.charMask[i] = 0xFF
+	}
+
+	mc := m.minContext
+	if m.numStats(mc) == 1 {
+		m.charMask[m.symbol(m.oneState(mc))] = 0
+		return
+	}
+
+	s := m.stats(mc)
+	for i := uint32(0); i < m.numStats(mc); i++ {
+		m.charMask[m.symbol(s)] = 0
+		s += ppmdStateSize
+	}
+}
+
+// escape moves to the nearest suffix context with unmasked symbols. It
+// returns false after an escape from the order -1 context.
+func (m *ppmdModel) escape() bool {
+	numMasked := m.numStats(m.minContext)
+
+	for {
+		m.orderFall++
+		if m.suffix(m.minContext) == 0 {
+			return false
+		}
+
+		m.minContext = m.suffix(m.minContext)
+		if m.numStats(m.minContext) != numMasked {
+			return true
+		}
+	}
+}
+
+func (re *rangeEncoder) encode(start, size, total uint32) {
+	re.rng /= total
+	re.low += uint64(start) * uint64(re.rng)
+	re.rng *= size
+
+	for re.rng < rangeTopValue {
+		re.rng <<= 8
+		re.shiftLow()
+	}
+}
+
+func (re *rangeEncoder) encodeBinary(size0, bit uint32) {
+	bound := (re.rng >> (ppmdIntBits + ppmdPeriodBits)) * size0
+	if bit == 0 {
+		re.rng = bound
+	} else {
+		re.low += uint64(bound)
+		re.rng -= bound
+	}
+
+	for re.rng < rangeTopValue {
+		re.rng <<= 8
+		re.shiftLow()
+	}
+}
+
+func (rd *rangeDecoder) threshold(total uint32) uint32 {
+	rd.rng /= total
+	return rd.code / rd.rng
+}
+
+func (rd *rangeDecoder) decode(start, size uint32) {
+	rd.code -= start * rd.rng
+	rd.rng *= size
+
+	for rd.rng < rangeTopValue {
+		rd.normalize()
+	}
+}
+
+func (rd *rangeDecoder) decodeBinary(size0 uint32) (bit uint32) {
+	bound := (rd.rng >> (ppmdIntBits + ppmdPeriodBits)) * size0
+	if rd.code < bound {
+		rd.rng = bound
+	} else {
+		rd.code -= bound
+		rd.rng -= bound
+		bit = 1
+	}
+
+	for rd.rng < rangeTopValue {
+		rd.normalize()
+	}
+
+	return
+}
+
+type ppmdEncoder struct {
+	ppmdModel
+	re  rangeEncoder
+	w   io.Writer
+	err error
+}
+
+func (e *ppmdEncoder) Write(p []byte) (n int, err error) {
+	for n < len(p) && e.err == nil {
+		chunk := p[n:min(len(p), n+ppmdOutputLimit)]
+		for _, b := range chunk {
+			e.encodeSymbol(int(b))
+		}
+		n += len(chunk)
+
+		if len(e.re.out) >= ppmdOutputLimit {
+			e.writeOutput()
+		}
+	}
+
+	return n, e.err
+}
+
+// Close encodes the end marker.
+func (e *ppmdEncoder) Close() error {
+	if e.err == nil {
+		e.encodeSymbol(-1)
+		e.re.flush()
+		e.writeOutput()
+	}
+
+	e.release()
+	return e.err
+}
+
+func (e *ppmdEncoder) writeOutput() {
+	if e.err == nil && len(e.re.out) > 0 {
+		_, e.err = e.w.Write(e.re.out)
+		e.re.out = e.re.out[:0]
+	}
+}
+
+// encodeSymbol encodes a byte, or the end marker if symbol is -1.
+func (e *ppmdEncoder) encodeSymbol(symbol int) {
+	re := &e.re
+	mc := e.minContext
+
+	if e.numStats(mc) != 1 {
+		s := e.stats(mc)
+		summFreq := e.summFreq(mc)
+
+		if int(e.symbol(s)) == symbol {
+			re.encode(0, e.freq(s), summFreq)
+			e.foundState = s
+			e.update1First()
+			return
+		}
+
+		e.prevSuccess = 0
+		sum := e.freq(s)
+		for i := e.numStats(mc) - 1; i > 0; i-- {
+			s += ppmdStateSize
+			if int(e.symbol(s)) == symbol {
+				re.encode(sum, e.freq(s), summFreq)
+				e.foundState = s
+				e.update1()
+				return
+			}
+			sum += e.freq(s)
+		}
+
+		e.hiBitsFlag = ppmdHB2Flag[e.symbol(e.foundState)]
+		e.maskContext()
+		re.encode(sum, summFreq-sum, summFreq)
+	} else {
+		prob := e.binProb()
+		s := e.oneState(mc)
+
+		if int(e.symbol(s)) == symbol {
+			re.encodeBinary(uint32(*prob), 0)
+			*prob = ppmdUpdateProb0(*prob)
+			e.foundState = s
+			e.updateBin()
+			return
+		}
+
+		re.encodeBinary(uint32(*prob), 1)
+		*prob = ppmdUpdateProb1(*prob)
+		e.initEsc = uint32(ppmdExpEscape[*prob>>10])
+		e.maskContext()
+		e.prevSuccess = 0
+	}
+
+	for {
+		numMasked := e.numStats(e.minContext)
+		if !e.escape() {
+			return
+		}
+
+		see, escFreq := e.makeEscFreq(numMasked)
+		mc := e.minContext
+		s := e.stats(mc)
+		sum := uint32(0)
+
+		for i := e.numStats(mc); i > 0; i-- {
+			cur := e.symbol(s)
+			if int(cur) == symbol {
+				low := sum
+				found := s
+				for ; i > 0; i-- {
+					sum += e.freq(s) & uint32(int8(e.charMask[e.symbol(s)]))
+					s += ppmdStateSize
+				}
+
+				re.encode(low, e.freq(found), sum+escFreq)
+				see.update()
+				e.foundState = found
+				e.update2()
+				return
+			}
+
+			sum += e.freq(s) & uint32(int8(e.charMask[cur]))
+			e.charMask[cur] = 0
+			s += ppmdStateSize
+		}
+
+		re.encode(sum, escFreq, sum+escFreq)
+		see.summ += uint16(sum + escFreq)
+	}
+}
+
+type ppmdDecoder struct {
+	ppmdModel
+	rd      rangeDecoder
+	started bool
+	eos     bool
+	states  [256]uint32
+}
+
+func (d *ppmdDecoder) Read(p []byte) (n int, err error) {
+	if !d.started {
+		d.rd.init()
+		d.started = true
+	}
+
+	for n < len(p) && !d.eos {
+		symbol := d.decodeSymbol()
+		if d.rd.err != nil {
+			return n, d.rd.err
+		}
+
+		switch {
+		case symbol == -1:
+			d.eos = true
+			d.release()
+		case symbol < 0:
+			return n, InvalidAddedData
+		default:
+			p[n] = byte(symbol)
+			n++
+		}
+	}
+
+	if n == 0 && d.eos {
+		return 0, io.EOF
+	}
+
+	return
+}
+
+// decodeSymbol returns the decoded byte, -1 for the end marker or -2
+// for invalid data.
+func (d *ppmdDecoder) decodeSymbol() int {
+	rd := &d.rd
+	mc := d.minContext
+
+	if d.numStats(mc) != 1 {
+		s := d.stats(mc)
+		summFreq := d.summFreq(mc)
+
+		count := rd.threshold(summFreq)
+		hiCnt := d.freq(s)
+		if count < hiCnt {
+			rd.decode(0, hiCnt)
+			d.foundState = s
+			symbol := int(d.symbol(s))
+			d.update1First()
+			return symbol
+		}
+
+		d.prevSuccess = 0
+		for i := d.numStats(mc) - 1; i > 0; i-- {
+			s += ppmdStateSize
+			hiCnt += d.freq(s)
+			if hiCnt > count {
+				rd.decode(hiCnt-d.freq(s), d.freq(s))
+				d.foundState = s
+				symbol := int(d.symbol(s))
+				d.update1()
+				return symbol
+			}
+		}
+
+		if count >= summFreq {
+			return -2
+		}
+
+		d.hiBitsFlag = ppmdHB2Flag[d.symbol(d.foundState)]
+		rd.decode(hiCnt, summFreq-hiCnt)
+		d.maskContext()
+	} else {
+		prob := d.binProb()
+		if rd.decodeBinary(uint32(*prob)) == 0 {
+			*prob = ppmdUpdateProb0(*prob)
+			d.foundState = d.oneState(mc)
+			symbol := int(d.symbol(d.foundState))
+			d.updateBin()
+			return symbol
+		}
+
+		*prob = ppmdUpdateProb1(*prob)
+		d.initEsc = uint32(ppmdExpEscape[*prob>>10])
+		d.maskContext()
+		d.prevSuccess = 0
+	}
+
+	for {
+		numMasked := d.numStats(d.minContext)
+		if !d.escape() {
+			return -1
+		}
+
+		mc := d.minContext
+		s := d.stats(mc)
+		num := d.numStats(mc) - numMasked
+		hiCnt := uint32(0)
+
+		for i := uint32(0); i < num; s += ppmdStateSize {
+			if d.charMask[d.symbol(s)] != 0 {
+				hiCnt += d.freq(s)
+				d.states[i] = s
+				i++
+			}
+		}
+
+		see, freqSum := d.makeEscFreq(numMasked)
+		freqSum += hiCnt
+
+		count := rd.threshold(freqSum)
+		if count < hiCnt {
+			i := 0
+			hiCnt = d.freq(d.states[0])
+			for hiCnt <= count {
+				i++
+				hiCnt += d.freq(d.states[i])
+			}
+
+			s = d.states[i]
+			rd.decode(hiCnt-d.freq(s), d.freq(s))
+			see.update()
+			d.foundState = s
+			symbol := int(d.symbol(s))
+			d.update2()
+			return symbol
+		}
+
+		if count >= freqSum {
+			return -2
+		}
+
+		rd.decode(hiCnt, freqSum-hiCnt)
+		see.summ += uint16(freqSum)
+		for _, s := range d.states[:num] {
+			d.charMask[d.symbol(s)] = 0
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package kcf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func ppmdInfo(order, memLog uint32) uint32 {
+	return compressionInfo(METHOD_PPMD, order|memLog<<6)
+}
+
+func TestPPMdRoundTrip(t *testing.T) {
+	data := append(textData(100<<10, 1), randomData(4<<10, 2)...)
+	data = append(data, textData(20<<10, 3)...)
+
+	for _, order := range []uint32{2, 6, 16, 32} {
+		info := ppmdInfo(order, 20)
+		t.Run(CompressionName(info), func(t *testing.T) {
+			codecRoundTrip(t, info, nil)
+			codecRoundTrip(t, info, []byte{42})
+			codecRoundTrip(t, info, bytes.Repeat([]byte{7}, 10000))
+			codecRoundTrip(t, info, data)
+		})
+	}
+
+	codecRoundTrip(t, compressionInfo(METHOD_PPMD, 0), data)
+}
+
+func TestPPMdRestart(t *testing.T) {
+	// 64 KiB of model memory is exhausted many times over by data of
+	// varied contexts, so that the model is restarted while coding.
+	data := append(randomData(64<<10, 1), textData(256<<10, 2)...)
+	data = append(data, randomData(64<<10, 3)...)
+
+	for _, order := range []uint32{2, 32} {
+		codecRoundTrip(t, ppmdInfo(order, ppmdMinMemLog), data)
+	}
+}
+
+func TestPPMdCorrupt(t *testing.T) {
+	info := ppmdInfo(8, 20)
+	data := textData(64<<10, 1)
+
+	var packed bytes.Buffer
+	w, _ := ppmdCodec{}.newWriter(&packed, paramsOf(info))
+	w.Write(data)
+	w.Close()
+
+	for _, n := range []int{0, 1, 5, 100, packed.Len() / 2,
+		packed.Len() - 1} {
+		_, err := decodeStream(info, packed.Bytes()[:n])
+		if err == nil {
+			t.Errorf("stream truncated to %d bytes decoded", n)
+		}
+	}
+
+	for i := 0; i < packed.Len(); i += 97 {
+		corrupt := bytes.Clone(packed.Bytes())
+		corrupt[i] ^= 0x55
+
+		got, err := decodeStream(info, corrupt)
+		if err == nil && bytes.Equal(got, data) {
+			t.Errorf("stream corrupt at byte %d decoded", i)
+		}
+	}
+
+	// Garbage must not make the model read or write out of its memory.
+	for seed := int64(0); seed < 50; seed++ {
+		decodeStream(ppmdInfo(32, ppmdMinMemLog),
+			append([]byte{0}, randomData(4<<10, seed)...))
+	}
+}
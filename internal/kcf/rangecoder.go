@@ -0,0 +1,84 @@
+package kcf
+
+import "io"
+
+// Range coder shared by LZMA and PPMd. Both code the same way and
+// differ only in how they split the range between symbols.
+
+const rangeTopValue = 1 << 24
+
+// rangeDecoder decodes bits of the range coder.
+type rangeDecoder struct {
+	r    io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rd *rangeDecoder) init() {
+	rd.rng = 0xFFFFFFFF
+	if rd.readByte() != 0 && rd.err == nil {
+		rd.err = InvalidAddedData
+	}
+
+	for i := 0; i < 4; i++ {
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+}
+
+func (rd *rangeDecoder) readByte() byte {
+	b, err := rd.r.ReadByte()
+	if err != nil && rd.err == nil {
+		rd.err = err
+		if err == io.EOF {
+			rd.err = InvalidAddedData
+		}
+	}
+
+	return b
+}
+
+func (rd *rangeDecoder) normalize() {
+	if rd.rng < rangeTopValue {
+		rd.rng <<= 8
+		rd.code = rd.code<<8 | uint32(rd.readByte())
+	}
+}
+
+// rangeEncoder encodes bits with the range coder. Output bytes are
+// appended to out. A byte may still change by a carry, so the last
+// byte and the following run of 0xFF bytes are kept back in cache and
+// cacheSize.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int64
+	out       []byte
+}
+
+func (re *rangeEncoder) init() {
+	re.rng = 0xFFFFFFFF
+	re.cacheSize = 1
+}
+
+func (re *rangeEncoder) shiftLow() {
+	if uint32(re.low) < 0xFF000000 || re.low>>32 != 0 {
+		carry := byte(re.low >> 32)
+		b := re.cache
+		for ; re.cacheSize > 0; re.cacheSize-- {
+			re.out = append(re.out, b+carry)
+			b = 0xFF
+		}
+		re.cache = byte(re.low >> 24)
+	}
+
+	re.cacheSize++
+	re.low = (re.low & 0x00FFFFFF) << 8
+}
+
+func (re *rangeEncoder) flush() {
+	for i := 0; i < 5; i++ {
+		re.shiftLow()
+	}
+}
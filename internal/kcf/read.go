@@ -20,12 +20,15 @@ func (kcf *Kcf) readRecord() (rec Record, err error) {
 	}
 
 	rec = kcf.lastRecord
+	kcf.available = 0
+	kcf.state.SetHasAddedCRC(false)
 	if rec.HasAddedSize() {
 		kcf.addedReader.R = kcf.file
 		kcf.addedReader.N = int64(rec.AddedDataSize)
 		kcf.available = rec.AddedDataSize
 
 		if rec.HasAddedCRC32() {
+			kcf.state.SetHasAddedCRC(true)
 			kcf.validCrc = rec.AddedDataCRC32
 			if kcf.crc32 == nil {
 				crc32c_table := crc32.MakeTable(crc32.Castagnoli)
@@ -96,6 +99,11 @@ func (kcf *Kcf) readAddedData(buf []byte) (n int, err error) {
 		kcf.available -= uint64(n)
 	}
 
+	// Truncated archives end before the added data do.
+	if err == io.EOF && kcf.available > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
 	if kcf.available == 0 {
 		kcf.state.SetStage(stageRecordHeader)
 		err = nil
@@ -3,14 +3,25 @@ package kcf
 import "encoding/binary"
 import "hash/crc32"
 import "io"
+import "time"
 
 type RecordType uint8
 
 const (
-	MARKER         RecordType = 0x21
-	ARCHIVE_HEADER RecordType = 0x41
-	FILE_HEADER    RecordType = 0x46
-	DATA_FRAGMENT  RecordType = 0x44
+	MARKER          RecordType = 0x21
+	ARCHIVE_HEADER  RecordType = 0x41
+	FILE_HEADER     RecordType = 0x46
+	DATA_FRAGMENT   RecordType = 0x44
+	FILE_METADATA   RecordType = 0x6D
+	SPARSE_MAP      RecordType = 0x53
+	XATTRS          RecordType = 0x78
+	EXTENDED_HEADER RecordType = 0x65
+	GLOBAL_HEADER   RecordType = 0x67
+	LONG_NAME       RecordType = 0x4C
+	ARCHIVE_COMMENT RecordType = 0x63
+	FILE_COMMENT    RecordType = 0x6E
+	CODER_CHAIN     RecordType = 0x43
+	SOLID_BLOCK     RecordType = 0x42
 )
 
 type RecordFlags uint8
@@ -184,15 +195,94 @@ type RecordData interface {
 	AsRecord() (Record, error)
 }
 
+type ArchiveFlags uint16
+
+const (
+	IS_SOLID        ArchiveFlags = 0x0001
+	IS_ENCRYPTED    ArchiveFlags = 0x0002
+	IS_MULTI_VOLUME ArchiveFlags = 0x0004
+	HAS_INDEX       ArchiveFlags = 0x0008
+)
+
+type ChecksumType uint8
+
+const (
+	CHECKSUM_CRC32C ChecksumType = 0
+)
+
+type HostOS uint8
+
+const (
+	HOST_UNKNOWN HostOS = iota
+	HOST_LINUX
+	HOST_WINDOWS
+	HOST_DARWIN
+	HOST_FREEBSD
+	HOST_OPENBSD
+	HOST_NETBSD
+)
+
+var hostOSNames = [...]string{
+	HOST_UNKNOWN: "unknown",
+	HOST_LINUX:   "linux",
+	HOST_WINDOWS: "windows",
+	HOST_DARWIN:  "darwin",
+	HOST_FREEBSD: "freebsd",
+	HOST_OPENBSD: "openbsd",
+	HOST_NETBSD:  "netbsd",
+}
+
+// hostOSOf returns the host OS for the value of runtime.GOOS.
+func hostOSOf(goos string) HostOS {
+	for host, name := range hostOSNames {
+		if name == goos {
+			return HostOS(host)
+		}
+	}
+
+	return HOST_UNKNOWN
+}
+
+func (host HostOS) String() string {
+	if int(host) < len(hostOSNames) {
+		return hostOSNames[host]
+	}
+
+	return hostOSNames[HOST_UNKNOWN]
+}
+
+// ArchiveHeader describes the archive as a whole. Archives written by
+// older versions of the package have only Version, other fields of
+// their headers are zero.
 type ArchiveHeader struct {
-	Version uint16
+	Version      uint16
+	ArchiveFlags ArchiveFlags
+	Checksum     ChecksumType
+	HostOS       HostOS
+	CreationTime time.Time
+
+	// Creator names the program which created the archive together
+	// with its version, for example "kcf v0.0.1".
+	Creator string
 }
 
 func (ahdr ArchiveHeader) AsRecord() (record Record, err error) {
 	record.HeadType = ARCHIVE_HEADER
 	record.HeadFlags = 0
 
-	record.Data = le.AppendUint16(nil, ahdr.Version)
+	if len(ahdr.Creator) > 255 {
+		err = TooBigRecordData
+		return
+	}
+
+	data := le.AppendUint16(nil, ahdr.Version)
+	data = le.AppendUint16(data, uint16(ahdr.ArchiveFlags))
+	data = append(data, uint8(ahdr.Checksum), uint8(ahdr.HostOS))
+	data = appendTime(data, ahdr.CreationTime)
+	data = append(data, uint8(len(ahdr.Creator)))
+	data = append(data, ahdr.Creator...)
+
+	record.Data = data
 	err = record.Fix()
 
 	return
@@ -204,6 +294,12 @@ type FileType uint8
 const (
 	REGULAR_FILE FileType = 0x46
 	DIRECTORY    FileType = 0x64
+	SYMLINK      FileType = 0x6C
+	HARDLINK     FileType = 0x68
+	FIFO         FileType = 0x70
+	CHAR_DEVICE  FileType = 0x63
+	BLOCK_DEVICE FileType = 0x62
+	SOCKET       FileType = 0x73
 )
 
 const (
@@ -211,6 +307,15 @@ const (
 	HAS_FILE_CRC32 FileFlags = 0b0000_0010
 	HAS_UNPACKED_4 FileFlags = 0b0000_0100
 	HAS_UNPACKED_8 FileFlags = 0b0000_1100
+	IS_SPARSE      FileFlags = 0b0001_0000
+
+	// INDEPENDENT_FRAGMENTS marks files compressed in independent
+	// blocks, one block per data fragment.
+	INDEPENDENT_FRAGMENTS FileFlags = 0b0010_0000
+
+	// IN_SOLID_BLOCK marks files whose data are stored in the solid
+	// block preceding them rather than in their own records.
+	IN_SOLID_BLOCK FileFlags = 0b0100_0000
 )
 
 type FileHeader struct {
@@ -221,14 +326,82 @@ type FileHeader struct {
 	CompressionInfo uint32
 	TimeStamp       uint64
 	FileName        string
+
+	// Filters lists CompressionInfo of coders applied to file data
+	// before the compression method, in order. They are stored in the
+	// coder chain record.
+	Filters []uint32
+
+	Metadata  FileMetadata
+	SparseMap SparseMap
+	Xattrs    Xattrs
+	Extra     Extra
+	Comment   string
 }
 
-func (fhdr FileHeader) AsRecord() (rec Record, err error) {
-	if len(fhdr.FileName) > 65535 {
-		err = TooBigFileName
+// SetUnpackedSize sets the size of the unpacked file choosing the
+// size of UnpackedSize field.
+func (fhdr *FileHeader) SetUnpackedSize(size uint64) {
+	fhdr.FileFlags &^= HAS_UNPACKED_8
+	fhdr.FileFlags |= HAS_UNPACKED_4
+	if size > 2147483647 {
+		fhdr.FileFlags |= HAS_UNPACKED_8
+	}
+
+	fhdr.UnpackedSize = size
+}
+
+// ModTime returns the modification time of the file. If the file has
+// no timestamp, it returns the zero time.
+func (fhdr FileHeader) ModTime() time.Time {
+	if (fhdr.Metadata.MetaFlags & HAS_MTIME) != 0 {
+		return fhdr.Metadata.ModTime
+	}
+
+	if (fhdr.FileFlags & HAS_TIMESTAMP) == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(fhdr.TimeStamp), 0)
+}
+
+// SetModTime sets the modification time of the file. Zero time removes
+// the timestamp.
+func (fhdr *FileHeader) SetModTime(t time.Time) {
+	if t.IsZero() {
+		fhdr.FileFlags &^= HAS_TIMESTAMP
+		fhdr.TimeStamp = 0
+		fhdr.Metadata.MetaFlags &^= HAS_MTIME
+		fhdr.Metadata.ModTime = time.Time{}
 		return
 	}
 
+	fhdr.FileFlags |= HAS_TIMESTAMP
+	fhdr.TimeStamp = uint64(t.Unix())
+	if (fhdr.Metadata.MetaFlags & HAS_MTIME) != 0 {
+		fhdr.Metadata.ModTime = t
+	}
+}
+
+// maxFileNameSize is the longest file name which fits into the file
+// header record together with all optional fields. Longer names are
+// stored in a long name record preceding the file header.
+const maxFileNameSize = 65535 - 46
+
+// HasLongName reports whether the file name is too long for the file
+// header record and is stored in a long name record.
+func (fhdr FileHeader) HasLongName() bool {
+	return len(fhdr.FileName) > maxFileNameSize
+}
+
+// AsRecord returns the file header record. If the file has a long
+// name, the name is left out of the record.
+func (fhdr FileHeader) AsRecord() (rec Record, err error) {
+	fileName := fhdr.FileName
+	if fhdr.HasLongName() {
+		fileName = ""
+	}
+
 	data := make([]byte, 0)
 	rec.HeadType = FILE_HEADER
 
@@ -251,13 +424,11 @@ func (fhdr FileHeader) AsRecord() (rec Record, err error) {
 		data = le.AppendUint64(data, fhdr.TimeStamp)
 	}
 
-	fileNameBytes := []byte(fhdr.FileName)
-	fileNameSize := len(fileNameBytes)
-	data = le.AppendUint16(data, uint16(fileNameSize))
-	data = append(data, fileNameBytes...)
+	data = le.AppendUint16(data, uint16(len(fileName)))
+	data = append(data, fileName...)
 
 	rec.Data = data
-	rec.Fix()
+	err = rec.Fix()
 
 	return
 }
@@ -276,7 +447,29 @@ func RecordToArchiveHeader(rec Record) (
 		return
 	}
 
+	if len(rec.Data) < 2 {
+		err = CorruptedRecordData
+		return
+	}
+
 	ahdr.Version = le.Uint16(rec.Data)
+	if len(rec.Data) == 2 {
+		return
+	}
+
+	// Fields following the creator are left for future versions.
+	data := rec.Data[2:]
+	if len(data) < 17 || len(data) < 17+int(data[16]) {
+		err = CorruptedRecordData
+		return
+	}
+
+	ahdr.ArchiveFlags = ArchiveFlags(le.Uint16(data))
+	ahdr.Checksum = ChecksumType(data[2])
+	ahdr.HostOS = HostOS(data[3])
+	ahdr.CreationTime = parseTime(data[4:])
+	ahdr.Creator = string(data[17 : 17+int(data[16])])
+
 	return
 }
 
@@ -284,6 +477,13 @@ func RecordToFileHeader(rec Record) (
 	fhdr FileHeader,
 	err error,
 ) {
+	err = fhdr.parseRecord(rec)
+	return
+}
+
+// parseRecord fills fields of the file header stored in the file header
+// record. Fields filled from other records are left intact.
+func (fhdr *FileHeader) parseRecord(rec Record) (err error) {
 	if !rec.ValidateCRC() {
 		err = CorruptedRecordData
 		return
@@ -322,8 +522,213 @@ func RecordToFileHeader(rec Record) (
 	fileNameSize := le.Uint16(rec.Data[ptr:])
 	ptr += 2
 
-	fileNameBytes := rec.Data[ptr : ptr+int(fileNameSize)]
-	fhdr.FileName = string(fileNameBytes)
+	// An empty name keeps the name of the preceding long name record.
+	if fileNameSize > 0 {
+		fileNameBytes := rec.Data[ptr : ptr+int(fileNameSize)]
+		fhdr.FileName = string(fileNameBytes)
+	}
+
+	return
+}
+
+type MetaFlags uint16
+
+const (
+	HAS_MTIME  MetaFlags = 0x0001
+	HAS_ATIME  MetaFlags = 0x0002
+	HAS_CTIME  MetaFlags = 0x0004
+	HAS_BTIME  MetaFlags = 0x0008
+	HAS_MODE   MetaFlags = 0x0010
+	HAS_OWNER  MetaFlags = 0x0020
+	HAS_NAMES  MetaFlags = 0x0040
+	HAS_DEVICE MetaFlags = 0x0080
+)
+
+// FileMetadata holds optional file attributes which do not fit into
+// the file header. It is stored as a separate record preceding the
+// file header it belongs to.
+type FileMetadata struct {
+	MetaFlags  MetaFlags
+	ModTime    time.Time
+	AccessTime time.Time
+	ChangeTime time.Time
+	BirthTime  time.Time
+
+	// Mode holds Unix permission bits together with setuid, setgid
+	// and sticky bits.
+	Mode      uint16
+	Uid       uint32
+	Gid       uint32
+	UserName  string
+	GroupName string
+
+	// DevMajor and DevMinor are numbers of the device represented by
+	// a device file.
+	DevMajor uint32
+	DevMinor uint32
+}
+
+func appendTime(data []byte, t time.Time) []byte {
+	data = le.AppendUint64(data, uint64(t.Unix()))
+	data = le.AppendUint32(data, uint32(t.Nanosecond()))
+	return data
+}
+
+func parseTime(data []byte) time.Time {
+	return time.Unix(int64(le.Uint64(data)), int64(le.Uint32(data[8:])))
+}
+
+func (meta FileMetadata) AsRecord() (rec Record, err error) {
+	data := make([]byte, 0)
+	rec.HeadType = FILE_METADATA
+
+	data = le.AppendUint16(data, uint16(meta.MetaFlags))
+
+	if (meta.MetaFlags & HAS_MTIME) != 0 {
+		data = appendTime(data, meta.ModTime)
+	}
+
+	if (meta.MetaFlags & HAS_ATIME) != 0 {
+		data = appendTime(data, meta.AccessTime)
+	}
+
+	if (meta.MetaFlags & HAS_CTIME) != 0 {
+		data = appendTime(data, meta.ChangeTime)
+	}
+
+	if (meta.MetaFlags & HAS_BTIME) != 0 {
+		data = appendTime(data, meta.BirthTime)
+	}
+
+	if (meta.MetaFlags & HAS_MODE) != 0 {
+		data = le.AppendUint16(data, meta.Mode)
+	}
+
+	if (meta.MetaFlags & HAS_OWNER) != 0 {
+		data = le.AppendUint32(data, meta.Uid)
+		data = le.AppendUint32(data, meta.Gid)
+	}
+
+	if (meta.MetaFlags & HAS_NAMES) != 0 {
+		if len(meta.UserName) > 255 || len(meta.GroupName) > 255 {
+			err = TooBigRecordData
+			return
+		}
+
+		data = append(data, uint8(len(meta.UserName)))
+		data = append(data, meta.UserName...)
+		data = append(data, uint8(len(meta.GroupName)))
+		data = append(data, meta.GroupName...)
+	}
+
+	if (meta.MetaFlags & HAS_DEVICE) != 0 {
+		data = le.AppendUint32(data, meta.DevMajor)
+		data = le.AppendUint32(data, meta.DevMinor)
+	}
+
+	rec.Data = data
+	err = rec.Fix()
+
+	return
+}
+
+func RecordToFileMetadata(rec Record) (
+	meta FileMetadata,
+	err error,
+) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != FILE_METADATA {
+		err = InvalidFormat
+		return
+	}
+
+	if len(rec.Data) < 2 {
+		err = CorruptedRecordData
+		return
+	}
+
+	meta.MetaFlags = MetaFlags(le.Uint16(rec.Data))
+
+	var ptr int = 2
+	times := []struct {
+		flag MetaFlags
+		t    *time.Time
+	}{
+		{HAS_MTIME, &meta.ModTime},
+		{HAS_ATIME, &meta.AccessTime},
+		{HAS_CTIME, &meta.ChangeTime},
+		{HAS_BTIME, &meta.BirthTime},
+	}
+
+	for _, field := range times {
+		if (meta.MetaFlags & field.flag) == 0 {
+			continue
+		}
+
+		if len(rec.Data) < ptr+12 {
+			err = CorruptedRecordData
+			return
+		}
+
+		*field.t = parseTime(rec.Data[ptr:])
+		ptr += 12
+	}
+
+	if (meta.MetaFlags & HAS_MODE) != 0 {
+		if len(rec.Data) < ptr+2 {
+			err = CorruptedRecordData
+			return
+		}
+
+		meta.Mode = le.Uint16(rec.Data[ptr:])
+		ptr += 2
+	}
+
+	if (meta.MetaFlags & HAS_OWNER) != 0 {
+		if len(rec.Data) < ptr+8 {
+			err = CorruptedRecordData
+			return
+		}
+
+		meta.Uid = le.Uint32(rec.Data[ptr:])
+		meta.Gid = le.Uint32(rec.Data[ptr+4:])
+		ptr += 8
+	}
+
+	if (meta.MetaFlags & HAS_NAMES) != 0 {
+		for _, name := range []*string{&meta.UserName, &meta.GroupName} {
+			if len(rec.Data) < ptr+1 {
+				err = CorruptedRecordData
+				return
+			}
+
+			nameSize := int(rec.Data[ptr])
+			ptr += 1
+
+			if len(rec.Data) < ptr+nameSize {
+				err = CorruptedRecordData
+				return
+			}
+
+			*name = string(rec.Data[ptr : ptr+nameSize])
+			ptr += nameSize
+		}
+	}
+
+	if (meta.MetaFlags & HAS_DEVICE) != 0 {
+		if len(rec.Data) < ptr+8 {
+			err = CorruptedRecordData
+			return
+		}
+
+		meta.DevMajor = le.Uint32(rec.Data[ptr:])
+		meta.DevMinor = le.Uint32(rec.Data[ptr+4:])
+		ptr += 8
+	}
 
 	return
 }
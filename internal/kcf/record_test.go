@@ -0,0 +1,143 @@
+package kcf
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLongName(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		long bool
+	}{
+		{"short", 10, false},
+		{"one below", maxFileNameSize - 1, false},
+		{"limit", maxFileNameSize, false},
+		{"one above", maxFileNameSize + 1, true},
+		{"very long", 100000, true},
+	}
+
+	var hdrs []FileHeader
+	for _, tt := range tests {
+		var hdr FileHeader
+		hdr.FileName = strings.Repeat("dir/", tt.size/4) +
+			strings.Repeat("x", tt.size%4)
+		hdr.FileType = REGULAR_FILE
+
+		if hdr.HasLongName() != tt.long {
+			t.Errorf("%s: long name is %v", tt.name, hdr.HasLongName())
+		}
+
+		// Names up to the limit fit with all optional fields.
+		full := hdr
+		full.FileFlags = HAS_TIMESTAMP | HAS_FILE_CRC32
+		full.SetUnpackedSize(1 << 40)
+		rec, err := full.AsRecord()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		got, err := RecordToFileHeader(rec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.long && got.FileName != "" ||
+			!tt.long && got.FileName != hdr.FileName {
+			t.Errorf("%s: got name of %d bytes in the record", tt.name,
+				len(got.FileName))
+		}
+
+		hdrs = append(hdrs, hdr)
+	}
+
+	got := packHeaders(t, filepath.Join(t.TempDir(), "test.kcf"), hdrs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d files, want %d", len(got), len(tests))
+	}
+
+	for i, tt := range tests {
+		if got[i].FileName != hdrs[i].FileName {
+			t.Errorf("%s: got name of %d bytes, want %d", tt.name,
+				len(got[i].FileName), tt.size)
+		}
+	}
+}
+
+func TestArchiveHeaderRoundTrip(t *testing.T) {
+	full := ArchiveHeader{
+		Version:      MaxVersion,
+		ArchiveFlags: IS_SOLID,
+		Checksum:     CHECKSUM_CRC32C,
+		HostOS:       HOST_LINUX,
+		CreationTime: time.Date(2024, 1, 2, 3, 4, 5, 678, time.UTC),
+		Creator:      "kcf v0.0.1",
+	}
+
+	rec, err := full.AsRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := RecordToArchiveHeader(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != full.Version ||
+		got.ArchiveFlags != full.ArchiveFlags ||
+		got.Checksum != full.Checksum || got.HostOS != full.HostOS ||
+		!got.CreationTime.Equal(full.CreationTime) ||
+		got.Creator != full.Creator {
+		t.Errorf("got %+v, want %+v", got, full)
+	}
+
+	// Headers of version 1 hold only the version.
+	old := Record{HeadType: ARCHIVE_HEADER, Data: []byte{1, 0}}
+	old.Fix()
+
+	got, err = RecordToArchiveHeader(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 1 || got.ArchiveFlags != 0 || got.Checksum != 0 ||
+		got.HostOS != 0 || !got.CreationTime.IsZero() ||
+		got.Creator != "" {
+		t.Errorf("version 1: got %+v", got)
+	}
+
+	// Fields following the creator are ignored.
+	later := rec
+	later.Data = append(bytes.Clone(rec.Data), "future"...)
+	later.Fix()
+
+	got, err = RecordToArchiveHeader(later)
+	if err != nil || got.Creator != full.Creator {
+		t.Errorf("later version: got %+v, %v", got, err)
+	}
+
+	// Headers cut short anywhere but after the version are refused.
+	for n := range len(rec.Data) {
+		if n == 2 {
+			continue
+		}
+
+		short := rec
+		short.Data = rec.Data[:n]
+		short.Fix()
+
+		_, err = RecordToArchiveHeader(short)
+		if err != CorruptedRecordData {
+			t.Errorf("header of %d bytes: got %v", n, err)
+		}
+	}
+
+	corrupt := rec
+	corrupt.Data = bytes.Clone(rec.Data)
+	corrupt.Data[0] ^= 1
+	if _, err = RecordToArchiveHeader(corrupt); err != InvalidFormat {
+		t.Errorf("corrupt header: got %v, want %v", err, InvalidFormat)
+	}
+}
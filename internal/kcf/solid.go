@@ -0,0 +1,622 @@
+package kcf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// solidVersion is the first format version with solid blocks.
+const solidVersion uint16 = 2
+
+// SolidOptions controls how a Pipeline packs regular files into solid
+// blocks, whose data are compressed together as a single stream. Small
+// files compress much better this way, while unpacking a file needs to
+// decompress data of its block up to the file.
+type SolidOptions struct {
+	// BlockSize limits the total size of files of a block. Larger
+	// files are packed on their own. Zero disables solid blocks.
+	BlockSize uint64
+
+	// Files limits the number of files of a block. Zero means no
+	// limit.
+	Files int
+
+	// ByExtension packs files into blocks by extensions of their
+	// names, so that similar files are compressed together.
+	ByExtension bool
+}
+
+// SolidBlock describes a solid block. Its packed data hold data of the
+// following FileCount regular files compressed together, UnpackedSize
+// bytes in total.
+type SolidBlock struct {
+	CompressionInfo uint32
+	UnpackedSize    uint64
+	FileCount       uint32
+
+	// Filters lists CompressionInfo of coders applied to data of the
+	// block before the compression method, as in FileHeader.
+	Filters []uint32
+}
+
+func (block SolidBlock) AsRecord() (rec Record, err error) {
+	if len(block.Filters) > maxFilters {
+		err = InvalidCompressionParams
+		return
+	}
+
+	rec.HeadType = SOLID_BLOCK
+	data := le.AppendUint32(nil, block.CompressionInfo)
+	data = le.AppendUint64(data, block.UnpackedSize)
+	data = le.AppendUint32(data, block.FileCount)
+	for _, info := range block.Filters {
+		data = le.AppendUint32(data, info)
+	}
+
+	rec.Data = data
+	err = rec.Fix()
+
+	return
+}
+
+func RecordToSolidBlock(rec Record) (block SolidBlock, err error) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != SOLID_BLOCK {
+		err = InvalidFormat
+		return
+	}
+
+	if len(rec.Data) < 16 || len(rec.Data)%4 != 0 ||
+		len(rec.Data) > 16+4*maxFilters {
+		err = CorruptedRecordData
+		return
+	}
+
+	block.CompressionInfo = le.Uint32(rec.Data)
+	block.UnpackedSize = le.Uint64(rec.Data[4:])
+	block.FileCount = le.Uint32(rec.Data[12:])
+	for ptr := 16; ptr < len(rec.Data); ptr += 4 {
+		block.Filters = append(block.Filters, le.Uint32(rec.Data[ptr:]))
+	}
+
+	if block.FileCount == 0 {
+		err = CorruptedRecordData
+	}
+
+	return
+}
+
+// solidReader unpacks data of files of the solid block being read. The
+// block is decompressed only when data of its files are unpacked, from
+// its start up to the end of the last unpacked file.
+type solidReader struct {
+	block SolidBlock
+	frags []*packedFragment
+
+	// left is the number of files of the block whose headers have not
+	// been read yet. Data of the current file are found from start to
+	// end of unpacked data of the block.
+	left  uint32
+	start uint64
+	end   uint64
+
+	// r decodes data of the block, pos bytes of which have been read.
+	r   io.Reader
+	pos uint64
+}
+
+func (sr *solidReader) Read(p []byte) (n int, err error) {
+	n, err = sr.r.Read(p)
+	sr.pos += uint64(n)
+	return
+}
+
+// fileData returns a reader of data of the current file. Data of files
+// preceding it in the block are decompressed and dropped, unless they
+// have been unpacked.
+func (sr *solidReader) fileData(kcf *Kcf) (r io.Reader, err error) {
+	if sr.r == nil {
+		info := sr.block.CompressionInfo
+		filters := sr.block.Filters
+
+		_, err = kcf.memoryNeeded(filters, info)
+		if err != nil {
+			return
+		}
+
+		data := &solidData{kcf: kcf, frags: sr.frags}
+		sr.r, err = newChainReader(data, filters, info)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = io.CopyN(io.Discard, sr, int64(sr.start-sr.pos))
+	if err == io.EOF {
+		err = InvalidAddedData
+	}
+	if err != nil {
+		return
+	}
+
+	return io.LimitReader(sr, int64(sr.end-sr.start)), nil
+}
+
+// solidData reads packed data of a solid block fragment by fragment.
+// Fragments of seekable archives are read by ReadAt, others are kept
+// in memory.
+type solidData struct {
+	kcf   *Kcf
+	frags []*packedFragment
+	buf   []byte
+}
+
+func (sd *solidData) Read(p []byte) (n int, err error) {
+	for len(sd.buf) == 0 {
+		if len(sd.frags) == 0 {
+			return 0, io.EOF
+		}
+
+		frag := sd.frags[0]
+		sd.frags = sd.frags[1:]
+
+		sd.buf = frag.data
+		if sd.kcf.isSeekable {
+			sd.buf, err = sd.kcf.readFragment(frag)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	n = copy(p, sd.buf)
+	sd.buf = sd.buf[n:]
+	return
+}
+
+// readSolidBlock reads the solid block record which has been read last
+// and notes where its packed data are. In archives which cannot seek,
+// packed data of the block are kept in memory until its files are read.
+func (kcf *Kcf) readSolidBlock() (err error) {
+	if kcf.block != nil && kcf.block.left > 0 {
+		return InvalidFormat
+	}
+
+	sr := &solidReader{}
+	sr.block, err = RecordToSolidBlock(kcf.lastRecord)
+	if err != nil {
+		return
+	}
+	sr.left = sr.block.FileCount
+
+	for {
+		if kcf.state.GetStage() == stageRecordAddedData {
+			frag := &packedFragment{}
+			if kcf.isSeekable {
+				err = kcf.locateFragment(frag)
+			} else {
+				frag.data, err = kcf.readAllAddedData()
+			}
+			if err != nil {
+				return
+			}
+
+			sr.frags = append(sr.frags, frag)
+		}
+
+		if kcf.lastRecord.HeadFlags&0x01 == 0 {
+			break
+		}
+
+		err = (&fragmentReader{kcf: kcf}).nextFragment()
+		if err != nil {
+			return
+		}
+	}
+
+	kcf.block = sr
+	return
+}
+
+// readSolidFile checks whether the current file is the next file of the
+// solid block being read, as its flags tell, and fills the compression
+// method and filters of the file from the block.
+func (kcf *Kcf) readSolidFile() (err error) {
+	isSolid := kcf.currentFile.FileFlags&IN_SOLID_BLOCK != 0
+
+	sr := kcf.block
+	if sr == nil || sr.left == 0 {
+		kcf.block = nil
+		if isSolid {
+			err = InvalidFormat
+		}
+		return
+	}
+
+	if !isSolid || kcf.currentFile.FileType != REGULAR_FILE ||
+		kcf.state.GetStage() == stageRecordAddedData ||
+		kcf.lastRecord.HeadFlags&0x01 != 0 {
+		return InvalidFormat
+	}
+
+	size := kcf.currentFile.UnpackedSize
+	if (kcf.currentFile.FileFlags & IS_SPARSE) != 0 {
+		size = kcf.currentFile.SparseMap.DataSize()
+	}
+	if size > sr.block.UnpackedSize-sr.end {
+		return InvalidFormat
+	}
+
+	sr.left--
+	sr.start = sr.end
+	sr.end += size
+	if sr.left == 0 && sr.end != sr.block.UnpackedSize {
+		return InvalidFormat
+	}
+
+	kcf.currentFile.CompressionInfo = sr.block.CompressionInfo
+	kcf.currentFile.Filters = sr.block.Filters
+	return
+}
+
+// unpackSolidFile unpacks data of the current file from its solid block
+// into w. Data are not decompressed if w is io.Discard.
+func (kcf *Kcf) unpackSolidFile(w io.Writer) (n int64, err error) {
+	sr := kcf.block
+
+	if w != io.Discard {
+		var r io.Reader
+
+		r, err = sr.fileData(kcf)
+		if err != nil {
+			return
+		}
+
+		n, err = io.CopyBuffer(w, r, make([]byte, 64<<10))
+		if err != nil {
+			return
+		}
+		if uint64(n) != sr.end-sr.start {
+			err = InvalidAddedData
+			return
+		}
+	}
+
+	if sr.left == 0 {
+		kcf.block = nil
+	}
+
+	return
+}
+
+// copySolidFile packs the current file of src, which is stored in a
+// solid block, on its own by the compression method of the block. Its
+// packed data cannot be copied apart from data of other files.
+func (kcf *Kcf) copySolidFile(src *Kcf) (err error) {
+	sr := src.block
+
+	var r io.Reader
+	r, err = sr.fileData(src)
+	if err != nil {
+		return
+	}
+
+	hdr := src.currentFile
+	hdr.FileFlags &^= IN_SOLID_BLOCK
+	err = kcf.PackFile(hdr, r)
+	if err != nil {
+		return
+	}
+
+	if sr.left == 0 {
+		src.block = nil
+	}
+
+	src.state.SetPackerPos(pposFileHeader)
+	return
+}
+
+// solidGroup is a group of files waiting to be packed into solid
+// blocks. Files of a group are packed with the same options, except
+// for the options of the archive.
+type solidGroup struct {
+	key   string
+	files []solidFile
+	size  uint64
+}
+
+// solidFile is a file of a solid group. It is read from path and packed
+// with opts, unless hdr describes it with its data kept in memory.
+type solidFile struct {
+	path string
+	opts WriterOptions
+	hdr  *FileHeader
+	data []byte
+}
+
+// solidKey returns the key of the group of the file at path packed with
+// opts. Files of a group are compressed the same way unless methods are
+// selected by their contents.
+func solidKey(path string, opts WriterOptions, byExtension bool) string {
+	key := fmt.Sprint(opts.Compression, opts.Filters,
+		opts.AutoCompression, opts.AutoBCJ, opts.AutoDelta)
+	if byExtension {
+		key += "/" + strings.ToLower(filepath.Ext(path))
+	}
+
+	return key
+}
+
+// isSolid reports whether a regular file with size bytes of data goes
+// to a solid block when packed with opts: its data are compressed and
+// not larger than a block.
+func (p *Pipeline) isSolid(size uint64, opts WriterOptions) bool {
+	if p.solid.BlockSize == 0 || size == 0 || size > p.solid.BlockSize {
+		return false
+	}
+
+	return opts.AutoCompression || len(opts.Filters) > 0 ||
+		MethodOf(opts.Compression) != METHOD_STORED
+}
+
+// addSolid adds the file with size bytes of data to its group. A group
+// which is full is queued to be packed and a new one takes the file.
+func (p *Pipeline) addSolid(f solidFile, size uint64) {
+	key := solidKey(f.path, f.opts, p.solid.ByExtension)
+	i := slices.IndexFunc(p.groups, func(g *solidGroup) bool {
+		return g.key == key
+	})
+
+	if i >= 0 {
+		g := p.groups[i]
+		if g.size+size > p.solid.BlockSize ||
+			(p.solid.Files > 0 && len(g.files) >= p.solid.Files) {
+			p.groups = slices.Delete(p.groups, i, i+1)
+			p.queueGroup(g)
+			i = -1
+		}
+	}
+
+	if i < 0 {
+		i = len(p.groups)
+		p.groups = append(p.groups, &solidGroup{key: key})
+	}
+
+	g := p.groups[i]
+	g.files = append(g.files, f)
+	g.size += size
+}
+
+// queueGroups queues all groups of files, in the order they were
+// started.
+func (p *Pipeline) queueGroups() {
+	for _, g := range p.groups {
+		p.queueGroup(g)
+	}
+
+	p.groups = nil
+}
+
+func (p *Pipeline) queueGroup(g *solidGroup) {
+	job := &packJob{opts: g.files[0].opts, ready: make(chan struct{})}
+	go p.prepareGroup(job, g)
+	p.queueJob(job)
+}
+
+// solidBuilder compresses data of files of a solid block.
+type solidBuilder struct {
+	block SolidBlock
+	files []FileHeader
+	enc   *spill
+	fw    *fragmentWriter
+	cw    io.WriteCloser
+}
+
+// prepareGroup packs files of the group into solid blocks, one block
+// for each compression method selected for them. Files which turn out
+// to be empty or not to be compressed are packed on their own by the
+// writer after the blocks.
+func (p *Pipeline) prepareGroup(job *packJob, g *solidGroup) {
+	defer close(job.ready)
+
+	p.tokens <- struct{}{}
+	defer func() { <-p.tokens }()
+
+	var builders []*solidBuilder
+	job.cleanup = func() {
+		for _, b := range builders {
+			b.enc.close()
+		}
+	}
+
+	var others []solidFile
+	for _, f := range g.files {
+		isSolid, err := p.addSolidFile(&builders, f)
+		if err != nil {
+			job.err = err
+			return
+		}
+
+		if !isSolid {
+			others = append(others, f)
+		}
+	}
+
+	for _, b := range builders {
+		if job.err = b.cw.Close(); job.err != nil {
+			return
+		}
+		if job.err = b.fw.Close(); job.err != nil {
+			return
+		}
+	}
+
+	kcf := p.kcf
+	job.write = func() (err error) {
+		for _, b := range builders {
+			if err = kcf.writeSolidBlock(b); err != nil {
+				return
+			}
+		}
+
+		for _, f := range others {
+			if f.hdr != nil {
+				r := bytes.NewReader(f.data)
+				err = kcf.PackFile(*f.hdr, r)
+			} else {
+				kcf.options = f.opts
+				err = kcf.packFileAt(f.path)
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		return
+	}
+}
+
+// addSolidFile reads the header and data of the file and compresses the
+// data into the block of its compression method. It returns false if
+// the file is to be packed on its own.
+func (p *Pipeline) addSolidFile(builders *[]*solidBuilder, f solidFile) (
+	isSolid bool,
+	err error,
+) {
+	if f.hdr != nil {
+		return addToBlock(builders, *f.hdr, bytes.NewReader(f.data),
+			uint64(len(f.data)))
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hdr, data, size, err := p.kcf.fileHeaderOf(file, f.opts)
+	if err != nil || hdr.FileType != REGULAR_FILE {
+		return
+	}
+
+	return addToBlock(builders, hdr, data(), size)
+}
+
+// addToBlock compresses size bytes of data of the file described by hdr
+// read from r into the block of its compression method, starting a new
+// block for a method met first. It returns false for empty files and
+// files whose data are not to be compressed.
+func addToBlock(builders *[]*solidBuilder, hdr FileHeader, r io.Reader,
+	size uint64) (isSolid bool, err error) {
+	info := hdr.CompressionInfo
+	if size == 0 ||
+		(MethodOf(info) == METHOD_STORED && len(hdr.Filters) == 0) {
+		return
+	}
+
+	i := slices.IndexFunc(*builders, func(b *solidBuilder) bool {
+		return b.block.CompressionInfo == info &&
+			slices.Equal(b.block.Filters, hdr.Filters)
+	})
+
+	if i < 0 {
+		var c codec
+
+		if MethodOf(info) != METHOD_STORED {
+			c, err = codecOf(info)
+			if err != nil {
+				return
+			}
+		}
+
+		b := &solidBuilder{enc: &spill{}}
+		b.block.CompressionInfo = info
+		b.block.Filters = hdr.Filters
+		b.fw = newFragmentWriter(b.enc, c, info)
+		b.cw, err = newChainWriter(b.fw, hdr.Filters, info)
+		if err != nil {
+			return
+		}
+
+		i = len(*builders)
+		*builders = append(*builders, b)
+	}
+
+	b := (*builders)[i]
+	crc := newFileHash(hdr)
+
+	var n int64
+	n, err = io.CopyBuffer(b.cw,
+		io.TeeReader(io.LimitReader(r, int64(size)), crc),
+		make([]byte, 64<<10))
+	if err != nil {
+		return
+	}
+	if uint64(n) != size {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	hdr.FileFlags &^= INDEPENDENT_FRAGMENTS
+	hdr.FileFlags |= IN_SOLID_BLOCK | HAS_FILE_CRC32
+	hdr.FileCRC32 = crc.Sum32()
+	hdr.Filters = nil
+
+	b.block.UnpackedSize += size
+	b.block.FileCount++
+	b.files = append(b.files, hdr)
+
+	return true, nil
+}
+
+// writeSolidBlock writes the solid block record with packed data of the
+// block followed by headers of its files and records preceding them.
+func (kcf *Kcf) writeSolidBlock(b *solidBuilder) (err error) {
+	err = b.enc.replay(&recordSink{kcf: kcf, head: b.block})
+	if err != nil {
+		return
+	}
+
+	for _, hdr := range b.files {
+		kcf.currentFile = hdr
+		err = kcf.writeFileMetadata()
+		if err != nil {
+			return
+		}
+
+		var rec Record
+		rec, err = hdr.AsRecord()
+		if err != nil {
+			return
+		}
+
+		err = kcf.writeRecordData(rec, nil)
+		if err != nil {
+			return
+		}
+
+		kcf.packedSize = 0
+		kcf.state.SetPackerPos(pposFileHeader)
+	}
+
+	return
+}
+
+// packFileAt packs the file at path as Kcf.PackFileRaw does.
+func (kcf *Kcf) packFileAt(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return kcf.PackFileRaw(file)
+}
@@ -0,0 +1,331 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// solidEntry is a file read from a solid archive. block counts solid
+// blocks from one, zero for files packed on their own.
+type solidEntry struct {
+	name     string
+	fileType FileType
+	data     string
+	block    int
+}
+
+// packSolid packs files at paths into a new solid archive at path by a
+// pipeline of workers.
+func packSolid(t *testing.T, path string, paths []string,
+	solid SolidOptions, workers int) {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	opts := WriterOptions{
+		Compression: compressionInfo(METHOD_LZ4, 0),
+		Solid:       solid,
+	}
+	kcf.SetWriterOptions(opts)
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := kcf.NewPipeline(workers)
+	for _, path := range paths {
+		if err = p.PackPath(path, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSolid unpacks every file of the archive at path.
+func readSolid(path string) (entries []solidEntry, err error) {
+	kcf, err := OpenArchive(path)
+	if err != nil {
+		return
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		return
+	}
+
+	var block *solidReader
+	var blocks int
+	for {
+		var hdr FileHeader
+
+		hdr, err = kcf.GetCurrentFile()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return
+		}
+
+		e := solidEntry{name: hdr.FileName, fileType: hdr.FileType}
+		if kcf.block != nil {
+			if kcf.block != block {
+				block = kcf.block
+				blocks++
+			}
+			e.block = blocks
+		}
+
+		var data bytes.Buffer
+		_, err = kcf.UnpackFile(&data)
+		if err != nil && err != io.EOF {
+			return
+		}
+		e.data = data.String()
+
+		entries = append(entries, e)
+	}
+}
+
+// writeFiles creates files of the given sizes in dir and returns their
+// paths and contents.
+func writeFiles(t *testing.T, dir string, names []string,
+	sizes []int) (paths []string, contents map[string]string) {
+	t.Helper()
+
+	contents = make(map[string]string)
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		data := textData(sizes[i], int64(i))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		paths = append(paths, path)
+		contents[path] = string(data)
+	}
+
+	return
+}
+
+func TestSolidRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a.txt", "b.c", "c.txt", "d.c", "e.bin", "f.txt",
+		"g.c", "h.txt", "empty.txt", "large.bin", "i.txt"}
+	sizes := []int{1000, 2000, 3000, 4000, 5000, 6000, 7000, 8000, 0,
+		100 << 10, 9000}
+	paths, contents := writeFiles(t, dir, names, sizes)
+
+	tests := []struct {
+		name  string
+		solid SolidOptions
+	}{
+		{"size", SolidOptions{BlockSize: 16 << 10}},
+		{"files", SolidOptions{BlockSize: 64 << 10, Files: 3}},
+		{"extension", SolidOptions{BlockSize: 64 << 10,
+			ByExtension: true}},
+	}
+
+	for _, tt := range tests {
+		var archives [][]byte
+		for _, workers := range []int{1, 4} {
+			name := fmt.Sprintf("%s/%d", tt.name, workers)
+			path := filepath.Join(dir, tt.name+".kcf")
+			packSolid(t, path, paths, tt.solid, workers)
+
+			entries, err := readSolid(path)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(entries) != len(paths) {
+				t.Fatalf("%s: got %d files, want %d", name,
+					len(entries), len(paths))
+			}
+
+			files := make(map[int]int)
+			exts := make(map[int]string)
+			for _, e := range entries {
+				if e.data != contents[e.name] {
+					t.Errorf("%s: data of %s differ", name, e.name)
+				}
+
+				isSolid := e.block > 0
+				wantSolid := len(contents[e.name]) > 0 &&
+					len(contents[e.name]) <= int(tt.solid.BlockSize)
+				if isSolid != wantSolid {
+					t.Errorf("%s: %s in a solid block: %v", name,
+						e.name, isSolid)
+				}
+				if !isSolid {
+					continue
+				}
+
+				files[e.block]++
+				ext := filepath.Ext(e.name)
+				if tt.solid.ByExtension && files[e.block] > 1 &&
+					exts[e.block] != ext {
+					t.Errorf("%s: %s in block of %s files", name,
+						e.name, exts[e.block])
+				}
+				exts[e.block] = ext
+			}
+
+			for block, n := range files {
+				if tt.solid.Files > 0 && n > tt.solid.Files {
+					t.Errorf("%s: block %d has %d files", name, block,
+						n)
+				}
+			}
+			if len(files) < 2 {
+				t.Errorf("%s: got %d solid blocks", name, len(files))
+			}
+
+			// Only the creation time may differ.
+			archive, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archives = append(archives, archive)
+		}
+
+		if len(archives[0]) != len(archives[1]) {
+			t.Errorf("%s: archives of different workers differ",
+				tt.name)
+		}
+	}
+}
+
+func TestSolidHardLink(t *testing.T) {
+	dir := t.TempDir()
+	paths, contents := writeFiles(t, dir, []string{"a", "b"},
+		[]int{1000, 2000})
+
+	link := filepath.Join(dir, "link")
+	if err := os.Link(paths[0], link); err != nil {
+		t.Skip(err)
+	}
+
+	// The link is added while its target waits for its block to fill
+	// up, the target must be written before it nevertheless.
+	path := filepath.Join(dir, "test.kcf")
+	packSolid(t, path, []string{paths[0], link, paths[1]},
+		SolidOptions{BlockSize: 1 << 20}, 2)
+
+	entries, err := readSolid(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	for _, e := range entries {
+		switch e.fileType {
+		case HARDLINK:
+			if e.name != link || e.data != paths[0] {
+				t.Errorf("got link %s to %s", e.name, e.data)
+			}
+			if len(seen) == 0 || seen[0] != paths[0] {
+				t.Errorf("link %s precedes its target", e.name)
+			}
+		case REGULAR_FILE:
+			if e.data != contents[e.name] {
+				t.Errorf("data of %s differ", e.name)
+			}
+			seen = append(seen, e.name)
+		}
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("got %d files, want 3", len(entries))
+	}
+}
+
+// findRecord returns the offset of the first record of type t in the
+// archive, whose data are size bytes long.
+func findRecord(archive []byte, t RecordType, size int) (
+	offset int,
+	rec Record,
+) {
+	for offset = 0; offset+6 < len(archive); offset++ {
+		if RecordType(archive[offset+2]) != t {
+			continue
+		}
+
+		headSize := int(le.Uint16(archive[offset+4:]))
+		if headSize < 6 || offset+headSize > len(archive) {
+			continue
+		}
+
+		rec.UnmarshalBinary(archive[offset : offset+headSize])
+		if rec.ValidateCRC() && len(rec.Data) == size {
+			return
+		}
+	}
+
+	return -1, rec
+}
+
+func TestSolidCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	paths, _ := writeFiles(t, dir, []string{"a", "b", "c"},
+		[]int{1000, 2000, 3000})
+
+	path := filepath.Join(dir, "test.kcf")
+	packSolid(t, path, paths, SolidOptions{BlockSize: 1 << 20}, 1)
+
+	archive, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, rec := findRecord(archive, SOLID_BLOCK, 16)
+	if offset < 0 {
+		t.Fatal("solid block record not found")
+	}
+
+	tests := []struct {
+		name  string
+		count uint32
+		size  uint64
+		err   error
+	}{
+		{"intact", 3, 6000, nil},
+		{"fewer files", 2, 6000, InvalidFormat},
+		{"more files", 4, 6000, InvalidFormat},
+		{"many files", 0xFFFFFFFF, 6000, InvalidFormat},
+		{"no files", 0, 6000, CorruptedRecordData},
+		{"smaller", 3, 5999, InvalidFormat},
+		{"larger", 3, 6001, InvalidFormat},
+		{"huge", 3, 1 << 62, InvalidFormat},
+	}
+
+	for _, tt := range tests {
+		corrupt := rec
+		corrupt.Data = bytes.Clone(rec.Data)
+		le.PutUint64(corrupt.Data[4:], tt.size)
+		le.PutUint32(corrupt.Data[12:], tt.count)
+		corrupt.Fix()
+
+		data, _ := corrupt.MarshalBinary()
+		archive := bytes.Clone(archive)
+		copy(archive[offset:], data)
+
+		path := filepath.Join(dir, "corrupt.kcf")
+		if err = os.WriteFile(path, archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = readSolid(path)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package kcf
+
+import (
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// SparseExtent is a region of a sparse file which holds data. Regions
+// between extents are holes and read as zeros.
+type SparseExtent struct {
+	Offset uint64
+	Size   uint64
+}
+
+// SparseMap lists data extents of a sparse file in ascending order.
+// Only data of the extents is stored as packed data of the file.
+type SparseMap []SparseExtent
+
+// DataSize returns the total size of data extents.
+func (smap SparseMap) DataSize() (size uint64) {
+	for _, ext := range smap {
+		size += ext.Size
+	}
+
+	return
+}
+
+// AsRecord returns the sparse map record and its added data which
+// holds the extents.
+func (smap SparseMap) AsRecord() (rec Record, data []byte, err error) {
+	rec.HeadType = SPARSE_MAP
+
+	data = make([]byte, 0, len(smap)*16)
+	for _, ext := range smap {
+		data = le.AppendUint64(data, ext.Offset)
+		data = le.AppendUint64(data, ext.Size)
+	}
+
+	err = rec.Fix()
+	return
+}
+
+func RecordToSparseMap(rec Record, data []byte) (
+	smap SparseMap,
+	err error,
+) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != SPARSE_MAP {
+		err = InvalidFormat
+		return
+	}
+
+	if len(data)%16 != 0 {
+		err = CorruptedRecordData
+		return
+	}
+
+	smap = make(SparseMap, 0, len(data)/16)
+	for ptr := 0; ptr < len(data); ptr += 16 {
+		smap = append(smap, SparseExtent{
+			Offset: le.Uint64(data[ptr:]),
+			Size:   le.Uint64(data[ptr+8:]),
+		})
+	}
+
+	err = smap.check(math.MaxUint64)
+	return
+}
+
+// check returns InvalidFormat unless extents are in ascending order,
+// do not overlap and end within a file of size bytes.
+func (smap SparseMap) check(size uint64) error {
+	var end uint64
+	for _, ext := range smap {
+		if ext.Offset < end || ext.Offset+ext.Size < ext.Offset {
+			return InvalidFormat
+		}
+		end = ext.Offset + ext.Size
+	}
+
+	if end > size {
+		return InvalidFormat
+	}
+
+	return nil
+}
+
+// crc32Zeros returns CRC32C of data with the given CRC32C followed by
+// n zero bytes. It takes O(log n) time, so holes of sparse files need
+// not be read to calculate the file CRC32.
+func crc32Zeros(crc uint32, n uint64) uint32 {
+	crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+
+	// Appending a zero byte to the data is a linear transform of the
+	// inverted CRC register. op holds the images of its basis vectors.
+	var op, sq [32]uint32
+	for i := range op {
+		v := uint32(1) << i
+		op[i] = crc32c_table[v&0xFF] ^ (v >> 8)
+	}
+
+	c := ^crc
+	for n > 0 {
+		if n&1 != 0 {
+			c = gf2Apply(&op, c)
+		}
+
+		n >>= 1
+		if n == 0 {
+			break
+		}
+
+		for i := range sq {
+			sq[i] = gf2Apply(&op, op[i])
+		}
+		op = sq
+	}
+
+	return ^c
+}
+
+func gf2Apply(op *[32]uint32, v uint32) (r uint32) {
+	for i := 0; v != 0; i, v = i+1, v>>1 {
+		if v&1 != 0 {
+			r ^= op[i]
+		}
+	}
+
+	return
+}
+
+// sparseCRC calculates CRC32C of a sparse file from data of its
+// extents written in order.
+type sparseCRC struct {
+	smap SparseMap
+	size uint64
+	ext  int
+	left uint64
+	pos  uint64
+	crc  uint32
+}
+
+func (sc *sparseCRC) Write(p []byte) (n int, err error) {
+	crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+
+	n = len(p)
+	for len(p) > 0 {
+		if sc.left == 0 {
+			if sc.ext >= len(sc.smap) {
+				return n - len(p), InvalidAddedData
+			}
+
+			ext := sc.smap[sc.ext]
+			sc.ext++
+			sc.crc = crc32Zeros(sc.crc, ext.Offset-sc.pos)
+			sc.pos = ext.Offset
+			sc.left = ext.Size
+			continue
+		}
+
+		chunk := p
+		if uint64(len(chunk)) > sc.left {
+			chunk = chunk[:sc.left]
+		}
+
+		sc.crc = crc32.Update(sc.crc, crc32c_table, chunk)
+		sc.left -= uint64(len(chunk))
+		sc.pos += uint64(len(chunk))
+		p = p[len(chunk):]
+	}
+
+	return
+}
+
+func (sc *sparseCRC) Sum32() uint32 {
+	if sc.pos >= sc.size {
+		return sc.crc
+	}
+
+	return crc32Zeros(sc.crc, sc.size-sc.pos)
+}
+
+// sparseWriter places data of extents written to it at their offsets.
+// Holes are skipped if the underlying writer can seek and filled with
+// zeros otherwise.
+type sparseWriter struct {
+	w    io.Writer
+	smap SparseMap
+	size uint64
+	ext  int
+	left uint64
+	pos  uint64
+}
+
+func (sw *sparseWriter) skip(to uint64) (err error) {
+	if to <= sw.pos {
+		return
+	}
+
+	if seeker, ok := sw.w.(io.Seeker); ok {
+		_, err = seeker.Seek(int64(to-sw.pos), io.SeekCurrent)
+	} else {
+		_, err = io.CopyN(sw.w, zeroReader{}, int64(to-sw.pos))
+	}
+
+	if err == nil {
+		sw.pos = to
+	}
+
+	return
+}
+
+func (sw *sparseWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if sw.left == 0 {
+			if sw.ext >= len(sw.smap) {
+				return n, InvalidAddedData
+			}
+
+			ext := sw.smap[sw.ext]
+			sw.ext++
+
+			err = sw.skip(ext.Offset)
+			if err != nil {
+				return
+			}
+			sw.left = ext.Size
+			continue
+		}
+
+		chunk := p
+		if uint64(len(chunk)) > sw.left {
+			chunk = chunk[:sw.left]
+		}
+
+		var written int
+		written, err = sw.w.Write(chunk)
+		n += written
+		sw.left -= uint64(written)
+		sw.pos += uint64(written)
+		if err != nil {
+			return
+		}
+
+		p = p[written:]
+	}
+
+	return
+}
+
+// Close extends the output to the size of the file. The trailing hole
+// is made by truncation if the underlying writer supports it.
+func (sw *sparseWriter) Close() (err error) {
+	if sw.pos >= sw.size {
+		return
+	}
+
+	type truncater interface {
+		Truncate(size int64) error
+	}
+
+	seeker, canSeek := sw.w.(io.Seeker)
+	t, canTruncate := sw.w.(truncater)
+	if canSeek && canTruncate {
+		var start int64
+
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return
+		}
+
+		end := start + int64(sw.size-sw.pos)
+		err = t.Truncate(end)
+		if err != nil {
+			return
+		}
+
+		_, err = seeker.Seek(end, io.SeekStart)
+		sw.pos = sw.size
+		return
+	}
+
+	if canSeek {
+		err = sw.skip(sw.size - 1)
+		if err != nil {
+			return
+		}
+
+		_, err = sw.w.Write([]byte{0})
+		sw.pos = sw.size
+		return
+	}
+
+	return sw.skip(sw.size)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	clear(p)
+	return len(p), nil
+}
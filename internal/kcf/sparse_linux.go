@@ -0,0 +1,61 @@
+package kcf
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	_SEEK_DATA = 3
+	_SEEK_HOLE = 4
+)
+
+// sparseExtents finds data extents of the file using SEEK_DATA and
+// SEEK_HOLE. If the file has no holes, isSparse is false.
+func sparseExtents(file *os.File, size int64) (
+	smap SparseMap,
+	isSparse bool,
+	err error,
+) {
+	if size == 0 {
+		return
+	}
+
+	var data, hole int64
+
+	hole, err = file.Seek(0, _SEEK_HOLE)
+	if err != nil || hole >= size {
+		_, err = file.Seek(0, io.SeekStart)
+		return
+	}
+
+	for pos := int64(0); pos < size; pos = hole {
+		data, err = file.Seek(pos, _SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		hole, err = file.Seek(data, _SEEK_HOLE)
+		if err != nil {
+			return
+		}
+		if hole > size {
+			hole = size
+		}
+
+		smap = append(smap, SparseExtent{
+			Offset: uint64(data),
+			Size:   uint64(hole - data),
+		})
+	}
+
+	isSparse = true
+	_, err = file.Seek(0, io.SeekStart)
+	return
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package kcf
+
+import "os"
+
+// sparseExtents finds data extents of the file. Holes cannot be found
+// on this system, so every file is considered not sparse.
+func sparseExtents(file *os.File, size int64) (
+	smap SparseMap,
+	isSparse bool,
+	err error,
+) {
+	return
+}
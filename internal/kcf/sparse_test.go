@@ -0,0 +1,165 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// sparseData returns data of a file of size bytes with the extents of
+// smap filled by data and holes of zeros.
+func sparseData(smap SparseMap, data []byte, size int) []byte {
+	file := make([]byte, size)
+	for _, ext := range smap {
+		copy(file[ext.Offset:ext.Offset+ext.Size], data)
+		data = data[ext.Size:]
+	}
+
+	return file
+}
+
+// packSparse creates an archive at path holding one sparse file of size
+// bytes. Unless check is set, the sparse map is written as it is.
+func packSparse(t *testing.T, path string, smap SparseMap, data []byte,
+	size uint64, check bool) error {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr FileHeader
+	hdr.FileName = "file"
+	hdr.FileType = REGULAR_FILE
+	hdr.FileFlags = IS_SPARSE
+	hdr.CompressionInfo = compressionInfo(METHOD_LZ4, 0)
+	hdr.SparseMap = smap
+	hdr.SetUnpackedSize(size)
+
+	if !check {
+		return kcf.packData(hdr, bytes.NewReader(data),
+			uint64(len(data)))
+	}
+	return kcf.PackFile(hdr, bytes.NewReader(data))
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	smap := SparseMap{{0, 100}, {4096, 5000}, {20000, 1}, {65536, 4464}}
+	data := textData(int(smap.DataSize()), 1)
+	size := 100000
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.kcf")
+	err := packSparse(t, path, smap, data, uint64(size), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kcf, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := kcf.GetCurrentFile()
+	kcf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.FileFlags&IS_SPARSE == 0 || !slices.Equal(hdr.SparseMap, smap) {
+		t.Errorf("got sparse map %v, want %v", hdr.SparseMap, smap)
+	}
+
+	// Holes are written as zeros into a buffer and skipped in a file.
+	want := sparseData(smap, data, size)
+
+	var buf bytes.Buffer
+	unpackTestFile(t, path, ReaderOptions{}, &buf)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Error("data written in order differ")
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpackTestFile(t, path, ReaderOptions{}, out)
+	out.Close()
+
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data written with holes differ")
+	}
+}
+
+func TestSparseCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		smap SparseMap
+		err  error
+	}{
+		{"valid", SparseMap{{10, 10}, {20, 10}, {90, 10}}, nil},
+		{"empty extent", SparseMap{{10, 0}, {10, 10}}, nil},
+		{"out of order", SparseMap{{50, 10}, {10, 10}}, InvalidFormat},
+		{"overlapping", SparseMap{{10, 20}, {20, 10}}, InvalidFormat},
+		{"past the end", SparseMap{{10, 10}, {90, 11}}, InvalidFormat},
+		{"far past the end", SparseMap{{1 << 40, 10}}, InvalidFormat},
+		{"overflowing", SparseMap{{10, 10}, {math.MaxUint64 - 5, 10}},
+			InvalidFormat},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		data := textData(int(min(tt.smap.DataSize(), 1000)), 1)
+		path := filepath.Join(dir, "test.kcf")
+
+		// The writer refuses such maps itself.
+		err := packSparse(t, path, tt.smap, data, 100, true)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: writer returned %v, want %v", tt.name, err,
+				tt.err)
+		}
+
+		err = packSparse(t, path, tt.smap, data, 100, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kcf, err := OpenArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = kcf.GetCurrentFile()
+		if err == nil {
+			_, err = kcf.UnpackFile(io.Discard)
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		kcf.Close()
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: reader returned %v, want %v", tt.name, err,
+				tt.err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package kcf
+
+import "syscall"
+
+// CreateSpecialFile creates a FIFO, a socket or a device file described
+// by the file header at path. Creating device files usually requires
+// privileges of the superuser.
+func CreateSpecialFile(path string, fhdr FileHeader) error {
+	var mode uint32
+	var dev uint64
+
+	switch fhdr.FileType {
+	case FIFO:
+		return syscall.Mkfifo(path, 0600)
+	case SOCKET:
+		mode = syscall.S_IFSOCK
+	case CHAR_DEVICE:
+		mode = syscall.S_IFCHR
+	case BLOCK_DEVICE:
+		mode = syscall.S_IFBLK
+	default:
+		return InvalidFormat
+	}
+
+	if (fhdr.Metadata.MetaFlags & HAS_DEVICE) != 0 {
+		major := uint64(fhdr.Metadata.DevMajor)
+		minor := uint64(fhdr.Metadata.DevMinor)
+		dev = (major&0xfffff000)<<32 | (major&0xfff)<<8 |
+			(minor&0xffffff00)<<12 | minor&0xff
+	}
+
+	return syscall.Mknod(path, mode|0600, int(dev))
+}
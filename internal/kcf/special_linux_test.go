@@ -0,0 +1,143 @@
+package kcf
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPackSpecial(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "test.kcf")
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{fifo, "/dev/null"} {
+		if err = kcf.PackPath(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kcf.Close()
+
+	kcf, err = OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		fileType     FileType
+		major, minor uint32
+	}{
+		{"fifo", FIFO, 0, 0},
+		{"/dev/null", CHAR_DEVICE, 1, 3},
+	}
+
+	for _, tt := range tests {
+		hdr, err := kcf.GetCurrentFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		meta := hdr.Metadata
+		if hdr.FileType != tt.fileType || hdr.UnpackedSize != 0 {
+			t.Errorf("%s: got type %#x of %d bytes, want %#x", tt.name,
+				hdr.FileType, hdr.UnpackedSize, tt.fileType)
+		}
+		hasDevice := meta.MetaFlags&HAS_DEVICE != 0
+		if hasDevice != (tt.fileType == CHAR_DEVICE) ||
+			meta.DevMajor != tt.major || meta.DevMinor != tt.minor {
+			t.Errorf("%s: got device %d:%d, want %d:%d", tt.name,
+				meta.DevMajor, meta.DevMinor, tt.major, tt.minor)
+		}
+
+		_, err = kcf.UnpackFile(io.Discard)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = kcf.GetCurrentFile(); err != io.EOF {
+		t.Errorf("got %v after the last file", err)
+	}
+}
+
+func TestCreateSpecialFile(t *testing.T) {
+	dir := t.TempDir()
+
+	var fifo FileHeader
+	fifo.FileType = FIFO
+
+	var null FileHeader
+	null.FileType = CHAR_DEVICE
+	null.Metadata.MetaFlags = HAS_DEVICE
+	null.Metadata.DevMajor, null.Metadata.DevMinor = 1, 3
+
+	// Device numbers beyond the 8 bits of minor of the old encoding.
+	var large FileHeader
+	large.FileType = BLOCK_DEVICE
+	large.Metadata.MetaFlags = HAS_DEVICE
+	large.Metadata.DevMajor, large.Metadata.DevMinor = 4095, 1<<19+7
+
+	tests := []struct {
+		name string
+		hdr  FileHeader
+		mode os.FileMode
+	}{
+		{"fifo", fifo, os.ModeNamedPipe},
+		{"null", null, os.ModeDevice | os.ModeCharDevice},
+		{"large", large, os.ModeDevice},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		err := CreateSpecialFile(path, tt.hdr)
+		if errors.Is(err, syscall.EPERM) {
+			t.Logf("%s: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != tt.mode {
+			t.Errorf("%s: got mode %v, want %v", tt.name, info.Mode(),
+				tt.mode)
+		}
+
+		meta := readLinkMetadata(path, info)
+		if meta.DevMajor != tt.hdr.Metadata.DevMajor ||
+			meta.DevMinor != tt.hdr.Metadata.DevMinor {
+			t.Errorf("%s: got device %d:%d, want %d:%d", tt.name,
+				meta.DevMajor, meta.DevMinor, tt.hdr.Metadata.DevMajor,
+				tt.hdr.Metadata.DevMinor)
+		}
+	}
+
+	var regular FileHeader
+	regular.FileType = REGULAR_FILE
+	err := CreateSpecialFile(filepath.Join(dir, "regular"), regular)
+	if err != InvalidFormat {
+		t.Errorf("regular file: got %v, want %v", err, InvalidFormat)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package kcf
+
+import "errors"
+
+// CreateSpecialFile creates a FIFO, a socket or a device file described
+// by the file header at path. It is not supported on this system.
+func CreateSpecialFile(path string, fhdr FileHeader) error {
+	return errors.ErrUnsupported
+}
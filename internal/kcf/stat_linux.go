@@ -0,0 +1,162 @@
+package kcf
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	_AT_FDCWD            = -100
+	_AT_EMPTY_PATH       = 0x1000
+	_AT_SYMLINK_NOFOLLOW = 0x100
+
+	_STATX_MODE  = 0x0002
+	_STATX_UID   = 0x0008
+	_STATX_GID   = 0x0010
+	_STATX_ATIME = 0x0020
+	_STATX_MTIME = 0x0040
+	_STATX_CTIME = 0x0080
+	_STATX_BTIME = 0x0800
+
+	_STATX_BASIC_STATS = 0x07ff
+
+	_S_IFMT  = 0o170000
+	_S_IFCHR = 0o020000
+	_S_IFBLK = 0o060000
+)
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// statxData is struct statx from <linux/stat.h>.
+type statxData struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	_              [14]uint64
+}
+
+func statx(dirfd int, path string, flags int, mask uint32,
+	stx *statxData) (err error) {
+	if sysStatx == 0 {
+		return syscall.ENOSYS
+	}
+
+	var p *byte
+	p, err = syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+
+	_, _, errno := syscall.Syscall6(sysStatx, uintptr(dirfd),
+		uintptr(unsafe.Pointer(p)), uintptr(flags), uintptr(mask),
+		uintptr(unsafe.Pointer(stx)), 0)
+	if errno != 0 {
+		err = errno
+	}
+
+	return
+}
+
+func (ts statxTimestamp) time() time.Time {
+	return time.Unix(ts.Sec, int64(ts.Nsec))
+}
+
+func timespecTime(ts syscall.Timespec) time.Time {
+	return time.Unix(int64(ts.Sec), int64(ts.Nsec))
+}
+
+// readMetadata collects times, permissions and owner of the opened
+// file. If statx is not available, they are taken from info.
+func readMetadata(file *os.File, info os.FileInfo) (meta FileMetadata) {
+	return statMetadata(int(file.Fd()), "", _AT_EMPTY_PATH, info)
+}
+
+// readLinkMetadata is like readMetadata, but takes the path of
+// the file and does not follow symbolic links.
+func readLinkMetadata(path string, info os.FileInfo) (meta FileMetadata) {
+	return statMetadata(_AT_FDCWD, path, _AT_SYMLINK_NOFOLLOW, info)
+}
+
+func statMetadata(dirfd int, path string, flags int, info os.FileInfo) (
+	meta FileMetadata,
+) {
+	var stx statxData
+
+	err := statx(dirfd, path, flags,
+		_STATX_BASIC_STATS|_STATX_BTIME, &stx)
+	if err == nil {
+		if stx.Mask&_STATX_MTIME != 0 {
+			meta.MetaFlags |= HAS_MTIME
+			meta.ModTime = stx.Mtime.time()
+		}
+		if stx.Mask&_STATX_ATIME != 0 {
+			meta.MetaFlags |= HAS_ATIME
+			meta.AccessTime = stx.Atime.time()
+		}
+		if stx.Mask&_STATX_CTIME != 0 {
+			meta.MetaFlags |= HAS_CTIME
+			meta.ChangeTime = stx.Ctime.time()
+		}
+		if stx.Mask&_STATX_BTIME != 0 {
+			meta.MetaFlags |= HAS_BTIME
+			meta.BirthTime = stx.Btime.time()
+		}
+		if stx.Mask&_STATX_MODE != 0 {
+			meta.MetaFlags |= HAS_MODE
+			meta.Mode = stx.Mode & (modeSetuid | modeSetgid |
+				modeSticky | modePerm)
+		}
+		if stx.Mask&(_STATX_UID|_STATX_GID) == _STATX_UID|_STATX_GID {
+			meta.setOwner(stx.Uid, stx.Gid)
+		}
+		if stx.Mode&_S_IFMT == _S_IFCHR || stx.Mode&_S_IFMT == _S_IFBLK {
+			meta.MetaFlags |= HAS_DEVICE
+			meta.DevMajor = stx.RdevMajor
+			meta.DevMinor = stx.RdevMinor
+		}
+		return
+	}
+
+	meta.MetaFlags |= HAS_MTIME | HAS_MODE
+	meta.ModTime = info.ModTime()
+	meta.Mode = unixMode(info.Mode())
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		meta.MetaFlags |= HAS_ATIME | HAS_CTIME
+		meta.AccessTime = timespecTime(st.Atim)
+		meta.ChangeTime = timespecTime(st.Ctim)
+		meta.setOwner(st.Uid, st.Gid)
+
+		if info.Mode()&os.ModeDevice != 0 {
+			rdev := uint64(st.Rdev)
+			meta.MetaFlags |= HAS_DEVICE
+			meta.DevMajor = uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+			meta.DevMinor = uint32(rdev&0xff | (rdev>>12)&^0xff)
+		}
+	}
+
+	return
+}
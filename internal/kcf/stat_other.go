@@ -0,0 +1,25 @@
+//go:build !linux
+
+package kcf
+
+import "os"
+
+// readMetadata collects file times and permissions of the opened
+// file. Only the modification time and permissions are portable.
+func readMetadata(file *os.File, info os.FileInfo) (meta FileMetadata) {
+	meta.MetaFlags |= HAS_MTIME | HAS_MODE
+	meta.ModTime = info.ModTime()
+	meta.Mode = unixMode(info.Mode())
+
+	return
+}
+
+// readLinkMetadata is like readMetadata, but takes the path of
+// the file and does not follow symbolic links.
+func readLinkMetadata(path string, info os.FileInfo) (meta FileMetadata) {
+	meta.MetaFlags |= HAS_MTIME | HAS_MODE
+	meta.ModTime = info.ModTime()
+	meta.Mode = unixMode(info.Mode())
+
+	return
+}
@@ -0,0 +1,7 @@
+//go:build linux && !(amd64 || arm64 || riscv64 || loong64 || 386 || arm || ppc64le || ppc64 || s390x)
+
+package kcf
+
+// sysStatx is zero where the statx system call number is not known,
+// so that file times are taken from stat instead.
+const sysStatx = 0
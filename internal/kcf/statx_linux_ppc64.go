@@ -0,0 +1,3 @@
+package kcf
+
+const sysStatx = 383
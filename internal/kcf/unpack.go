@@ -0,0 +1,244 @@
+package kcf
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// packedFragment is a fragment of packed data of a file whose fragments
+// are compressed independently, or of a solid block. Unpacked data of
+// independent fragments are ready once done is closed.
+type packedFragment struct {
+	offset int64
+	size   uint64
+	crc    uint32
+	hasCRC bool
+
+	data   []byte
+	length int64
+	err    error
+	done   chan struct{}
+
+	// start receives the position of unpacked data of the fragment in
+	// the output written by WriteAt, next passes the position of the
+	// following fragment on.
+	start chan int64
+	next  chan int64
+}
+
+// writerAtSeeker is an output whose position is known, such as a file,
+// so that fragments can be written at their positions in any order.
+type writerAtSeeker interface {
+	io.WriterAt
+	io.Seeker
+}
+
+// unpackFragments writes size bytes of data of the current file, whose
+// fragments are compressed independently by the block codec c, to w.
+// Up to workers fragments are read by ReadAt and unpacked at once, and
+// no more are kept until they are written, so that memory stays within
+// what workers have been limited to. If w is an io.WriterAt and
+// io.Seeker, fragments are written at their positions as soon as they
+// are unpacked, otherwise in order.
+func (kcf *Kcf) unpackFragments(w io.Writer, c codec, info uint32,
+	size uint64, workers int) (n int64, err error) {
+	wa, _ := w.(writerAtSeeker)
+
+	var base int64
+	if wa != nil {
+		base, err = wa.Seek(0, io.SeekCurrent)
+		if err != nil {
+			wa, err = nil, nil
+		}
+	}
+	end := base + int64(size)
+
+	var fragments []*packedFragment
+	var wg sync.WaitGroup
+
+	// finish waits for the first pending fragment and writes it unless
+	// it has been written at its position.
+	finish := func() error {
+		frag := fragments[0]
+		fragments = fragments[1:]
+
+		<-frag.done
+		if frag.err != nil {
+			return frag.err
+		}
+
+		n += frag.length
+		if uint64(n) > size {
+			return InvalidAddedData
+		}
+
+		if wa == nil {
+			_, err := w.Write(frag.data)
+			return err
+		}
+
+		return nil
+	}
+
+	next := make(chan int64, 1)
+	next <- base
+
+	for err == nil {
+		if len(fragments) == workers {
+			if err = finish(); err != nil {
+				break
+			}
+		}
+
+		frag := &packedFragment{
+			done:  make(chan struct{}),
+			start: next,
+			next:  make(chan int64, 1),
+		}
+		next = frag.next
+
+		if kcf.state.GetStage() == stageRecordAddedData {
+			if err = kcf.locateFragment(frag); err != nil {
+				break
+			}
+		}
+
+		fragments = append(fragments, frag)
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer close(frag.done)
+
+			kcf.unpackFragment(frag, c, paramsOf(info))
+			if wa == nil {
+				return
+			}
+
+			// The position of the following fragment is passed on
+			// even after an error, so that none of them waits for
+			// it forever.
+			start := <-frag.start
+			frag.next <- start + frag.length
+			if frag.err != nil {
+				return
+			}
+
+			if start+frag.length > end {
+				frag.err = InvalidAddedData
+				return
+			}
+
+			_, frag.err = wa.WriteAt(frag.data, start)
+			frag.data = nil
+		}()
+
+		if kcf.lastRecord.HeadFlags&0x01 == 0 {
+			break
+		}
+
+		err = (&fragmentReader{kcf: kcf}).nextFragment()
+	}
+
+	for err == nil && len(fragments) > 0 {
+		err = finish()
+	}
+
+	// Fragments still being unpacked after an error are left to end.
+	wg.Wait()
+	if err != nil {
+		return
+	}
+
+	if uint64(n) != size {
+		return n, InvalidAddedData
+	}
+
+	if wa != nil {
+		_, err = wa.Seek(base+n, io.SeekStart)
+	}
+
+	return
+}
+
+// locateFragment notes the position of the added data of the last
+// record in frag and skips them, so that they can be read by ReadAt
+// later.
+func (kcf *Kcf) locateFragment(frag *packedFragment) (err error) {
+	frag.size = kcf.available
+	frag.crc = kcf.validCrc
+	frag.hasCRC = kcf.state.HasAddedCRC()
+
+	frag.offset, err = kcf.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	_, err = kcf.file.Seek(int64(frag.size), io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	kcf.state.SetStage(stageRecordHeader)
+	return
+}
+
+// readFragment reads the packed data of the fragment by ReadAt and
+// checks their CRC32.
+func (kcf *Kcf) readFragment(frag *packedFragment) (
+	packed []byte,
+	err error,
+) {
+	packed = make([]byte, frag.size)
+	_, err = kcf.file.ReadAt(packed, frag.offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+	if frag.hasCRC && crc32.Checksum(packed, crc32c_table) != frag.crc {
+		return nil, InvalidAddedData
+	}
+
+	return
+}
+
+// unpackFragment reads the packed data of the fragment and unpacks them
+// by the codec c.
+func (kcf *Kcf) unpackFragment(frag *packedFragment, c codec,
+	params uint32) {
+	var packed []byte
+
+	packed, frag.err = kcf.readFragment(frag)
+	if frag.err != nil {
+		return
+	}
+
+	var r io.Reader
+	r, frag.err = c.newReader(bytes.NewReader(packed), params)
+	if frag.err != nil {
+		return
+	}
+
+	// A fragment holds one block, so more data than that mean the
+	// archive is corrupt and are not kept.
+	limit := c.(blockCodec).blockSize(params)
+
+	var buf bytes.Buffer
+	buf.Grow(limit)
+
+	_, frag.err = buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if frag.err == nil && buf.Len() > limit {
+		frag.err = InvalidFormat
+	}
+	if frag.err != nil {
+		return
+	}
+
+	frag.data = buf.Bytes()
+	frag.length = int64(len(frag.data))
+}
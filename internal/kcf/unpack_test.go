@@ -0,0 +1,182 @@
+package kcf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnpackFragments(t *testing.T) {
+	// Blocks of 64 KiB make the file a few dozens of fragments.
+	info := compressionInfo(METHOD_LZ4, lz4MinBlockLog)
+	data := append(textData(1<<20, 1), randomData(300<<10+5, 2)...)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.kcf")
+	packTestFile(t, path, info, nil, data)
+
+	kcf, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := kcf.GetCurrentFile()
+	kcf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.FileFlags&INDEPENDENT_FRAGMENTS == 0 {
+		t.Fatal("fragments of the file are not independent")
+	}
+
+	prefix := []byte("data before the file")
+	for _, workers := range []int{1, 2, 4, 64} {
+		opts := ReaderOptions{Workers: workers}
+
+		// A buffer gets fragments in order.
+		var buf bytes.Buffer
+		unpackTestFile(t, path, opts, &buf)
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("%d workers: data written in order differ",
+				workers)
+		}
+
+		// A file gets fragments at their positions by WriteAt.
+		out, err := os.Create(filepath.Join(dir, "out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(prefix)
+		unpackTestFile(t, path, opts, out)
+
+		pos, err := out.Seek(0, io.SeekCurrent)
+		out.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != int64(len(prefix)+len(data)) {
+			t.Errorf("%d workers: file position is %d, want %d",
+				workers, pos, len(prefix)+len(data))
+		}
+
+		got, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(prefix, data...)) {
+			t.Errorf("%d workers: data written by WriteAt differ",
+				workers)
+		}
+	}
+}
+
+// packFragments creates an archive at path holding one regular file of
+// size bytes with data packed by the method of info and split into
+// independent fragments as given by frags.
+func packFragments(t *testing.T, path string, info uint32, size int,
+	frags [][]byte) {
+	t.Helper()
+
+	kcf, err := CreateNewArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcf.Close()
+
+	if err = kcf.InitArchive(); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr FileHeader
+	hdr.FileName = "file"
+	hdr.FileType = REGULAR_FILE
+	hdr.FileFlags = INDEPENDENT_FRAGMENTS
+	hdr.CompressionInfo = info
+	hdr.SetUnpackedSize(uint64(size))
+
+	enc := &spill{}
+	defer enc.close()
+	for _, frag := range frags {
+		if err = enc.writeFragment(frag, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = kcf.writeEncoded(hdr, enc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackFragmentsCorrupt(t *testing.T) {
+	info := compressionInfo(METHOD_LZ4, lz4MinBlockLog)
+	data := textData(1<<20, 1)
+	dir := t.TempDir()
+
+	// A bit flipped in the middle of packed data.
+	corrupt := filepath.Join(dir, "corrupt.kcf")
+	packTestFile(t, corrupt, info, nil, data)
+
+	archive, err := os.ReadFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[len(archive)/2] ^= 0x55
+	if err = os.WriteFile(corrupt, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// All blocks of the file in a single fragment, which unpacks to
+	// far more than a block.
+	c, err := codecOf(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packed bytes.Buffer
+	w, err := c.newWriter(&packed, paramsOf(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	oversized := filepath.Join(dir, "oversized.kcf")
+	packFragments(t, oversized, info, len(data), [][]byte{packed.Bytes()})
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+	}{
+		{"corrupt", corrupt, nil},
+		{"oversized", oversized, InvalidFormat},
+	}
+
+	for _, tt := range tests {
+		kcf, err := OpenArchive(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		kcf.SetReaderOptions(ReaderOptions{Workers: 4})
+
+		if _, err = kcf.GetCurrentFile(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = kcf.UnpackFile(&bytes.Buffer{})
+		kcf.Close()
+		if err == nil {
+			t.Errorf("%s: fragment has been unpacked", tt.name)
+		} else if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package kcf
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// fileTypeOf returns the type of archived file for the file mode.
+func fileTypeOf(mode os.FileMode) FileType {
+	switch {
+	case mode.IsDir():
+		return DIRECTORY
+	case mode&os.ModeSymlink != 0:
+		return SYMLINK
+	case mode&os.ModeNamedPipe != 0:
+		return FIFO
+	case mode&os.ModeSocket != 0:
+		return SOCKET
+	case mode&os.ModeCharDevice != 0:
+		return CHAR_DEVICE
+	case mode&os.ModeDevice != 0:
+		return BLOCK_DEVICE
+	}
+
+	return REGULAR_FILE
+}
+
+// IsUpToDate reports whether the archived file has the same type, size
+// and modification time as the file described by info. Fields absent
+// from the file header are not compared. Symbolic links are compared
+// to the links themselves, so info should come from os.Lstat.
+func (fhdr FileHeader) IsUpToDate(info os.FileInfo) bool {
+	// Hard links have no attributes of their own to compare.
+	if fhdr.FileType == HARDLINK {
+		return info.Mode().IsRegular()
+	}
+
+	if fileTypeOf(info.Mode()) != fhdr.FileType {
+		return false
+	}
+
+	if info.IsDir() {
+		return true
+	}
+
+	if uint64(info.Size()) != fhdr.UnpackedSize {
+		return false
+	}
+
+	if (fhdr.Metadata.MetaFlags & HAS_MTIME) != 0 {
+		if !fhdr.ModTime().Equal(info.ModTime()) {
+			return false
+		}
+	} else if (fhdr.FileFlags & HAS_TIMESTAMP) != 0 {
+		if !fhdr.ModTime().Equal(info.ModTime().Truncate(time.Second)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HasSameCRC32 reports whether data read from r has the same CRC32C as
+// the archived file. If the file header has no CRC32, it returns true.
+func (fhdr FileHeader) HasSameCRC32(r io.Reader) (same bool, err error) {
+	if (fhdr.FileFlags & HAS_FILE_CRC32) == 0 {
+		return true, nil
+	}
+
+	crc32c_table := crc32.MakeTable(crc32.Castagnoli)
+	crc32c := crc32.New(crc32c_table)
+
+	_, err = io.Copy(crc32c, r)
+	if err != nil {
+		return
+	}
+
+	same = crc32c.Sum32() == fhdr.FileCRC32
+	return
+}
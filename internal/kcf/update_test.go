@@ -0,0 +1,104 @@
+package kcf
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	// file returns the header of an archived regular file of size bytes
+	// modified at mtime, which metadata hold if precise is set.
+	file := func(size uint64, mtime time.Time, precise bool) (
+		hdr FileHeader,
+	) {
+		hdr.FileType = REGULAR_FILE
+		hdr.SetUnpackedSize(size)
+		if precise {
+			hdr.Metadata.MetaFlags |= HAS_MTIME
+		}
+		hdr.SetModTime(mtime)
+		return
+	}
+
+	tests := []struct {
+		name string
+		hdr  FileHeader
+		path string
+		want bool
+	}{
+		{"same", file(4, mtime, true), path, true},
+		{"same seconds", file(4, mtime.Truncate(time.Second), false),
+			path, true},
+		{"no time", file(4, time.Time{}, false), path, true},
+		{"size", file(5, mtime, true), path, false},
+		{"mtime", file(4, mtime.Add(time.Second), true), path, false},
+		{"mtime nanoseconds", file(4, mtime.Add(1), true), path, false},
+		{"mtime seconds", file(4, mtime.Add(time.Second), false), path,
+			false},
+		{"type", FileHeader{FileType: SYMLINK}, path, false},
+		{"symlink", file(4, mtime, true), link, false},
+		{"directory", FileHeader{FileType: DIRECTORY}, dir, true},
+		{"hard link", FileHeader{FileType: HARDLINK}, path, true},
+		{"hard link to directory", FileHeader{FileType: HARDLINK}, dir,
+			false},
+	}
+
+	for _, tt := range tests {
+		info, err := os.Lstat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tt.hdr.IsUpToDate(info); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHasSameCRC32(t *testing.T) {
+	data := []byte("archived data")
+	crc := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+
+	tests := []struct {
+		name  string
+		flags FileFlags
+		data  string
+		want  bool
+	}{
+		{"same", HAS_FILE_CRC32, "archived data", true},
+		{"changed", HAS_FILE_CRC32, "archived date", false},
+		{"empty", HAS_FILE_CRC32, "", false},
+		{"no CRC32", 0, "archived date", true},
+	}
+
+	for _, tt := range tests {
+		hdr := FileHeader{FileFlags: tt.flags, FileCRC32: crc}
+
+		got, err := hdr.HasSameCRC32(bytes.NewReader([]byte(tt.data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
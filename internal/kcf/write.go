@@ -20,15 +20,27 @@ func (kcf *Kcf) writeRecord(rec Record) (n int64, err error) {
 		panic(InvalidState)
 	}
 
+	err = kcf.useVersion(recordVersion(rec.HeadType))
+	if err != nil {
+		return
+	}
+
 	kcf.recOffset, err = kcf.file.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return
 	}
 
 	n, err = rec.WriteTo(kcf.file)
+	if err != nil {
+		return
+	}
+
+	kcf.lastRecord = rec
+	kcf.state.SetHasAddedCRC(false)
+	kcf.state.SetAddedCRCKnown(false)
 	if rec.HeadFlags&HAS_ADDED_4 != 0 {
 		kcf.state.SetStage(stageRecordAddedData)
-		kcf.lastRecord = rec
+		kcf.written = 0
 
 		kcf.addedWriter.W = kcf.file
 		if rec.AddedDataSize > 0 {
@@ -134,7 +146,9 @@ func (kcf *Kcf) finishAddedData() (err error) {
 	}
 
 	_, _ = kcf.file.Seek(kcf.recOffset, io.SeekStart)
-	kcf.lastRecord.AddedDataCRC32 = kcf.crc32.Sum32()
+	if kcf.state.HasAddedCRC() {
+		kcf.lastRecord.AddedDataCRC32 = kcf.crc32.Sum32()
+	}
 	kcf.lastRecord.AddedDataSize = kcf.written
 	kcf.lastRecord.Fix()
 	_, err = kcf.lastRecord.WriteTo(kcf.file)
@@ -144,7 +158,40 @@ func (kcf *Kcf) finishAddedData() (err error) {
 	_, _ = kcf.file.Seek(kcf.recEndOffset, io.SeekStart)
 
 	kcf.state.SetStage(stageRecordHeader)
+	kcf.state.SetAddedSizeKnown(false)
+	kcf.state.SetHasAddedCRC(false)
+
+	return
+}
+
+// rewriteRecord overwrites the record previously written at offset.
+// The new record must have the same size as the old one.
+func (kcf *Kcf) rewriteRecord(offset int64, rec Record) (err error) {
+	if !kcf.state.IsWriting() {
+		panic(InvalidState)
+	}
+
+	if kcf.state.GetStage() != stageRecordHeader {
+		panic(InvalidState)
+	}
+
+	var endOffset int64
+	endOffset, err = kcf.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	_, err = kcf.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	_, err = rec.WriteTo(kcf.file)
+	if err != nil {
+		return
+	}
 
+	_, err = kcf.file.Seek(endOffset, io.SeekStart)
 	return
 }
 
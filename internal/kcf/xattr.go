@@ -0,0 +1,133 @@
+package kcf
+
+import "strings"
+
+// Xattr is an extended attribute of a file.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// Xattrs is a list of extended attributes of a file. It is stored in
+// the record header if it fits there and as added data otherwise.
+type Xattrs []Xattr
+
+// XattrFilter selects extended attributes by their namespaces, such as
+// "user", "trusted", "security" or "system". The namespace is the part
+// of the name before the first dot. Empty Include selects all
+// namespaces. Exclude takes precedence over Include.
+type XattrFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (filter XattrFilter) Match(name string) bool {
+	namespace, _, _ := strings.Cut(name, ".")
+
+	for _, ns := range filter.Exclude {
+		if ns == namespace {
+			return false
+		}
+	}
+
+	if len(filter.Include) == 0 {
+		return true
+	}
+
+	for _, ns := range filter.Include {
+		if ns == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter returns attributes matching the filter.
+func (xattrs Xattrs) Filter(filter XattrFilter) (result Xattrs) {
+	for _, xattr := range xattrs {
+		if filter.Match(xattr.Name) {
+			result = append(result, xattr)
+		}
+	}
+
+	return
+}
+
+// AsRecord returns the extended attributes record. If the attributes
+// do not fit into the record, they are returned as its added data.
+func (xattrs Xattrs) AsRecord() (rec Record, data []byte, err error) {
+	rec.HeadType = XATTRS
+
+	list := make([]byte, 0)
+	for _, xattr := range xattrs {
+		if len(xattr.Name) > 255 || uint64(len(xattr.Value)) > 0xFFFFFFFF {
+			err = TooBigRecordData
+			return
+		}
+
+		list = append(list, uint8(len(xattr.Name)))
+		list = append(list, xattr.Name...)
+		list = le.AppendUint32(list, uint32(len(xattr.Value)))
+		list = append(list, xattr.Value...)
+	}
+
+	rec.Data = list
+	err = rec.Fix()
+	if err == TooBigRecordData {
+		rec.Data = nil
+		data = list
+		err = rec.Fix()
+	}
+
+	return
+}
+
+func RecordToXattrs(rec Record, data []byte) (
+	xattrs Xattrs,
+	err error,
+) {
+	if !rec.ValidateCRC() {
+		err = CorruptedRecordData
+		return
+	}
+
+	if rec.HeadType != XATTRS {
+		err = InvalidFormat
+		return
+	}
+
+	list := rec.Data
+	if len(data) > 0 {
+		list = data
+	}
+
+	for ptr := 0; ptr < len(list); {
+		var xattr Xattr
+
+		nameSize := int(list[ptr])
+		ptr += 1
+		if len(list) < ptr+nameSize+4 {
+			err = CorruptedRecordData
+			return
+		}
+
+		xattr.Name = string(list[ptr : ptr+nameSize])
+		ptr += nameSize
+
+		valueSize := uint64(le.Uint32(list[ptr:]))
+		ptr += 4
+		if uint64(len(list)-ptr) < valueSize {
+			err = CorruptedRecordData
+			return
+		}
+
+		xattr.Value = make([]byte, valueSize)
+		copy(xattr.Value, list[ptr:])
+		ptr += int(valueSize)
+
+		xattrs = append(xattrs, xattr)
+	}
+
+	return
+}
@@ -0,0 +1,95 @@
+package kcf
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// readXattrs returns extended attributes of the file at path matching
+// the filter. POSIX ACLs and file capabilities are stored as
+// system.posix_acl_* and security.capability attributes.
+func readXattrs(path string, filter XattrFilter) (xattrs Xattrs, err error) {
+	var names []byte
+
+	names, err = xattrCall(func(buf []byte) (int, error) {
+		return syscall.Listxattr(path, buf)
+	})
+	if err != nil {
+		if isXattrUnsupported(err) {
+			err = nil
+		}
+		return
+	}
+
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" || !filter.Match(name) {
+			continue
+		}
+
+		var value []byte
+		value, err = xattrCall(func(buf []byte) (int, error) {
+			return syscall.Getxattr(path, name, buf)
+		})
+		if errors.Is(err, syscall.ENODATA) ||
+			errors.Is(err, syscall.EPERM) ||
+			errors.Is(err, syscall.EACCES) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		xattrs = append(xattrs, Xattr{Name: name, Value: value})
+	}
+
+	sort.Slice(xattrs, func(i, j int) bool {
+		return xattrs[i].Name < xattrs[j].Name
+	})
+
+	return
+}
+
+// xattrCall calls a function filling buf, growing buf while it is too
+// small for the result.
+func xattrCall(call func(buf []byte) (int, error)) (data []byte, err error) {
+	for {
+		var size int
+
+		size, err = call(nil)
+		if err != nil || size == 0 {
+			return
+		}
+
+		data = make([]byte, size)
+		size, err = call(data)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return data[:size], nil
+	}
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// RestoreXattrs sets extended attributes of the file at path. All the
+// attributes are tried, the first error is returned.
+func RestoreXattrs(path string, xattrs Xattrs) (err error) {
+	for _, xattr := range xattrs {
+		err1 := syscall.Setxattr(path, xattr.Name, xattr.Value, 0)
+		if err1 != nil && err == nil {
+			err = &XattrError{Path: path, Name: xattr.Name, Err: err1}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,99 @@
+package kcf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestPackXattrs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := Xattrs{
+		{"trusted.kcf", []byte("trusted")},
+		{"user.a", []byte("a")},
+		{"user.b", nil},
+	}
+	for _, xattr := range xattrs {
+		err := syscall.Setxattr(path, xattr.Name, xattr.Value, 0)
+		if isXattrUnsupported(err) || err == syscall.EPERM {
+			t.Skip(err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter XattrFilter
+		want   []string
+	}{
+		{"all", XattrFilter{}, []string{"trusted.kcf", "user.a",
+			"user.b"}},
+		{"include", XattrFilter{Include: []string{"user"}},
+			[]string{"user.a", "user.b"}},
+		{"exclude", XattrFilter{Exclude: []string{"user"}},
+			[]string{"trusted.kcf"}},
+	}
+
+	for _, tt := range tests {
+		archive := filepath.Join(dir, "test.kcf")
+		kcf, err := CreateNewArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kcf.SetWriterOptions(WriterOptions{XattrFilter: tt.filter})
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.PackPath(path); err != nil {
+			t.Fatal(err)
+		}
+		kcf.Close()
+
+		kcf, err = OpenArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = kcf.InitArchive(); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := kcf.GetCurrentFile()
+		kcf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, xattr := range hdr.Xattrs {
+			got = append(got, xattr.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		// Restored attributes read back the same.
+		out := filepath.Join(dir, tt.name)
+		if err = os.WriteFile(out, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = RestoreXattrs(out, hdr.Xattrs); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := readXattrs(out, XattrFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restored) != len(hdr.Xattrs) {
+			t.Errorf("%s: restored %d attributes, want %d", tt.name,
+				len(restored), len(hdr.Xattrs))
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package kcf
+
+// readXattrs returns extended attributes of the file at path. They
+// are not supported on this system.
+func readXattrs(path string, filter XattrFilter) (xattrs Xattrs, err error) {
+	return
+}
+
+// RestoreXattrs sets extended attributes of the file at path. They
+// are not supported on this system, so the attributes are dropped.
+func RestoreXattrs(path string, xattrs Xattrs) (err error) {
+	return
+}
@@ -0,0 +1,118 @@
+package kcf
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestXattrFilter(t *testing.T) {
+	xattrs := Xattrs{
+		{"security.capability", []byte{1}},
+		{"system.posix_acl_access", []byte{2}},
+		{"trusted.overlay", []byte{3}},
+		{"user.a", []byte{4}},
+		{"user.b.c", nil},
+		{"userx", []byte{5}},
+	}
+
+	tests := []struct {
+		name   string
+		filter XattrFilter
+		want   []string
+	}{
+		{"all", XattrFilter{}, []string{"security.capability",
+			"system.posix_acl_access", "trusted.overlay", "user.a",
+			"user.b.c", "userx"}},
+		{"include", XattrFilter{Include: []string{"user", "system"}},
+			[]string{"system.posix_acl_access", "user.a", "user.b.c"}},
+		{"exclude", XattrFilter{Exclude: []string{"trusted",
+			"security"}}, []string{"system.posix_acl_access", "user.a",
+			"user.b.c", "userx"}},
+		{"both", XattrFilter{Include: []string{"user", "trusted"},
+			Exclude: []string{"trusted"}}, []string{"user.a", "user.b.c"}},
+		{"none", XattrFilter{Include: []string{"nothing"}}, nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, xattr := range xattrs.Filter(tt.filter) {
+			got = append(got, xattr.Name)
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXattrsRoundTrip(t *testing.T) {
+	small := Xattrs{
+		{"user.empty", nil},
+		{"user.comment", []byte("text")},
+		{"system.posix_acl_access", []byte{2, 0, 0, 0, 1, 0, 6, 0}},
+	}
+
+	// Attributes too large for the record go to its added data.
+	large := Xattrs{
+		{"user.large", bytes.Repeat([]byte("x"), 70000)},
+		{"user.small", []byte("y")},
+	}
+
+	tests := []struct {
+		name   string
+		xattrs Xattrs
+		added  bool
+	}{
+		{"small", small, false},
+		{"large", large, true},
+	}
+
+	var hdrs []FileHeader
+	for _, tt := range tests {
+		rec, data, err := tt.xattrs.AsRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(data) > 0) != tt.added {
+			t.Errorf("%s: %d bytes of added data", tt.name, len(data))
+		}
+
+		// Lists cut short are refused.
+		list := rec.Data
+		if tt.added {
+			list = data
+		}
+		for _, n := range []int{1, len(list) - 1} {
+			short := Record{HeadType: XATTRS}
+			short.Data = list[:n]
+			short.Fix()
+
+			_, err = RecordToXattrs(short, nil)
+			if err != CorruptedRecordData {
+				t.Errorf("%s: list of %d bytes: got %v", tt.name, n, err)
+			}
+		}
+
+		hdrs = append(hdrs, FileHeader{
+			FileName: tt.name,
+			FileType: REGULAR_FILE,
+			Xattrs:   tt.xattrs,
+		})
+	}
+
+	got := packHeaders(t, filepath.Join(t.TempDir(), "test.kcf"), hdrs)
+	if len(got) != len(tests) {
+		t.Fatalf("got %d files, want %d", len(got), len(tests))
+	}
+
+	for i, tt := range tests {
+		equal := func(a, b Xattr) bool {
+			return a.Name == b.Name && bytes.Equal(a.Value, b.Value)
+		}
+		if !slices.EqualFunc(got[i].Xattrs, tt.xattrs, equal) {
+			t.Errorf("%s: extended attributes differ", tt.name)
+		}
+	}
+}